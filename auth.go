@@ -0,0 +1,187 @@
+package photosync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/garyburd/go-oauth/oauth"
+)
+
+// the callback to give Flickr when there is nowhere for it to redirect to
+const OobCallback = "oob"
+
+// Flickr permission levels, each includes the ones before it
+var authPerms = []string{"read", "write", "delete"}
+
+// permissions asked for when the config doesn't say. Uploading needs write.
+const DefaultAuthPerms = "write"
+
+// Check the permission level is one Flickr knows about. Empty means the default.
+func ValidAuthPerms(perms string) error {
+	if len(perms) == 0 {
+		return nil
+	}
+	for _, p := range authPerms {
+		if p == perms {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown perms %q, must be one of %s", perms, strings.Join(authPerms, ", "))
+}
+
+// Start the OAuth flow. Returns the temporary credentials to hand back to
+// Authorize and the url the user needs to visit to grant access. Use
+// OobCallback for the callback when Flickr should just show the verifier.
+func (this *FlickrAPI) RequestAuthorization(callbackURL, perms string) (*oauth.Credentials, string, error) {
+	if len(perms) == 0 {
+		perms = DefaultAuthPerms
+	}
+	if err := ValidAuthPerms(perms); err != nil {
+		return nil, "", err
+	}
+
+	tmp, err := this.oauthClient.RequestTemporaryCredentials(this.client, callbackURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return tmp, this.oauthClient.AuthorizationURL(tmp, url.Values{"perms": {perms}}), nil
+}
+
+// Finish the OAuth flow with the verifier the user got back from Flickr. The
+// access credentials are used for the rest of the api calls and returned so
+// they can be saved. The values hold what Flickr says about the user
+// (user_nsid, username, fullname).
+func (this *FlickrAPI) Authorize(tmp *oauth.Credentials, verifier string) (*oauth.Credentials, url.Values, error) {
+	access, vals, err := this.oauthClient.RequestToken(this.client, tmp, verifier)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	this.config.Access = *access
+	if id := vals.Get("user_nsid"); len(id) > 0 {
+		this.FlickrUserId = id
+	}
+
+	return access, vals, nil
+}
+
+// Write the access credentials into the config file. Everything else in the
+// file is kept, in the same order, though it gets re-indented.
+func SaveAccess(configPath string, access *oauth.Credentials) error {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	keys, vals, err := readObject(b)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", configPath, err)
+	}
+
+	// lower case keys to match the sample config
+	accessJson, err := json.Marshal(struct {
+		Token  string `json:"token"`
+		Secret string `json:"secret"`
+	}{access.Token, access.Secret})
+	if err != nil {
+		return err
+	}
+
+	// the config loads case insensitively so match it the same way
+	found := false
+	for i, k := range keys {
+		if strings.EqualFold(k, "access") {
+			vals[i] = accessJson
+			found = true
+		}
+	}
+	if !found {
+		keys = append(keys, "access")
+		vals = append(vals, accessJson)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("{\n")
+	for i, k := range keys {
+		kb, _ := json.Marshal(k)
+		out.WriteString("  ")
+		out.Write(kb)
+		out.WriteString(": ")
+		if err := json.Indent(&out, vals[i], "  ", "  "); err != nil {
+			return err
+		}
+		if i < len(keys)-1 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n")
+	}
+	out.WriteString("}\n")
+
+	// write it next to the original and swap it in so a failure can't leave half a config
+	tmp, err := ioutil.TempFile(filepath.Dir(configPath), filepath.Base(configPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), configPath)
+}
+
+// The keys and raw values of a json object in the order they appear
+func readObject(b []byte) ([]string, []json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return nil, nil, fmt.Errorf("expected an object")
+	}
+
+	var keys []string
+	var vals []json.RawMessage
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("expected an object key")
+		}
+
+		var val json.RawMessage
+		if err := dec.Decode(&val); err != nil {
+			return nil, nil, err
+		}
+
+		keys = append(keys, key)
+		vals = append(vals, val)
+	}
+
+	return keys, vals, nil
+}
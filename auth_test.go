@@ -0,0 +1,85 @@
+package photosync_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Reisender/photosync"
+	"github.com/Reisender/photosync/photosynctest"
+)
+
+// The whole OAuth handshake, from the request token to the saved access token
+func TestAuth(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	cfg := srv.Config()
+	cfg.Access.Token, cfg.Access.Secret = "", ""
+	api := photosync.NewFlickrAPI(&cfg)
+
+	if _, _, err := api.RequestAuthorization(photosync.OobCallback, "admin"); err == nil {
+		t.Fatal("asked for unknown perms")
+	}
+
+	tmp, authURL, err := api.RequestAuthorization(photosync.OobCallback, "delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fake approves right away and shows the verifier
+	resp, err := http.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	verifier := strings.TrimSpace(string(b))
+
+	if _, _, err := api.Authorize(tmp, "wrong"); err == nil {
+		t.Fatal("authorized with the wrong verifier")
+	}
+	access, vals, err := api.Authorize(tmp, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access.Token != "access-token" || access.Secret != "access-secret" || vals.Get("username") != srv.Username {
+		t.Fatalf("access %+v %v", access, vals)
+	}
+	if api.FlickrUserId != srv.UserId {
+		t.Error("user id", api.FlickrUserId)
+	}
+	if perms := srv.GrantedPerms(); perms != "delete" {
+		t.Error("granted perms", perms)
+	}
+
+	// the rest of the config is kept as it was
+	path := filepath.Join(tempDir(t), "config.json")
+	config := `{"consumer": {"token": "consumer-key", "secret": "consumer-secret"}, "access": {"token": "", "secret": ""}, "perms": "delete", "jobs": 3}`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := photosync.SaveAccess(path, access); err != nil {
+		t.Fatal(err)
+	}
+	saved := photosync.PhotosyncConfig{}
+	if err := photosync.LoadConfig(&path, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Access != *access || saved.Consumer.Token != "consumer-key" || saved.Perms != "delete" || saved.Jobs != 3 {
+		t.Fatalf("saved %+v", saved)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Fatal("config mode", info.Mode())
+	}
+
+	// and the new token works
+	cfg.Access = saved.Access
+	if _, err := photosync.NewFlickrAPI(&cfg).GetLogin(); err != nil {
+		t.Fatal(err)
+	}
+}
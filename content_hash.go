@@ -0,0 +1,58 @@
+package photosync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// Uploads are tagged with a machine tag holding the sha256 of the original file
+// so they can be matched up by content no matter what they are named.
+const HashMachineTagPrefix = "photosync:sha256="
+
+// Photos keyed by content hash
+type HashesMap map[string]Photo
+
+func HashMachineTag(hash string) string {
+	return HashMachineTagPrefix + hash
+}
+
+// The content hash from the photo's machine tags. Empty if it was never tagged.
+func (this Photo) ContentHash() string {
+	for _, tag := range strings.Fields(this.MachineTags) {
+		if strings.HasPrefix(tag, HashMachineTagPrefix) {
+			return tag[len(HashMachineTagPrefix):]
+		}
+	}
+	return ""
+}
+
+// Index the photos that carry a content hash machine tag
+func IndexByHash(maps ...*PhotosMap) HashesMap {
+	hashes := make(HashesMap)
+	for _, m := range maps {
+		for _, p := range *m {
+			if hash := p.ContentHash(); len(hash) > 0 {
+				hashes[hash] = p
+			}
+		}
+	}
+	return hashes
+}
+
+// Hex encoded sha256 of the file contents
+func FileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
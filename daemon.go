@@ -0,0 +1,533 @@
+package photosync
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The folders being watched. Watchers only watch the folder they are given
+// so every folder under the watched directories gets its own watch, from the
+// kind of watcher the directory's config asks for. The events and errors of
+// all the watchers come out of the same channels.
+type watchedDirs struct {
+	events chan WatchEvent
+	errors chan error
+	done   chan struct{}
+
+	mu       sync.Mutex
+	watchers map[string]Watcher // by kind and poll interval, started when first needed
+	dirs     map[string]Watcher // what watches each folder
+}
+
+func newWatchedDirs() *watchedDirs {
+	return &watchedDirs{
+		events:   make(chan WatchEvent),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+		watchers: make(map[string]Watcher),
+		dirs:     make(map[string]Watcher),
+	}
+}
+
+// Watch the folder and everything under it apart from what the dir config
+// ignores. Calls fn for the files found along the way when it isn't nil.
+func (this *watchedDirs) addTree(dirCfg *WatchDirConfig, root string, fn func(path string, f os.FileInfo)) error {
+	return filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			log.Println("error watching", path, err)
+			return nil
+		}
+		if dirCfg.Ignores(path) {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !f.IsDir() {
+			if fn != nil {
+				fn(path, f)
+			}
+			return nil
+		}
+
+		if err := this.add(dirCfg, path); err != nil {
+			if path == root {
+				return err
+			}
+			log.Println("error watching", path, err)
+		}
+		return nil
+	})
+}
+
+// Watch one folder, moving it to another watcher if the config changed
+func (this *watchedDirs) add(dirCfg *WatchDirConfig, path string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	kind := dirCfg.GetWatcher()
+	if kind == WatcherPoll {
+		kind += " " + dirCfg.GetPollInterval().String()
+	}
+	w, ok := this.watchers[kind]
+	if !ok {
+		var err error
+		if w, err = NewWatcher(dirCfg); err != nil {
+			return err
+		}
+		this.watchers[kind] = w
+		go this.forward(w)
+	}
+
+	if err := w.Add(path); err != nil {
+		return err
+	}
+	if old, ok := this.dirs[path]; ok && old != w {
+		old.Remove(path)
+	}
+	this.dirs[path] = w
+	return nil
+}
+
+// Pass on what a watcher reports until the watchers are closed
+func (this *watchedDirs) forward(w Watcher) {
+	for {
+		select {
+		case <-this.done:
+			return
+		case event, ok := <-w.Events():
+			if !ok {
+				return
+			}
+			select {
+			case this.events <- event:
+			case <-this.done:
+				return
+			}
+		case err, ok := <-w.Errors():
+			if !ok {
+				return
+			}
+			select {
+			case this.errors <- err:
+			case <-this.done:
+				return
+			}
+		}
+	}
+}
+
+// Stop watching a folder that was deleted or moved away, and the ones under it
+func (this *watchedDirs) remove(path string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	for dir, w := range this.dirs {
+		if dir == path || strings.HasPrefix(dir, prefix) {
+			w.Remove(dir) // fails when the watch went with the folder
+			delete(this.dirs, dir)
+		}
+	}
+}
+
+// Stop all the watchers
+func (this *watchedDirs) close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	close(this.done)
+	for _, w := range this.watchers {
+		w.Close()
+	}
+}
+
+// Watch the configured directories and sync files as they appear, until the
+// context is done
+func (this *syncer) daemon() {
+	log.Println("starting...")
+	this.start()
+	this.backlogReady = make(chan struct{}, 1)
+	applied := make(chan struct{})
+	go func() {
+		defer close(applied)
+		this.applyBacklog()
+	}()
+
+	watched := newWatchedDirs()
+	settle := newSettler(this.ctx, this.config.Settle.Duration())
+
+	// reload the config when it's saved, once the save is done
+	configPath, configEvents, closeConfig := this.watchConfig()
+	defer closeConfig()
+	configSettle := newSettler(this.ctx, this.config.Settle.Duration())
+
+	// rescans leave files that are still changing to settle first
+	this.holdBack = func(path string, f os.FileInfo) bool {
+		if settle.has(path) {
+			return true
+		}
+		if time.Since(f.ModTime()) < settle.wait {
+			settle.touch(path)
+			return true
+		}
+		return false
+	}
+
+	// watch before the loop starts, a reload in it changes the config
+	for i := range this.config.WatchDir {
+		dir := &this.config.WatchDir[i]
+
+		// ensure the path exists
+		if _, err := os.Stat(dir.Dir); os.IsNotExist(err) {
+			fmt.Fprintf(this.out, "no such file or directory: %s", dir.Dir)
+			continue
+		}
+
+		if err := watched.addTree(dir, dir.Dir, nil); err != nil {
+			log.Println("error watching", dir.Dir, err)
+			continue
+		}
+	}
+
+	var background sync.WaitGroup
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+
+		// catch up on what the watcher missed now and then, and on Flickr
+		// less often. Both run beside the loop, one at a time each, and a
+		// refresh rescans when done.
+		rescan := newTicker(this.config.Rescan.Duration())
+		refresh := newTicker(this.config.RemoteRefresh.Duration())
+		defer func() {
+			rescan.Stop()
+			refresh.Stop()
+		}()
+		refreshed := make(chan error)
+		refreshing := false
+		rescanned := make(chan struct{})
+		rescanning := false
+		startRescan := func() {
+			if rescanning {
+				return
+			}
+			rescanning = true
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				this.rescan()
+				select {
+				case rescanned <- struct{}{}:
+				case <-this.ctx.Done():
+				}
+			}()
+		}
+
+		// a rescan reads the config, reloads wait for it to finish
+		reloadWaiting := false
+
+		// deleted files are looked for once removes stop coming in rather
+		// than on every one, deleting a folder sends lots
+		var deletes <-chan time.Time
+
+		reload := func() {
+			if rescanning {
+				reloadWaiting = true
+				return
+			}
+			rescanEvery, refreshEvery := this.config.Rescan, this.config.RemoteRefresh
+			this.reload(watched, settle)
+			if this.config.Rescan != rescanEvery {
+				rescan.Stop()
+				rescan = newTicker(this.config.Rescan.Duration())
+			}
+			if this.config.RemoteRefresh != refreshEvery {
+				refresh.Stop()
+				refresh = newTicker(this.config.RemoteRefresh.Duration())
+			}
+		}
+
+		for {
+			select {
+			case <-this.ctx.Done():
+				return
+			case <-rescan.C():
+				startRescan()
+			case <-rescanned:
+				rescanning = false
+				if reloadWaiting {
+					reloadWaiting = false
+					reload()
+				}
+			case <-refresh.C():
+				if refreshing || this.opt.NoUpload {
+					continue
+				}
+				refreshing = true
+				background.Add(1)
+				go func() {
+					defer background.Done()
+					err := this.refreshRemote()
+					select {
+					case refreshed <- err:
+					case <-this.ctx.Done():
+					}
+				}()
+			case err := <-refreshed:
+				refreshing = false
+				if err != nil {
+					log.Println("error refreshing the Flickr listing", err)
+					continue
+				}
+				startRescan()
+			case event := <-watched.events:
+				if this.handleEvent(watched, settle, event) {
+					deletes = time.After(settle.wait)
+				}
+			case <-deletes:
+				deletes = nil
+				// notes when files went, Flickr follows once the grace period is up
+				actions, err := this.planDeletes(nil)
+				if err != nil {
+					log.Println("error checking for deleted files", err)
+					continue
+				}
+				this.applyNow(actions)
+			case path := <-settle.ready:
+				this.syncSettled(path)
+			case <-this.opt.Reload:
+				reload()
+			case event := <-configEvents:
+				// editors often save by renaming a new file over the old one
+				if filepath.Clean(event.Name) == configPath && event.Op&(WatchCreate|WatchWrite|WatchChmod) != 0 {
+					configSettle.touch(configPath)
+				}
+			case <-configSettle.ready:
+				reload()
+			case err := <-watched.errors:
+				log.Println("error:", err)
+			}
+		}
+	}()
+
+	<-this.ctx.Done()
+	<-handled // nothing may enqueue once the workers stop
+	background.Wait()
+	<-applied
+	settle.stop()
+	configSettle.stop()
+	watched.close()
+
+	// let the uploads in progress finish, then save the albums they changed
+	log.Println("stopping...")
+	this.stop()
+	this.updateAlbumsOrder()
+}
+
+// Watch the folder the config file is in for changes to it. The events
+// channel is nil when there is no config file to watch.
+func (this *syncer) watchConfig() (string, <-chan WatchEvent, func()) {
+	if len(this.opt.ConfigPath) == 0 {
+		return "", nil, func() {}
+	}
+	path, err := filepath.Abs(this.opt.ConfigPath)
+	if err != nil {
+		log.Println("not watching the config for changes,", err)
+		return "", nil, func() {}
+	}
+
+	watcher, err := NewNotifyWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(path))
+		if err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		log.Println("not watching the config for changes,", err)
+		return "", nil, func() {}
+	}
+
+	// nothing reads the errors, don't let them block the watcher
+	go func() {
+		for err := range watcher.Errors() {
+			log.Println("error watching the config:", err)
+		}
+	}()
+	return path, watcher.Events(), func() { watcher.Close() }
+}
+
+// Load the config file again and carry on with it. A config that doesn't
+// load is reported and the old one kept. The account, api settings, jobs
+// and metadata reader stay as they were until a restart.
+func (this *syncer) reload(watched *watchedDirs, settle *settler) {
+	config := &PhotosyncConfig{}
+	if err := LoadConfig(&this.opt.ConfigPath, config); err != nil {
+		log.Println("keeping the old config, error loading", this.opt.ConfigPath, err)
+		return
+	}
+	if config.OauthConfig != this.config.OauthConfig || config.ApiBase != this.config.ApiBase {
+		log.Println("the account or api changed, restart to use it")
+	}
+
+	old := this.config
+	this.config = config
+	log.Println("reloaded", this.opt.ConfigPath)
+
+	// stop watching directories that were dropped
+	for _, dir := range old.WatchDir {
+		if this.config.watchDirFor(dir.Dir) == nil {
+			settle.cancel(dir.Dir)
+			watched.remove(dir.Dir)
+		}
+	}
+
+	for i := range this.config.WatchDir {
+		dir := &this.config.WatchDir[i]
+		if _, err := os.Stat(dir.Dir); err != nil {
+			log.Println("not watching", dir.Dir, err)
+			continue
+		}
+		if err := watched.addTree(dir, dir.Dir, nil); err != nil {
+			log.Println("error watching", dir.Dir, err)
+			continue
+		}
+
+		// sync what's already in new directories
+		if old.watchDirFor(dir.Dir) == nil {
+			actions, err := this.planDir(dir)
+			if err != nil {
+				log.Println("error checking", dir.Dir, err)
+			}
+			this.applyNow(actions)
+		}
+	}
+}
+
+// Deal with one change in a watched folder. New files wait until they settle.
+// True when something was removed, so deleted files should be looked for.
+func (this *syncer) handleEvent(watched *watchedDirs, settle *settler, event WatchEvent) bool {
+	dirCfg := this.config.watchDirFor(event.Name)
+	if dirCfg == nil || dirCfg.Ignores(event.Name) {
+		return false
+	}
+
+	if event.Op&WatchCreate == WatchCreate {
+		log.Println("created file:", event.Name)
+		f, err := os.Stat(event.Name)
+		if err != nil {
+			log.Println("error getting file info for ", event.Name)
+			return false
+		}
+
+		if f.IsDir() {
+			// files can land in a new folder before it is watched
+			err := watched.addTree(dirCfg, event.Name, func(path string, f os.FileInfo) {
+				settle.touch(path)
+			})
+			if err != nil {
+				log.Println("error watching", event.Name, err)
+			}
+			return false
+		}
+
+		settle.touch(event.Name)
+	} else if event.Op&(WatchWrite|WatchChmod) != 0 {
+		// still being written, having its mode or times set once written, or
+		// a file synced earlier being changed. It's planned again once settled.
+		if f, err := os.Stat(event.Name); err == nil && !f.IsDir() {
+			settle.touch(event.Name)
+		}
+	} else if event.Op&(WatchRemove|WatchRename) != 0 {
+		// a renamed file turns up again as a create with its new name
+		settle.cancel(event.Name)
+		watched.remove(event.Name)
+		return true
+	}
+	return false
+}
+
+// Sync a new or changed file once it stopped changing
+func (this *syncer) syncSettled(path string) {
+	dirCfg := this.config.watchDirFor(path)
+	if dirCfg == nil {
+		return
+	}
+	f, err := os.Stat(path)
+	if err != nil {
+		return // gone again
+	}
+	this.syncFile(dirCfg, path, f)
+}
+
+// Plan and apply a file that turned up while watching
+func (this *syncer) syncFile(dirCfg *WatchDirConfig, path string, f os.FileInfo) {
+	actions, err := this.planFile(dirCfg, path, f, nil)
+	if err != nil {
+		log.Println("error checking", path, err)
+		return
+	}
+	this.applyNow(actions)
+}
+
+// Apply actions while watching, or just show them on a dry run. They're left
+// for applyBacklog so a full upload queue doesn't hold up the caller. The
+// workers update the album order when uploads are done.
+func (this *syncer) applyNow(actions []Action) {
+	if len(actions) == 0 {
+		return
+	}
+	if this.opt.Dryrun {
+		(&Plan{actions}).Print(this.out)
+		return
+	}
+
+	this.backlogMu.Lock()
+	this.backlog = append(this.backlog, backlogged{actions, this.config})
+	this.backlogMu.Unlock()
+	select {
+	case this.backlogReady <- struct{}{}:
+	default: // it's already been told
+	}
+}
+
+// Actions applyNow left and the config they were planned with
+type backlogged struct {
+	actions []Action
+	config  *PhotosyncConfig
+}
+
+// Apply what applyNow left, in the order it was left, until the context is
+// done
+func (this *syncer) applyBacklog() {
+	for {
+		select {
+		case <-this.ctx.Done():
+			return
+		case <-this.backlogReady:
+		}
+
+		for this.ctx.Err() == nil {
+			this.backlogMu.Lock()
+			if len(this.backlog) == 0 {
+				this.backlogMu.Unlock()
+				break
+			}
+			next := this.backlog[0]
+			this.backlog = this.backlog[1:]
+			this.backlogMu.Unlock()
+
+			this.apply(next.actions, next.config)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package photosync_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Reisender/photosync"
+	"github.com/Reisender/photosync/photosynctest"
+)
+
+// Wait for a photo with the title to be uploaded
+func waitForPhoto(t *testing.T, srv *photosynctest.Server, title string, out *lockedBuffer) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, p := range srv.Photos() {
+			if p.Title == title {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s never uploaded\n%s", title, out.String())
+}
+
+func TestDaemonReload(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	dir := tempDir(t)
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	writeFiles(t, first, map[string]string{"a.jpg": "aaa"})
+	writeFiles(t, second, map[string]string{"b.jpg": "bbb"})
+
+	cfg := testConfig(srv)
+	cfg.Settle = photosync.Duration(20 * time.Millisecond)
+	watching := func(dirs ...string) photosync.PhotosyncConfig {
+		c := cfg
+		c.WatchDir = nil
+		for _, d := range dirs {
+			c.WatchDir = append(c.WatchDir, photosync.WatchDirConfig{Dir: d, Watcher: photosync.WatcherPoll, PollInterval: photosync.Duration(20 * time.Millisecond)})
+		}
+		return c
+	}
+	configPath := filepath.Join(dir, "config.json")
+	saveConfig := func(c photosync.PhotosyncConfig) {
+		b, err := json.Marshal(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(configPath, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveConfig(watching(first))
+	if err := photosync.LoadConfig(&configPath, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	api := photosync.NewFlickrAPI(&cfg)
+	state := openState(t, dir)
+	user, err := api.GetLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	photos, videos, err := photosync.LoadLibrary(api, state, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan struct{}, 1)
+	var out lockedBuffer
+	opt := &photosync.Options{ConfigPath: configPath, Daemon: true, Reload: reload, Out: &out, Jobs: 1}
+	done := make(chan error)
+	go func() {
+		_, _, _, _, err := photosync.SyncContext(ctx, api, &cfg, state, photos, videos, &photosync.AlbumsMap{}, opt)
+		done <- err
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil && err != context.Canceled {
+			t.Error(err)
+		}
+	}()
+	waitForPhoto(t, srv, "a", &out)
+
+	// swap the first directory for the second, what's already in it is synced
+	saveConfig(watching(second))
+	reload <- struct{}{}
+	waitForPhoto(t, srv, "b", &out)
+
+	// and new files in it are too, but not in the one that was dropped
+	writeFiles(t, first, map[string]string{"a2.jpg": "aaa2"})
+	writeFiles(t, second, map[string]string{"b2.jpg": "bbb2"})
+	waitForPhoto(t, srv, "b2", &out)
+
+	// a config that doesn't load leaves the old one watching
+	if err := ioutil.WriteFile(configPath, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reload <- struct{}{}
+	writeFiles(t, second, map[string]string{"b3.jpg": "bbb3"})
+	waitForPhoto(t, srv, "b3", &out)
+	for _, p := range srv.Photos() {
+		if p.Title == "a2" {
+			t.Fatal("synced a file from a directory that was dropped")
+		}
+	}
+
+	// both again
+	saveConfig(watching(first, second))
+	reload <- struct{}{}
+	waitForPhoto(t, srv, "a2", &out)
+	writeFiles(t, first, map[string]string{"a3.jpg": "aaa3"})
+	waitForPhoto(t, srv, "a3", &out)
+
+	if n := len(srv.Photos()); n != 6 {
+		t.Fatalf("%d photos\n%s", n, out.String())
+	}
+}
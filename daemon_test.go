@@ -0,0 +1,104 @@
+package photosync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandleEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "photosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.jpg")
+	if err := ioutil.WriteFile(path, []byte("aaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &syncer{config: &PhotosyncConfig{WatchDir: []WatchDirConfig{{Dir: dir}}}}
+	watched := newWatchedDirs()
+	settle := newSettler(ctx, 20*time.Millisecond)
+	defer settle.stop()
+
+	// a file synced earlier, so not being waited on, is settled again when
+	// it's written to or has its mode changed
+	for _, op := range []WatchOp{WatchWrite, WatchChmod} {
+		s.handleEvent(watched, settle, WatchEvent{path, op})
+		select {
+		case got := <-settle.ready:
+			if got != path {
+				t.Fatal(op, "settled", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal(op, "never settled")
+		}
+	}
+
+	// nothing to settle for folders, files outside the watched dirs or
+	// files that went again
+	for _, name := range []string{filepath.Join(dir, "sub"), filepath.Join(os.TempDir(), "elsewhere.jpg"), filepath.Join(dir, "gone.jpg")} {
+		s.handleEvent(watched, settle, WatchEvent{name, WatchWrite})
+		if settle.has(name) {
+			t.Error("settling", name)
+		}
+	}
+}
+
+func TestApplyNow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "photosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b, c := filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.jpg"), filepath.Join(dir, "c.jpg")
+	if err := ioutil.WriteFile(a, []byte("aaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &syncer{ctx: ctx, opt: &Options{}, out: ioutil.Discard, backlogReady: make(chan struct{}, 1)}
+
+	// nothing applies them yet, the caller doesn't wait for that
+	s.applyNow([]Action{{Type: ActionRename, From: a, Path: b}})
+	s.applyNow(nil)
+	s.applyNow([]Action{{Type: ActionRename, From: b, Path: c}})
+	if _, err := os.Stat(a); err != nil {
+		t.Fatal("applied before the backlog was", err)
+	}
+
+	// then they're applied in the order they were left
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.applyBacklog()
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&s.renCnt) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("never applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(c); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't stop with the context")
+	}
+}
@@ -0,0 +1,310 @@
+package photosync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Where downloads go under DownloadOptions.Dir when there's no layout
+const DefaultDownloadLayout = `{{.Date "2006/01"}}/{{.Title}}`
+
+type DownloadOptions struct {
+	Dir    string    // the root of the mirror
+	Layout string    // template for the path of each file under Dir, without the extension
+	Media  string    // photo or video, both when empty
+	Albums []string  // only what's in these albums, everything when empty
+	Since  time.Time // only what was taken from here
+	Until  time.Time // and before here
+	Verify bool      // check files already there are the size of the original
+	Jobs   int       // number of downloads at once
+	Dryrun bool
+	Out    io.Writer // progress messages, os.Stdout when nil
+}
+
+// Context for the layout template, one per photo or video
+type DownloadValueContext struct {
+	photo  Photo
+	albums []string
+	taken  time.Time
+}
+
+func (this *DownloadValueContext) Id() string {
+	return this.photo.Id
+}
+
+// The title made safe to use as a file name, the id if it has none
+func (this *DownloadValueContext) Title() string {
+	title := safeFilename(this.photo.Title)
+	if len(title) == 0 {
+		return this.photo.Id
+	}
+	return title
+}
+
+func (this *DownloadValueContext) Media() string {
+	return this.photo.Media
+}
+
+// The first album it is in by name, empty when it isn't in one
+func (this *DownloadValueContext) Album() string {
+	if len(this.albums) == 0 {
+		return ""
+	}
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(this.albums[0])
+}
+
+// When it was taken in the given Go time layout, {{.Date "2006/01"}}
+func (this *DownloadValueContext) Date(layout string) string {
+	if this.taken.IsZero() {
+		return ""
+	}
+	return this.taken.Format(layout)
+}
+
+// The extension of the original with the dot
+func (this *DownloadValueContext) Ext() string {
+	if len(this.photo.OriginalFormat) > 0 {
+		return "." + strings.ToLower(this.photo.OriginalFormat)
+	}
+	if this.photo.Media == "video" {
+		return ".mp4"
+	}
+	return ".jpg"
+}
+
+// Mirror the photos and videos to local disk. library is keyed by id, like
+// GetLibrary gives, as photos can share a title. Returns how many were
+// downloaded, already there and failed.
+func DownloadAll(api PhotoService, library *PhotosMap, albums *AlbumsMap, opt *DownloadOptions) (int, int, int, error) {
+	return DownloadAllContext(context.Background(), api, library, albums, opt)
+}
+
+// DownloadAll that stops when the context is done. Interrupted downloads are
+// picked up again on the next run.
+func DownloadAllContext(ctx context.Context, api PhotoService, library *PhotosMap, albums *AlbumsMap, opt *DownloadOptions) (int, int, int, error) {
+	layout := opt.Layout
+	if len(layout) == 0 {
+		layout = DefaultDownloadLayout
+	}
+	tmpl, err := template.New("layout").Parse(layout)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("bad layout: %v", err)
+	}
+
+	// what albums each photo is in, by album name so Album is stable
+	inAlbums := make(map[string][]string)
+	for name, alb := range *albums {
+		for _, id := range alb.PhotoIds {
+			inAlbums[id] = append(inAlbums[id], name)
+		}
+	}
+	for _, names := range inAlbums {
+		sort.Strings(names)
+	}
+
+	todo := downloadList(library, inAlbums, opt)
+
+	out := opt.Out
+	if out == nil {
+		out = os.Stdout
+	}
+
+	var downCnt, exCnt, errCnt int64
+
+	// lay them all out first so when names clash the oldest photo, with the
+	// lowest id, keeps the name and the rest get their id added. Names don't
+	// change from run to run that way. A photo and a video can share a name
+	// as their extensions keep them apart.
+	paths := make(map[*DownloadValueContext]string)
+	owner := make(map[string]string) // path with the extension -> photo id
+	for _, vc := range todo {
+		name := new(bytes.Buffer)
+		if err := tmpl.Execute(name, vc); err != nil {
+			log.Println("error laying out", vc.photo.Id, err)
+			atomic.AddInt64(&errCnt, 1)
+			continue
+		}
+		path := filepath.Join(opt.Dir, filepath.FromSlash(name.String()))
+		paths[vc] = path
+		if id, ok := owner[path+vc.Ext()]; !ok || idLess(vc.photo.Id, id) {
+			owner[path+vc.Ext()] = vc.photo.Id
+		}
+	}
+
+	jobs := opt.Jobs
+	if jobs <= 0 {
+		jobs = 1
+	}
+	queue := make(chan func(), jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fn := range queue {
+				fn()
+			}
+		}()
+	}
+
+	for _, vc := range todo {
+		if ctx.Err() != nil {
+			break
+		}
+		vc := vc
+
+		path, ok := paths[vc]
+		if !ok {
+			continue // couldn't lay it out
+		}
+		if owner[path+vc.Ext()] != vc.photo.Id {
+			path += "_" + vc.photo.Id
+		}
+		path += vc.Ext()
+
+		if fi, err := os.Stat(path); err == nil {
+			if !opt.Verify {
+				atomic.AddInt64(&exCnt, 1)
+				continue
+			}
+			size, err := api.OriginalSizeContext(ctx, &vc.photo)
+			if err != nil {
+				log.Println("error checking", path, err)
+				atomic.AddInt64(&errCnt, 1)
+				continue
+			}
+			if size == fi.Size() {
+				atomic.AddInt64(&exCnt, 1)
+				continue
+			}
+			fmt.Fprintln(out, "size changed:", path)
+		}
+
+		fmt.Fprintln(out, path)
+		if opt.Dryrun {
+			atomic.AddInt64(&downCnt, 1)
+			continue
+		}
+
+		select {
+		case queue <- func() {
+			var bar io.Writer
+			if jobs == 1 {
+				bar = out
+			}
+			if err := downloadFile(ctx, api, vc, path, bar); err != nil {
+				log.Println("error downloading", path, err)
+				atomic.AddInt64(&errCnt, 1)
+				return
+			}
+			atomic.AddInt64(&downCnt, 1)
+		}:
+		case <-ctx.Done():
+		}
+	}
+
+	close(queue)
+	wg.Wait()
+
+	return int(atomic.LoadInt64(&downCnt)), int(atomic.LoadInt64(&exCnt)), int(atomic.LoadInt64(&errCnt)), ctx.Err()
+}
+
+// The photos and videos that pass the filters, oldest first
+func downloadList(library *PhotosMap, inAlbums map[string][]string, opt *DownloadOptions) []*DownloadValueContext {
+	var todo []*DownloadValueContext
+	for _, p := range *library {
+		if len(p.Media) == 0 {
+			p.Media = "photo"
+		}
+		if len(opt.Media) > 0 && opt.Media != p.Media {
+			continue
+		}
+
+		vc := &DownloadValueContext{photo: p, albums: inAlbums[p.Id]}
+		if t, err := time.ParseInLocation(FlickrTimeLayout, p.DateTaken, time.Local); err == nil {
+			vc.taken = t
+		}
+
+		if len(opt.Albums) > 0 && len(intersect(vc.albums, opt.Albums)) == 0 {
+			continue
+		}
+		if !opt.Since.IsZero() && vc.taken.Before(opt.Since) {
+			continue
+		}
+		if !opt.Until.IsZero() && !vc.taken.Before(opt.Until) {
+			continue
+		}
+
+		todo = append(todo, vc)
+	}
+
+	sort.Slice(todo, func(i, j int) bool {
+		if !todo[i].taken.Equal(todo[j].taken) {
+			return todo[i].taken.Before(todo[j].taken)
+		}
+		return idLess(todo[i].photo.Id, todo[j].photo.Id)
+	})
+	return todo
+}
+
+// Flickr ids are numbers that grow, compare them as numbers
+func idLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// Download one file and give it the date it was taken. The progress bar goes
+// to bar when it isn't nil.
+func downloadFile(ctx context.Context, api PhotoService, vc *DownloadValueContext, path string, bar io.Writer) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	var progress ProgressFunc
+	if bar != nil {
+		fmt.Fprint(bar, "|")
+		progress = progressBar(bar, 10)
+	}
+
+	if err := api.DownloadContext(ctx, &vc.photo, path, progress); err != nil {
+		if bar != nil {
+			fmt.Fprintln(bar)
+		}
+		return err
+	}
+	if bar != nil {
+		fmt.Fprintln(bar, "| 100%")
+	}
+
+	if !vc.taken.IsZero() {
+		os.Chtimes(path, vc.taken, vc.taken)
+	}
+	return nil
+}
+
+// The values in both a and b
+func intersect(a, b []string) []string {
+	var both []string
+	for _, v := range a {
+		for _, w := range b {
+			if v == w {
+				both = append(both, v)
+				break
+			}
+		}
+	}
+	return both
+}
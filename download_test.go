@@ -0,0 +1,129 @@
+package photosync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Reisender/photosync"
+	"github.com/Reisender/photosync/photosynctest"
+)
+
+func TestDownloadAll(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	beach := srv.AddPhoto("beach", "photo")
+	beach.Content = []byte(strings.Repeat("A", 1000))
+	beach.DateTaken = "2016-05-01 10:10:10"
+	clip := srv.AddPhoto("clip", "video")
+	clip.Content = []byte(strings.Repeat("B", 500))
+	clip.DateTaken = "2017-01-02 03:04:05"
+	srv.AddAlbum("Trip/2016", beach.Id)
+
+	cfg := testConfig(srv)
+	api := photosync.NewFlickrAPI(&cfg)
+	user, err := api.GetLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	library, err := api.GetLibrary(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albums, err := api.GetAlbums(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := tempDir(t)
+	var out lockedBuffer
+	opt := &photosync.DownloadOptions{Dir: dir, Layout: `{{.Album}}/{{.Date "2006"}}/{{.Title}}`, Out: &out}
+
+	// a download cut short carries on from where it got to
+	path := filepath.Join(dir, "Trip_2016", "2016", "beach.jpg")
+	writeFiles(t, dir, map[string]string{"Trip_2016/2016/beach.jpg.part": strings.Repeat("A", 300)})
+	d, e, f, err := photosync.DownloadAll(api, library, albums, opt)
+	if err != nil || d != 2 || e != 0 || f != 0 {
+		t.Fatal("first", d, e, f, err)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != string(beach.Content) {
+		t.Fatal("resumed download has", len(got), "bytes")
+	}
+	if !strings.Contains(out.String(), path) {
+		t.Fatalf("progress %q", out.String())
+	}
+
+	d, e, f, err = photosync.DownloadAll(api, library, albums, opt)
+	if err != nil || d != 0 || e != 2 {
+		t.Fatal("again", d, e, f, err)
+	}
+
+	// verifying downloads a file that doesn't match again
+	ioutil.WriteFile(path, []byte("short"), 0644)
+	opt.Verify = true
+	opt.Jobs = 2
+	d, e, f, err = photosync.DownloadAll(api, library, albums, opt)
+	if err != nil || d != 1 || e != 1 {
+		t.Fatal("verify", d, e, f, err)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != string(beach.Content) {
+		t.Fatal("verified download has", len(got), "bytes")
+	}
+
+	opt = &photosync.DownloadOptions{Dir: filepath.Join(dir, "videos"), Media: "video", Out: &out}
+	d, e, f, err = photosync.DownloadAll(api, library, albums, opt)
+	if err != nil || d != 1 {
+		t.Fatal("videos", d, e, f, err)
+	}
+}
+
+func TestDownloadAllSameTitle(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	for _, title := range []string{"dup", "dup", "", ""} {
+		p := srv.AddPhoto(title, "photo")
+		p.Content = []byte("x" + p.Id)
+	}
+	// a photo and a video don't clash, their extensions keep them apart
+	for _, media := range []string{"photo", "video"} {
+		p := srv.AddPhoto("pair", media)
+		p.Content = []byte("x" + p.Id)
+	}
+
+	cfg := testConfig(srv)
+	api := photosync.NewFlickrAPI(&cfg)
+	user, err := api.GetLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	library, err := api.GetLibrary(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := &photosync.DownloadOptions{Dir: tempDir(t), Layout: "{{.Title}}", Out: ioutil.Discard}
+	d, e, f, err := photosync.DownloadAll(api, library, &photosync.AlbumsMap{}, opt)
+	if err != nil || d != 6 || f != 0 {
+		t.Fatal("download", d, e, f, err)
+	}
+	files, err := ioutil.ReadDir(opt.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, file := range files {
+		names[file.Name()] = true
+	}
+	if len(names) != 6 || !names["pair.jpg"] || !names["pair.mp4"] {
+		t.Fatal("files", names)
+	}
+
+	// every run picks the same names
+	d, e, f, err = photosync.DownloadAll(api, library, &photosync.AlbumsMap{}, opt)
+	if err != nil || d != 0 || e != 6 {
+		t.Fatal("again", d, e, f, err)
+	}
+	if _, err := os.Stat(filepath.Join(opt.Dir, "dup.jpg")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,37 @@
+package photosync
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// A time.Duration that reads from the config as either a duration string
+// like "90s" or "1h30m" or a plain number of seconds.
+type Duration time.Duration
+
+func (this *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*this = Duration(d)
+		return nil
+	}
+
+	var secs float64
+	if err := json.Unmarshal(b, &secs); err != nil {
+		return err
+	}
+	*this = Duration(secs * float64(time.Second))
+	return nil
+}
+
+func (this Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(this).String())
+}
+
+func (this Duration) Duration() time.Duration {
+	return time.Duration(this)
+}
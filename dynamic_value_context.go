@@ -2,8 +2,8 @@ package photosync
 
 import (
 	"path/filepath"
+	"strconv"
 	"strings"
-	"time"
 )
 
 // Context for dynamic values in the config
@@ -17,14 +17,57 @@ type DynamicValueContext struct {
 	exif    ExifToolOutput
 }
 
+// When the photo was taken as 20060102_150405
 func (this *DynamicValueContext) ExifDate() (string, error) {
-	layout := "20060102_150405"
-	t, err := time.Parse(ExifTimeLayout, this.exif.Ifd.ModifyDate)
-	if err != nil {
-		return "", nil
+	return this.Date("20060102_150405"), nil
+}
+
+// When the photo was taken in the given Go time layout, {{.Date "2006/01"}}
+func (this *DynamicValueContext) Date(layout string) string {
+	t, ok := this.exif.DateTaken()
+	if !ok {
+		return ""
 	}
+	return t.Format(layout)
+}
 
-	return t.Format(layout), nil
+// All of the metadata, {{.Exif.ExifIFD.LensModel}}
+func (this *DynamicValueContext) Exif() *ExifToolOutput {
+	return &this.exif
+}
+
+func (this *DynamicValueContext) Camera() string {
+	return this.exif.Camera()
+}
+
+func (this *DynamicValueContext) Lens() string {
+	return string(this.exif.ExifIFD.LensModel)
+}
+
+// Decimal degrees, empty without a GPS position
+func (this *DynamicValueContext) Latitude() string {
+	lat, _, ok := this.exif.Position()
+	if !ok {
+		return ""
+	}
+	return strconv.FormatFloat(lat, 'f', 6, 64)
+}
+
+func (this *DynamicValueContext) Longitude() string {
+	_, lon, ok := this.exif.Position()
+	if !ok {
+		return ""
+	}
+	return strconv.FormatFloat(lon, 'f', 6, 64)
+}
+
+// Meters above sea level, empty if it isn't known
+func (this *DynamicValueContext) Altitude() string {
+	alt, ok := this.exif.Altitude()
+	if !ok {
+		return ""
+	}
+	return strconv.FormatFloat(alt, 'f', -1, 64)
 }
 
 func (this *DynamicValueContext) Folders() (string, error) {
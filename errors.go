@@ -12,3 +12,36 @@ func (e Error) Error() string {
 	return fmt.Sprintf("API fail: %s", e.response)
 }
 
+// Error response from the Flickr API
+type ApiError struct {
+	Code    int
+	Message string
+}
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("API fail: %d %s", e.Code, e.Message)
+}
+
+// Flickr's code for a photo it can't find, deleted or never there
+const photoNotFound = 1
+
+// Flickr's code for adding a photo to an album it is already in
+const photoAlreadyInSet = 3
+
+// Non 200 HTTP response
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API fail: %s", e.Status)
+}
+
+
+// An upload that failed when Flickr may already have all of it. Uploads
+// aren't idempotent, so these aren't retried in case one went through.
+type UploadUncertainError struct {
+	Err error
+}
+func (e *UploadUncertainError) Error() string {
+	return fmt.Sprintf("upload may have gone through: %v", e.Err)
+}
@@ -0,0 +1,198 @@
+package photosync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// ExifToolSession keeps one `exiftool -stay_open True -@ -` process around
+// and feeds it commands, saving perl's start up time on every file. The
+// process is started on first use and started again if it dies.
+type ExifToolSession struct {
+	Path string // the exiftool to run, found on the PATH when empty
+
+	mu     sync.Mutex // one command at a time
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr *bufio.Reader
+	seq    int
+}
+
+var errExifToolDied = errors.New("exiftool exited")
+
+func NewExifToolSession(path string) *ExifToolSession {
+	return &ExifToolSession{Path: path}
+}
+
+// Run exiftool with the args and return what it printed. Errors exiftool
+// reports on stderr come back as the error, warnings are dropped.
+func (this *ExifToolSession) Execute(ctx context.Context, args ...string) ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	out, err := this.execute(ctx, args)
+	if err == errExifToolDied && ctx.Err() == nil {
+		// it went away between commands, try once more with a fresh one
+		out, err = this.execute(ctx, args)
+	}
+	return out, err
+}
+
+// Stop the exiftool process. The session can still be used after, it'll start a new one.
+func (this *ExifToolSession) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.cmd == nil {
+		return nil
+	}
+
+	// ask nicely then wait for it to go
+	fmt.Fprint(this.stdin, "-stay_open\nFalse\n")
+	this.stdin.Close()
+	err := this.cmd.Wait()
+	this.cmd = nil
+	return err
+}
+
+func (this *ExifToolSession) start() error {
+	bin := this.Path
+	if len(bin) == 0 {
+		bin = "exiftool"
+	}
+
+	cmd := exec.Command(bin, "-stay_open", "True", "-@", "-")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	this.cmd = cmd
+	this.stdin = stdin
+	this.stdout = bufio.NewReader(stdout)
+	this.stderr = bufio.NewReader(stderr)
+	return nil
+}
+
+// Kill the process after it crashed or got stuck. Called with mu held.
+func (this *ExifToolSession) kill() {
+	if this.cmd == nil {
+		return
+	}
+	this.cmd.Process.Kill()
+	this.stdin.Close()
+	this.cmd.Wait()
+	this.cmd = nil
+}
+
+// Called with mu held
+func (this *ExifToolSession) execute(ctx context.Context, args []string) ([]byte, error) {
+	if this.cmd == nil {
+		if err := this.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	this.seq++
+	ready := fmt.Sprintf("{ready%d}", this.seq)
+
+	// one arg per line, the marker echoed to stderr once it is done so both
+	// streams can be read up to the end of this command
+	var cmd bytes.Buffer
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "\r\n") {
+			return nil, fmt.Errorf("exiftool argument has a new line in it: %q", arg)
+		}
+		cmd.WriteString(arg + "\n")
+	}
+	fmt.Fprintf(&cmd, "-echo4\n%s\n-execute%d\n", ready, this.seq)
+
+	if _, err := this.stdin.Write(cmd.Bytes()); err != nil {
+		this.kill()
+		return nil, errExifToolDied
+	}
+
+	type result struct {
+		out []byte
+		err error
+	}
+	outc := make(chan result, 1)
+	errc := make(chan result, 1)
+	go func() {
+		out, err := readUntil(this.stdout, ready)
+		outc <- result{out, err}
+	}()
+	go func() {
+		out, err := readUntil(this.stderr, ready)
+		errc <- result{out, err}
+	}()
+
+	var stdout, stderr result
+	for got := 0; got < 2; got++ {
+		select {
+		case stdout = <-outc:
+		case stderr = <-errc:
+		case <-ctx.Done():
+			// no way to cancel a single command, start over next time
+			this.kill()
+			<-outc
+			<-errc
+			return nil, ctx.Err()
+		}
+	}
+
+	if stdout.err != nil || stderr.err != nil {
+		this.kill()
+		return nil, errExifToolDied
+	}
+
+	for _, line := range strings.Split(string(stderr.out), "\n") {
+		if strings.HasPrefix(line, "Error") {
+			return stdout.out, fmt.Errorf("exiftool: %s", line)
+		}
+	}
+
+	return stdout.out, nil
+}
+
+// Read lines up to the marker, returning what came before it
+func readUntil(r *bufio.Reader, marker string) ([]byte, error) {
+	var out bytes.Buffer
+	for {
+		line, err := r.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == marker {
+			return out.Bytes(), nil
+		}
+		out.WriteString(line)
+		if err != nil {
+			return out.Bytes(), err
+		}
+	}
+}
+
+// Run exiftool through the session, or on its own when there isn't one
+func runExifTool(ctx context.Context, session *ExifToolSession, args ...string) ([]byte, error) {
+	if session != nil {
+		return session.Execute(ctx, args...)
+	}
+	return exec.CommandContext(ctx, "exiftool", args...).Output()
+}
@@ -0,0 +1,122 @@
+package photosync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A session running the fake exiftool and a count of how many times it was started
+func fakeExifTool(t *testing.T) (*ExifToolSession, func() int) {
+	bin, err := filepath.Abs(filepath.Join("testdata", "fake-exiftool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "photosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, "starts")
+	t.Setenv("FAKE_EXIFTOOL_LOG", log)
+
+	session := NewExifToolSession(bin)
+	t.Cleanup(func() {
+		session.Close()
+		os.RemoveAll(dir)
+	})
+
+	starts := func() int {
+		b, _ := ioutil.ReadFile(log)
+		return strings.Count(string(b), "start")
+	}
+	return session, starts
+}
+
+func TestExifToolSession(t *testing.T) {
+	session, starts := fakeExifTool(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		args []string
+		out  string
+		err  string
+	}{
+		{[]string{"a.jpg", "b.jpg"}, "a.jpg\nb.jpg\n", ""},
+		{[]string{"c.jpg"}, "c.jpg\n", ""},
+		{[]string{"warn", "d.jpg"}, "d.jpg\n", ""}, // warnings are dropped
+		{[]string{"e.jpg", "error"}, "e.jpg\n", "exiftool: Error: File not found - error"},
+		{[]string{"f.jpg"}, "f.jpg\n", ""}, // nothing left over from the error
+		{[]string{"new\nline"}, "", "new line"},
+	}
+	for _, test := range tests {
+		out, err := session.Execute(ctx, test.args...)
+		if string(out) != test.out {
+			t.Errorf("%q: out %q", test.args, out)
+		}
+		if len(test.err) == 0 && err != nil || len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%q: err %v, want %q", test.args, err, test.err)
+		}
+	}
+
+	// all of it in the one process
+	if n := starts(); n != 1 {
+		t.Fatal("started", n, "times")
+	}
+
+	// the session can be used again after it's closed
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := session.Execute(ctx, "g.jpg"); err != nil || string(out) != "g.jpg\n" {
+		t.Fatalf("after close %q %v", out, err)
+	}
+	if n := starts(); n != 2 {
+		t.Fatal("started", n, "times")
+	}
+}
+
+func TestExifToolSessionRestart(t *testing.T) {
+	session, starts := fakeExifTool(t)
+	ctx := context.Background()
+
+	if _, err := session.Execute(ctx, "a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+
+	// dying between commands is only noticed on the next one, which gets a fresh process
+	session.cmd.Process.Kill()
+	session.cmd.Wait()
+	if out, err := session.Execute(ctx, "b.jpg"); err != nil || string(out) != "b.jpg\n" {
+		t.Fatalf("after it died %q %v", out, err)
+	}
+	if n := starts(); n != 2 {
+		t.Fatal("started", n, "times")
+	}
+
+	// dying on the command itself is only tried once more, on a fresh process
+	if _, err := session.Execute(ctx, "die"); err != errExifToolDied {
+		t.Fatal("dying command", err)
+	}
+	if n := starts(); n != 3 {
+		t.Fatal("started", n, "times")
+	}
+
+	// a stuck one is killed when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := session.Execute(ctx, "hang"); err != context.DeadlineExceeded {
+		t.Fatal("stuck command", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatal("stuck command returned after", d)
+	}
+
+	if out, err := session.Execute(context.Background(), "c.jpg"); err != nil || string(out) != "c.jpg\n" {
+		t.Fatalf("after it got stuck %q %v", out, err)
+	}
+}
@@ -22,9 +22,17 @@ func (this *FilenameConfig) Load() error {
 	if err != nil {
 		return err
 	}
+	prependTmpl, err := template.New("prependTmpl").Parse(this.Prepend)
+	if err != nil {
+		return err
+	}
+	appendTmpl, err := template.New("appendTmpl").Parse(this.Append)
+	if err != nil {
+		return err
+	}
 	this.matchRegexp = *rgxp
-	this.prependTmpl = template.Must(template.New("prependTmpl").Parse(this.Prepend))
-	this.appendTmpl = template.Must(template.New("appendTmpl").Parse(this.Append))
+	this.prependTmpl = prependTmpl
+	this.appendTmpl = appendTmpl
 	return nil
 }
 
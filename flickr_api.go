@@ -2,9 +2,9 @@ package photosync
 
 import (
 	"os"
+	"context"
 	"io"
 	"fmt"
-	"log"
 	"net/url"
 	"net/http"
 	"io/ioutil"
@@ -12,10 +12,13 @@ import (
 	"encoding/xml"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"net"
 	"github.com/garyburd/go-oauth/oauth"
 	"mime/multipart"
 	"bytes"
 	"strings"
+	"time"
 )
 
 type Photo struct {
@@ -23,9 +26,13 @@ type Photo struct {
 	Owner string
 	Secret string
 	Title string
-	Ispublic int `json:"string"`
-	Isfriend int `json:"string"`
-	Isfamily int `json:"string"`
+	Ispublic int `json:"ispublic"`
+	Isfriend int `json:"isfriend"`
+	Isfamily int `json:"isfamily"`
+	MachineTags string `json:"machine_tags"`
+	DateTaken string `json:"datetaken"`
+	OriginalFormat string `json:"originalformat"`
+	Media string `json:"media"`
 }
 
 type PhotoInfo struct {
@@ -42,6 +49,7 @@ type PhotoSet struct {
 type PhotoSize struct {
 	Label string
 	Source string
+	Media string
 }
 
 type FlickrResponse interface {
@@ -50,6 +58,8 @@ type FlickrResponse interface {
 
 type FlickrBaseApiResponse struct {
 	Stat string
+	Code int // only set when Stat is "fail"
+	Message string
 }
 func (this FlickrBaseApiResponse) Success() bool {
 	return this.Stat == "ok"
@@ -161,8 +171,15 @@ type FlickrUploadResponse struct {
 	XMLName xml.Name `xml:"rsp"`
 	Status string `xml:"stat,attr"`
 	PhotoId string `xml:"photoid"`
+	Err struct {
+		Code int `xml:"code,attr"`
+		Msg string `xml:"msg,attr"`
+	} `xml:"err"`
 }
 
+// Called as an upload goes out with the bytes sent so far and the total
+type ProgressFunc func(sent, total int64)
+
 type FlickrUser struct {
 	Id string
 	Username struct {
@@ -170,12 +187,32 @@ type FlickrUser struct {
 	} `json:"username"`
 }
 
+// how long a single api call can take unless the config says otherwise
+const defaultHttpTimeout = time.Minute
+
+// how many pages of a listing to request at once
+const maxParallelPages = 4
+
+// default endpoint for the REST, upload and oauth services
+const DefaultApiBase = "https://api.flickr.com/services"
+
 type FlickrAPI struct {
 	config PhotosyncConfig
 	FlickrUserId string `json:"flickr_user_id"`
 	apiBase string
-	form url.Values
 	oauthClient oauth.Client
+	limiter *rateLimiter
+	client *http.Client // for api calls
+	uploadClient *http.Client // no overall timeout as uploads can take a long time
+	Out io.Writer // loading progress, os.Stdout when nil
+}
+
+// Where the loading progress goes
+func (this *FlickrAPI) out() io.Writer {
+	if this.Out == nil {
+		return os.Stdout
+	}
+	return this.Out
 }
 
 
@@ -183,17 +220,27 @@ type FlickrAPI struct {
 
 
 func NewFlickrAPI(config *PhotosyncConfig) *FlickrAPI {
+	apiBase := config.ApiBase
+	if apiBase == "" {
+		apiBase = DefaultApiBase
+	}
+	apiBase = strings.TrimRight(apiBase, "/")
+
+	timeout := config.HttpTimeout.Duration()
+	if timeout <= 0 {
+		timeout = defaultHttpTimeout
+	}
+
 	return &FlickrAPI{
 		config: *config, // config the value is set in photosync.go
-		apiBase: "https://api.flickr.com/services",
-		form: url.Values{ // default querystring values
-			"format": {"json"},
-			"nojsoncallback": {"1"},
-		},
+		apiBase: apiBase,
+		limiter: newRateLimiter(config.RateLimit),
+		client: &http.Client{Timeout: timeout},
+		uploadClient: &http.Client{},
 		oauthClient: oauth.Client {
-			TemporaryCredentialRequestURI: "https://api.flickr.com/services/oauth/request_token",
-			ResourceOwnerAuthorizationURI: "https://api.flickr.com/services/oauth/authorize",
-			TokenRequestURI:               "https://api.flickr.com/services/oauth/access_token",
+			TemporaryCredentialRequestURI: apiBase+"/oauth/request_token",
+			ResourceOwnerAuthorizationURI: apiBase+"/oauth/authorize",
+			TokenRequestURI:               apiBase+"/oauth/access_token",
 			Credentials: config.Consumer, // setup the consumer key and secret from the confis
 		},
 	}
@@ -204,80 +251,144 @@ func (this *FlickrAPI) GetFilenamesConfig() []FilenameConfig {
 }
 
 func (this *FlickrAPI) GetPhotos(user *FlickrUser) (*PhotosMap, error) {
-	this.form.Set("user_id", user.Id)
-	defer this.form.Del("user_id") // remove from form values when done
-
-	this.form.Set("media", "photos")
-	defer this.form.Del("media") // remove from form values when done
+	return this.GetPhotosContext(context.Background(), user)
+}
 
-	return this.Search(&this.form)
+func (this *FlickrAPI) GetPhotosContext(ctx context.Context, user *FlickrUser) (*PhotosMap, error) {
+	return this.searchMedia(ctx, user, "photos", time.Time{})
 }
 
 func (this *FlickrAPI) GetVideos(user *FlickrUser) (*PhotosMap, error) {
-	this.form.Set("user_id", user.Id)
-	defer this.form.Del("user_id") // remove from form values when done
+	return this.GetVideosContext(context.Background(), user)
+}
+
+func (this *FlickrAPI) GetVideosContext(ctx context.Context, user *FlickrUser) (*PhotosMap, error) {
+	return this.searchMedia(ctx, user, "videos", time.Time{})
+}
+
+func (this *FlickrAPI) GetPhotosSince(user *FlickrUser, since time.Time) (*PhotosMap, error) {
+	return this.GetPhotosSinceContext(context.Background(), user, since)
+}
+
+// Only the photos uploaded on or after the given time
+func (this *FlickrAPI) GetPhotosSinceContext(ctx context.Context, user *FlickrUser, since time.Time) (*PhotosMap, error) {
+	return this.searchMedia(ctx, user, "photos", since)
+}
 
-	this.form.Set("media", "videos")
-	defer this.form.Del("media") // remove from form values when done
+func (this *FlickrAPI) GetVideosSince(user *FlickrUser, since time.Time) (*PhotosMap, error) {
+	return this.GetVideosSinceContext(context.Background(), user, since)
+}
 
-	return this.Search(&this.form)
+// Only the videos uploaded on or after the given time
+func (this *FlickrAPI) GetVideosSinceContext(ctx context.Context, user *FlickrUser, since time.Time) (*PhotosMap, error) {
+	return this.searchMedia(ctx, user, "videos", since)
 }
 
 func (this *FlickrAPI) Search(form *url.Values) (*PhotosMap, error) {
-	form.Set("method", "flickr.photos.search")
+	return this.SearchContext(context.Background(), form)
+}
+
+func (this *FlickrAPI) SearchContext(ctx context.Context, form *url.Values) (*PhotosMap, error) {
+	return this.search(ctx, form, func(p Photo) string { return p.Title })
+}
+
+func (this *FlickrAPI) GetLibrary(user *FlickrUser) (*PhotosMap, error) {
+	return this.GetLibraryContext(context.Background(), user)
+}
+
+// Every photo and video keyed by id. Titles can repeat so the listings keyed
+// by title can't say for sure that a photo is gone.
+func (this *FlickrAPI) GetLibraryContext(ctx context.Context, user *FlickrUser) (*PhotosMap, error) {
+	return this.GetLibrarySinceContext(ctx, user, time.Time{})
+}
+
+func (this *FlickrAPI) GetLibrarySince(user *FlickrUser, since time.Time) (*PhotosMap, error) {
+	return this.GetLibrarySinceContext(context.Background(), user, since)
+}
+
+// Only the photos and videos uploaded on or after the given time, keyed by id
+func (this *FlickrAPI) GetLibrarySinceContext(ctx context.Context, user *FlickrUser, since time.Time) (*PhotosMap, error) {
+	form := this.newForm()
+	form.Set("user_id", user.Id)
+	form.Set("media", "all")
+	if !since.IsZero() {
+		form.Set("min_upload_date", strconv.FormatInt(since.Unix(), 10))
+	}
+
+	return this.search(ctx, &form, func(p Photo) string { return p.Id })
+}
+
+// Page through a search putting the photos in a map under key(photo)
+func (this *FlickrAPI) search(ctx context.Context, form *url.Values, key func(p Photo) string) (*PhotosMap, error) {
+	// work on a copy so the caller's values are left alone
+	search := this.newForm()
+	for k, v := range *form {
+		search[k] = v
+	}
+	search.Set("method", "flickr.photos.search")
+
+	search.Set("extras", "machine_tags,date_taken,original_format,media") // for the content hashes and downloads
 
 	// needed for getAllPages
-	form.Set("per_page", "500") // max page size
-	defer form.Del("per_page") // remove from form values when done
+	search.Set("per_page", "500") // max page size
 
 	photos := make(PhotosMap)
 
-	page := FlickrApiResponse{}
-	err := this.getAllPages(&page, func() {
+	err := this.getAllPages(ctx, search, func() FlickrPagedResponse { return &FlickrApiResponse{} }, func(resp FlickrPagedResponse) {
+		page := resp.(*FlickrApiResponse)
+
 		// extract into photos map
 		for _, img := range page.Data.Photos {
-			photos[img.Title] = img
+			photos[key(img)] = img
 		}
-		fmt.Print("\rloading: ",int((float32(page.Page())/float32(page.Pages()))*100),"%")
+		fmt.Fprint(this.out(), "\rloading: ",int((float32(page.Page())/float32(page.Pages()))*100),"%")
 	})
-	fmt.Println()
+	fmt.Fprintln(this.out())
 
 	return &photos, err
 }
 
 func (this *FlickrAPI) GetAlbums(user *FlickrUser) (*AlbumsMap, error) {
-	this.form.Set("method", "flickr.photosets.getList")
+	return this.GetAlbumsContext(context.Background(), user)
+}
 
-	this.form.Set("user_id", user.Id)
-	defer this.form.Del("user_id") // remove from form values when done
+func (this *FlickrAPI) GetAlbumsContext(ctx context.Context, user *FlickrUser) (*AlbumsMap, error) {
+	form := this.newForm()
+	form.Set("method", "flickr.photosets.getList")
+
+	form.Set("user_id", user.Id)
 
 	// needed for getAllPages
-	this.form.Set("per_page", "500") // max page size
-	defer this.form.Del("per_page") // remove from form values when done
+	form.Set("per_page", "500") // max page size
 
 	albums := make(AlbumsMap)
 
-	page := FlickrAlbumsResponse{}
-	fmt.Print("\rloading albums: 0%")
-	err := this.getAllPages(&page, func() {
+	fmt.Fprint(this.out(), "\rloading albums: 0%")
+	err := this.getAllPages(ctx, form, func() FlickrPagedResponse { return &FlickrAlbumsResponse{} }, func(resp FlickrPagedResponse) {
+		page := resp.(*FlickrAlbumsResponse)
 		for i, alb := range page.Data.Albums {
 			albCopy := alb
-			_ = this.LoadAlbumPhotos(&albCopy)
+			_ = this.LoadAlbumPhotosContext(ctx, &albCopy)
 			albums[albCopy.GetTitle()] = &albCopy
 			cnt := (page.Page()-1) * page.PerPage() + (i+1)
-			fmt.Print("\rloading albums: ",int((float32(cnt)/float32(page.Total()))*100),"%")
+			fmt.Fprint(this.out(), "\rloading albums: ",int((float32(cnt)/float32(page.Total()))*100),"%")
 		}
 	})
-	fmt.Println()
+	fmt.Fprintln(this.out())
 
 	return &albums, err
 }
 
 func (this *FlickrAPI) GetLogin() (*FlickrUser, error) {
-	this.form.Set("method", "flickr.test.login")
+	return this.GetLoginContext(context.Background())
+}
+
+func (this *FlickrAPI) GetLoginContext(ctx context.Context) (*FlickrUser, error) {
+	form := this.newForm()
+	form.Set("method", "flickr.test.login")
 
 	data := FlickrApiResponse{}
-	err := this.get(&this.form, &data)
+	err := this.get(ctx, &form, &data)
 	if err != nil {
 		return nil, err
 	}
@@ -286,6 +397,10 @@ func (this *FlickrAPI) GetLogin() (*FlickrUser, error) {
 }
 
 func (this *FlickrAPI) GetExtention(info *PhotoInfo) (string, error) {
+	if len(info.Originalformat) > 0 {
+		return strings.ToLower(info.Originalformat), nil
+	}
+
 	switch info.Media {
 	case "photo":
 		return "jpg", nil
@@ -297,13 +412,17 @@ func (this *FlickrAPI) GetExtention(info *PhotoInfo) (string, error) {
 }
 
 func (this *FlickrAPI) GetInfo(p *Photo) (*PhotoInfo, error) {
-	this.form.Set("method", "flickr.photos.getInfo")
+	return this.GetInfoContext(context.Background(), p)
+}
 
-	this.form.Set("photo_id", p.Id)
-	defer this.form.Del("photo_id") // remove from form values when done
+func (this *FlickrAPI) GetInfoContext(ctx context.Context, p *Photo) (*PhotoInfo, error) {
+	form := this.newForm()
+	form.Set("method", "flickr.photos.getInfo")
+
+	form.Set("photo_id", p.Id)
 
 	data := FlickrApiResponse{}
-	err := this.get(&this.form, &data)
+	err := this.get(ctx, &form, &data)
 	if err != nil {
 		return nil, err
 	}
@@ -312,13 +431,17 @@ func (this *FlickrAPI) GetInfo(p *Photo) (*PhotoInfo, error) {
 }
 
 func (this *FlickrAPI) GetSizes(p *Photo) (*[]PhotoSize, error) {
-	this.form.Set("method", "flickr.photos.getSizes")
+	return this.GetSizesContext(context.Background(), p)
+}
+
+func (this *FlickrAPI) GetSizesContext(ctx context.Context, p *Photo) (*[]PhotoSize, error) {
+	form := this.newForm()
+	form.Set("method", "flickr.photos.getSizes")
 
-	this.form.Set("photo_id", p.Id)
-	defer this.form.Del("photo_id") // remove from form values when done
+	form.Set("photo_id", p.Id)
 
 	data := FlickrApiResponse{}
-	err := this.get(&this.form, &data)
+	err := this.get(ctx, &form, &data)
 	if err != nil {
 		return nil, err
 	}
@@ -327,16 +450,33 @@ func (this *FlickrAPI) GetSizes(p *Photo) (*[]PhotoSize, error) {
 }
 
 func (this *FlickrAPI) LoadAlbumPhotos(album *Album) error {
-	this.form.Set("method", "flickr.photosets.getPhotos")
+	return this.LoadAlbumPhotosContext(context.Background(), album)
+}
+
+func (this *FlickrAPI) LoadAlbumPhotosContext(ctx context.Context, album *Album) error {
+	form := this.newForm()
+	form.Set("method", "flickr.photosets.getPhotos")
 
-	this.form.Set("photoset_id", album.Id)
-	defer this.form.Del("photoset_id") // remove from form values when done
+	form.Set("photoset_id", album.Id)
 
-	page := FlickrAlbumPhotosResponse{}
+	form.Set("per_page", "500") // max page size
+
+	// a repeated page would otherwise add the same photos twice
+	seen := make(map[string]bool)
+	for _, id := range album.PhotoIds {
+		seen[id] = true
+	}
+
+	return this.getAllPages(ctx, form, func() FlickrPagedResponse { return &FlickrAlbumPhotosResponse{} }, func(resp FlickrPagedResponse) {
+		page := resp.(*FlickrAlbumPhotosResponse)
 
-	return this.getAllPages(&page, func() {
 		// extract into photos map
 		for _, img := range page.Data.Photos {
+			if seen[img.Id] {
+				continue
+			}
+			seen[img.Id] = true
+
 			// using album.Append with mark as dirty
 			album.PhotoIds = append(album.PhotoIds, img.Id)
 		}
@@ -344,53 +484,62 @@ func (this *FlickrAPI) LoadAlbumPhotos(album *Album) error {
 }
 
 func (this *FlickrAPI) AddTags(photoId, tags string) error {
-	this.form.Set("method", "flickr.photos.addTags")
+	return this.AddTagsContext(context.Background(), photoId, tags)
+}
 
-	this.form.Set("photo_id", photoId)
-	defer this.form.Del("photo_id") // remove from form values when done
+func (this *FlickrAPI) AddTagsContext(ctx context.Context, photoId, tags string) error {
+	form := this.newForm()
+	form.Set("method", "flickr.photos.addTags")
 
-	this.form.Set("tags", tags)
-	defer this.form.Del("tags")
+	form.Set("photo_id", photoId)
+
+	form.Set("tags", tags)
 
 	data := FlickrApiResponse{}
-	err := this.post(&this.form, &data)
+	err := this.post(ctx, &form, &data)
 
 	return err
 }
 
 func (this *FlickrAPI) AddToAlbum(photoId string, album *Album) error {
-	this.form.Set("method", "flickr.photosets.addPhoto")
+	return this.AddToAlbumContext(context.Background(), photoId, album)
+}
 
-	this.form.Set("photo_id", photoId)
-	defer this.form.Del("photo_id") // remove from form values when done
+func (this *FlickrAPI) AddToAlbumContext(ctx context.Context, photoId string, album *Album) error {
+	form := this.newForm()
+	form.Set("method", "flickr.photosets.addPhoto")
 
-	this.form.Set("photoset_id", album.Id)
-	defer this.form.Del("photoset_id")
+	form.Set("photo_id", photoId)
+
+	form.Set("photoset_id", album.Id)
 
 	data := FlickrBaseApiResponse{}
-	if err := this.post(&this.form, &data); err != nil { return err }
+	if err := this.postOnce(ctx, &form, &data, photoAlreadyInSet); err != nil { return err }
 
 	// add to album photoIds array
 	album.Prepend(photoId)
 
 	// now set it to the album photo
-	this.form.Set("method", "flickr.photosets.setPrimaryPhoto")
+	form.Set("method", "flickr.photosets.setPrimaryPhoto")
 
 	ignore := FlickrBaseApiResponse{}
-	return this.post(&this.form, &ignore)
+	return this.post(ctx, &form, &ignore)
 }
 
 func (this *FlickrAPI) SetAlbumOrder(photoSetId string, photoIds []string) error {
-	this.form.Set("method", "flickr.photosets.reorderPhotos")
+	return this.SetAlbumOrderContext(context.Background(), photoSetId, photoIds)
+}
 
-	this.form.Set("photoset_id", photoSetId)
-	defer this.form.Del("photoset_id")
+func (this *FlickrAPI) SetAlbumOrderContext(ctx context.Context, photoSetId string, photoIds []string) error {
+	form := this.newForm()
+	form.Set("method", "flickr.photosets.reorderPhotos")
 
-	this.form.Set("photo_ids", strings.Join(photoIds, ","))
-	defer this.form.Del("photo_ids") // remove from form values when done
+	form.Set("photoset_id", photoSetId)
+
+	form.Set("photo_ids", strings.Join(photoIds, ","))
 
 	ignore := FlickrBaseApiResponse{}
-	if err := this.post(&this.form, &ignore); err != nil {
+	if err := this.post(ctx, &form, &ignore); err != nil {
 		return err
 	}
 
@@ -402,16 +551,19 @@ func (this *FlickrAPI) SetAlbumOrder(photoSetId string, photoIds []string) error
 }
 
 func (this *FlickrAPI) SetAlbumPhoto(photoId, photoSetId string) error {
-	this.form.Set("method", "flickr.photosets.setPrimaryPhoto")
+	return this.SetAlbumPhotoContext(context.Background(), photoId, photoSetId)
+}
 
-	this.form.Set("photo_id", photoId)
-	defer this.form.Del("photo_id") // remove from form values when done
+func (this *FlickrAPI) SetAlbumPhotoContext(ctx context.Context, photoId, photoSetId string) error {
+	form := this.newForm()
+	form.Set("method", "flickr.photosets.setPrimaryPhoto")
 
-	this.form.Set("photoset_id", photoSetId)
-	defer this.form.Del("photoset_id")
+	form.Set("photo_id", photoId)
+
+	form.Set("photoset_id", photoSetId)
 
 	ignore := FlickrBaseApiResponse{}
-	if err := this.post(&this.form, &ignore); err != nil {
+	if err := this.post(ctx, &form, &ignore); err != nil {
 		return err
 	}
 
@@ -423,55 +575,151 @@ func (this *FlickrAPI) SetAlbumPhoto(photoId, photoSetId string) error {
 }
 
 func (this *FlickrAPI) SetTitle(photo_id, title string) error {
-	this.form.Set("method", "flickr.photos.setMeta")
+	return this.SetTitleContext(context.Background(), photo_id, title)
+}
 
-	this.form.Set("photo_id", photo_id)
-	defer this.form.Del("photo_id") // remove from form values when done
+func (this *FlickrAPI) SetTitleContext(ctx context.Context, photo_id, title string) error {
+	form := this.newForm()
+	form.Set("method", "flickr.photos.setMeta")
 
-	this.form.Set("title", title)
-	defer this.form.Del("title")
+	form.Set("photo_id", photo_id)
+
+	form.Set("title", title)
 
 	data := FlickrApiResponse{}
-	err := this.post(&this.form, &data)
+	err := this.post(ctx, &form, &data)
 
 	return err
 }
 
 func (this *FlickrAPI) SetDate(photoId, date string) error {
-	this.form.Set("method", "flickr.photos.setDates")
+	return this.SetDateContext(context.Background(), photoId, date)
+}
+
+func (this *FlickrAPI) SetDateContext(ctx context.Context, photoId, date string) error {
+	form := this.newForm()
+	form.Set("method", "flickr.photos.setDates")
+
+	form.Set("photo_id", photoId)
+
+	form.Set("date_taken", date)
+
+	data := FlickrApiResponse{}
+	err := this.get(ctx, &form, &data)
+
+	return err
+}
+
+func (this *FlickrAPI) SetLocation(photoId string, lat, lon float64, accuracy int) error {
+	return this.SetLocationContext(context.Background(), photoId, lat, lon, accuracy)
+}
+
+// Put the photo on the map. Accuracy runs from 1 (world) to 16 (street).
+func (this *FlickrAPI) SetLocationContext(ctx context.Context, photoId string, lat, lon float64, accuracy int) error {
+	form := this.newForm()
+	form.Set("method", "flickr.photos.geo.setLocation")
+
+	form.Set("photo_id", photoId)
+
+	form.Set("lat", strconv.FormatFloat(lat, 'f', 6, 64))
+	form.Set("lon", strconv.FormatFloat(lon, 'f', 6, 64))
+	form.Set("accuracy", strconv.Itoa(accuracy))
+
+	data := FlickrApiResponse{}
+	err := this.post(ctx, &form, &data)
+
+	return err
+}
+
+func (this *FlickrAPI) SetPerms(photoId string, public, friend, family bool) error {
+	return this.SetPermsContext(context.Background(), photoId, public, friend, family)
+}
+
+// Who can see the photo, private to the owner when all are false
+func (this *FlickrAPI) SetPermsContext(ctx context.Context, photoId string, public, friend, family bool) error {
+	form := this.newForm()
+	form.Set("method", "flickr.photos.setPerms")
 
-	this.form.Set("photo_id", photoId)
-	defer this.form.Del("photo_id") // remove from form values when done
+	form.Set("photo_id", photoId)
 
-	this.form.Set("date_taken", date)
-	defer this.form.Del("date_taken")
+	flag := func(b bool) string {
+		if b { return "1" }
+		return "0"
+	}
+	form.Set("is_public", flag(public))
+	form.Set("is_friend", flag(friend))
+	form.Set("is_family", flag(family))
 
 	data := FlickrApiResponse{}
-	err := this.get(&this.form, &data)
+	err := this.post(ctx, &form, &data)
+
+	return err
+}
+
+func (this *FlickrAPI) Delete(photoId string) error {
+	return this.DeleteContext(context.Background(), photoId)
+}
+
+// Delete the photo from Flickr for good. Needs delete perms.
+func (this *FlickrAPI) DeleteContext(ctx context.Context, photoId string) error {
+	form := this.newForm()
+	form.Set("method", "flickr.photos.delete")
+
+	form.Set("photo_id", photoId)
+
+	data := FlickrApiResponse{}
+	err := this.postOnce(ctx, &form, &data, photoNotFound)
 
 	return err
 }
 
 func (this *FlickrAPI) Upload(path string, file os.FileInfo) (*FlickrUploadResponse, error) {
-	// Prepare a form that you will submit to that URL.
-	var b bytes.Buffer
-	w := multipart.NewWriter(&b)
+	return this.UploadContext(context.Background(), path, file, nil)
+}
 
-	// Add your image file
+// Upload the file, calling progress (if not nil) as the bytes go out. A retried
+// upload starts the count over from zero.
+func (this *FlickrAPI) UploadContext(ctx context.Context, path string, file os.FileInfo, progress ProgressFunc) (*FlickrUploadResponse, error) {
+	var xr *FlickrUploadResponse
+	err := this.withRetry(ctx, "upload "+file.Name(), func() error {
+		var err error
+		xr, err = this.upload(ctx, path, file, progress)
+		return err
+	})
+	return xr, err
+}
+
+func (this *FlickrAPI) upload(ctx context.Context, path string, file os.FileInfo, progress ProgressFunc) (*FlickrUploadResponse, error) {
 	f, err := os.Open(path)
 	if err != nil { return nil, err }
 
-	fw, err := w.CreateFormFile("photo", file.Name())
-	if err != nil { return nil, err }
+	// size what is actually on disk, the file may have been rewritten since it was walked
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := info.Size()
 
-	if _, err = io.Copy(fw, f); err != nil { return nil, err }
+	// stream the multipart body instead of holding the whole file in memory
+	pr, pw := io.Pipe()
+	defer pr.Close() // unblocks the writer if the post bails early
+	w := multipart.NewWriter(pw)
 
-	// close this to get the terminating boundary
-	w.Close()
+	overhead, err := multipartOverhead(w.Boundary(), "photo", file.Name())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 
 	// create the request
-	req, err := http.NewRequest("POST", this.apiBase+"/upload/", &b)
-	if err != nil { return nil, err }
+	req, err := http.NewRequest("POST", this.apiBase+"/upload/", pr)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = overhead + size
 
 	// set the content type for the mutlipart
 	req.Header.Set("Content-Type", w.FormDataContentType())
@@ -479,18 +727,51 @@ func (this *FlickrAPI) Upload(path string, file os.FileInfo) (*FlickrUploadRespo
 	// add the oauth sig as well
 	req.Header.Set("Authorization", this.oauthClient.AuthorizationHeader(&this.config.Access, "POST", req.URL, url.Values{}))
 
+	if err := this.limiter.Wait(ctx); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var sent int32 // set once the whole body has been read off the pipe
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		defer f.Close()
+		fw, err := w.CreateFormFile("photo", file.Name())
+		if err == nil {
+			_, err = io.Copy(fw, &progressReader{r: f, total: size, fn: progress})
+		}
+		if err == nil {
+			// close this to get the terminating boundary
+			err = w.Close()
+		}
+		if err == nil {
+			atomic.StoreInt32(&sent, 1)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	// once Flickr has the whole body, or we stopped waiting, the photo may be there
+	uncertain := func(err error) error {
+		pr.Close()
+		<-written
+		if ne, ok := err.(net.Error); (ok && ne.Timeout()) || atomic.LoadInt32(&sent) == 1 {
+			return &UploadUncertainError{err}
+		}
+		return err
+	}
+
 	// do the actual post
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil { return nil, err }
+	resp, err := this.uploadClient.Do(req)
+	if err != nil { return nil, uncertain(err) }
 
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil { return nil, err }
+	if err != nil { return nil, uncertain(err) }
 
 	// Check the response
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status: %s", resp.Status)
+		return nil, uncertain(&StatusError{resp.StatusCode, resp.Status})
 	}
 
 
@@ -498,129 +779,385 @@ func (this *FlickrAPI) Upload(path string, file os.FileInfo) (*FlickrUploadRespo
 	if err := xml.Unmarshal(body, &xr); err != nil { return nil, err }
 
 	if xr.Status != "ok" {
+		if xr.Err.Code != 0 {
+			return nil, &ApiError{xr.Err.Code, xr.Err.Msg}
+		}
 		return nil, Error{"failed status on upload"}
 	}
 
 	return &xr, nil
 }
 
-func (this *FlickrAPI) Download(info *PhotoInfo, p *Photo) error {
-	sizes, _ := this.GetSizes(p)
-	ext, _ := this.GetExtention(info)
-
+// The original upload out of the sizes for a photo or video
+func OriginalSize(sizes *[]PhotoSize, media string) (*PhotoSize, error) {
+	label := "Original"
+	if media == "video" {
+		label = "Video Original"
+	}
 	for _, v := range *sizes {
-		if (info.Media == "video" && v.Label == "Video Original") || (info.Media == "photo" && v.Label == "Original") {
-			out, err := os.Create(p.Title+"."+ext)
-			if err != nil { return err }
+		if v.Label == label {
+			return &v, nil
+		}
+	}
+	return nil, Error{"no original size"}
+}
+
+func (this *FlickrAPI) Download(p *Photo, path string) error {
+	return this.DownloadContext(context.Background(), p, path, nil)
+}
 
-			r, err := http.Get(v.Source)
-			if err != nil { return err }
+// Download the original of a photo or video to path. It goes to path.part
+// first and a part left by an interrupted download is picked up where it
+// stopped. The size is checked against what the server said it would send.
+func (this *FlickrAPI) DownloadContext(ctx context.Context, p *Photo, path string, progress ProgressFunc) error {
+	orig, err := this.original(ctx, p)
+	if err != nil { return err }
 
-			defer r.Body.Close()
+	part := path + ".part"
+	var have int64
+	if fi, err := os.Stat(part); err == nil {
+		have = fi.Size()
+	}
+
+	req, err := http.NewRequest("GET", orig.Source, nil)
+	if err != nil { return err }
+	if have > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", have))
+	}
 
-			n, err := io.Copy(out, r.Body)
+	r, err := this.uploadClient.Do(req.WithContext(ctx))
+	if err != nil { return err }
+	defer r.Body.Close()
 
-			fmt.Println("written ",n)
+	flags := os.O_WRONLY|os.O_CREATE
+	total := int64(-1)
+	switch r.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+		total = rangeTotal(r.Header.Get("Content-Range"))
+	case http.StatusOK:
+		// no resuming, start over
+		flags |= os.O_TRUNC
+		have = 0
+		total = r.ContentLength
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the part is already all there
+		if rangeTotal(r.Header.Get("Content-Range")) == have {
+			return os.Rename(part, path)
 		}
+		os.Remove(part)
+		return &StatusError{r.StatusCode, r.Status}
+	default:
+		return &StatusError{r.StatusCode, r.Status}
 	}
 
-	return nil
+	out, err := os.OpenFile(part, flags, 0644)
+	if err != nil { return err }
+
+	n, err := io.Copy(out, &progressReader{r: r.Body, sent: have, total: total, fn: progress})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil { return err } // keep the part to resume from
+
+	if total >= 0 && have+n != total {
+		return fmt.Errorf("%s: got %d bytes of %d", path, have+n, total)
+	}
+
+	return os.Rename(part, path)
+}
+
+// How big the original of a photo or video is, without downloading it
+func (this *FlickrAPI) OriginalSizeContext(ctx context.Context, p *Photo) (int64, error) {
+	orig, err := this.original(ctx, p)
+	if err != nil { return 0, err }
+
+	req, err := http.NewRequest("HEAD", orig.Source, nil)
+	if err != nil { return 0, err }
+
+	r, err := this.uploadClient.Do(req.WithContext(ctx))
+	if err != nil { return 0, err }
+	r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return 0, &StatusError{r.StatusCode, r.Status}
+	}
+	if r.ContentLength < 0 {
+		return 0, Error{"no size for "+p.Id}
+	}
+	return r.ContentLength, nil
+}
+
+// The original size of the photo, looking up its media type if the listing didn't have it
+func (this *FlickrAPI) original(ctx context.Context, p *Photo) (*PhotoSize, error) {
+	media := p.Media
+	if len(media) == 0 {
+		info, err := this.GetInfoContext(ctx, p)
+		if err != nil { return nil, err }
+		media = info.Media
+	}
+
+	sizes, err := this.GetSizesContext(ctx, p)
+	if err != nil { return nil, err }
+
+	return OriginalSize(sizes, media)
+}
+
+// The full size out of a "bytes 100-199/200" Content-Range, -1 when it isn't known
+func rangeTotal(contentRange string) int64 {
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return -1
+	}
+	total, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return total
 }
 
 
 
 // ***** Private Functions *****
 
-func (this *FlickrAPI) get(form *url.Values, resp FlickrResponse) error {
-	return this.do("GET", form, resp)
+func (this *FlickrAPI) get(ctx context.Context, form *url.Values, resp FlickrResponse) error {
+	return this.do(ctx, "GET", form, resp)
 }
 
-func (this *FlickrAPI) post(form *url.Values, resp FlickrResponse) error {
-	return this.do("POST", form, resp)
+func (this *FlickrAPI) post(ctx context.Context, form *url.Values, resp FlickrResponse) error {
+	return this.do(ctx, "POST", form, resp)
 }
 
-func (this *FlickrAPI) put(form *url.Values, resp FlickrResponse) error {
-	return this.do("PUT", form, resp)
+func (this *FlickrAPI) put(ctx context.Context, form *url.Values, resp FlickrResponse) error {
+	return this.do(ctx, "PUT", form, resp)
 }
 
-func (this *FlickrAPI) del(form *url.Values, resp FlickrResponse) error {
-	return this.do("DELETE", form, resp)
+func (this *FlickrAPI) del(ctx context.Context, form *url.Values, resp FlickrResponse) error {
+	return this.do(ctx, "DELETE", form, resp)
 }
 
-func (this *FlickrAPI) do(method string, form *url.Values, resp FlickrResponse) error {
-	contents, err := this.doRaw(method, form)
+func (this *FlickrAPI) do(ctx context.Context, method string, form *url.Values, resp FlickrResponse) error {
+	return this.withRetry(ctx, form.Get("method"), func() error {
+		return this.doOnce(ctx, method, form, resp)
+	})
+}
+
+// A post that isn't safe to simply repeat. Once an attempt failed without an
+// answer from Flickr it may still have gone through, so on the next tries
+// the error Flickr gives for a change that is already made counts as success.
+func (this *FlickrAPI) postOnce(ctx context.Context, form *url.Values, resp FlickrResponse, doneCode int) error {
+	var maybeDone bool
+	return this.withRetry(ctx, form.Get("method"), func() error {
+		err := this.doOnce(ctx, "POST", form, resp)
+		e, answered := err.(*ApiError)
+		if answered && maybeDone && e.Code == doneCode {
+			return nil
+		}
+		if err != nil && !answered {
+			maybeDone = true
+		}
+		return err
+	})
+}
+
+func (this *FlickrAPI) doOnce(ctx context.Context, method string, form *url.Values, resp FlickrResponse) error {
+	contents, err := this.doRaw(ctx, method, form)
 	if err != nil { return err }
 
 	err = json.Unmarshal(contents, resp)
 	if err != nil {
-		fmt.Println(string(contents))
+		fmt.Fprintln(this.out(), string(contents))
 		return err
 	}
 
 	if !resp.Success() {
+		// pull out the error code so we know if it's worth trying again
+		fail := FlickrBaseApiResponse{}
+		if json.Unmarshal(contents, &fail) == nil && fail.Code != 0 {
+			return &ApiError{fail.Code, fail.Message}
+		}
 		return &Error{ string(contents) }
 	}
 
 	return nil
 }
-func (this *FlickrAPI) doRaw(method string, form *url.Values) ([]byte, error) {
-	methodFunc := this.oauthClient.Get
-	switch method { // override the default method of get
-		case "POST":
-			methodFunc = this.oauthClient.Post
-		case "PUT":
-			methodFunc = this.oauthClient.Put
-		case "DELETE":
-			methodFunc = this.oauthClient.Delete
-	}
-	r, err := methodFunc(http.DefaultClient, &this.config.Access, this.apiBase+"/rest", *form)
+
+func (this *FlickrAPI) doRaw(ctx context.Context, method string, form *url.Values) ([]byte, error) {
+	u, err := url.Parse(this.apiBase+"/rest")
+	if err != nil { return nil,err }
+
+	// GET and DELETE send the values in the query string and sign them from
+	// there, the rest send them as the body and sign them as form values
+	var body io.Reader
+	params := *form
+	switch method {
+		case "GET", "DELETE":
+			u.RawQuery = form.Encode()
+			params = nil
+		default:
+			body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil { return nil,err }
+	req = req.WithContext(ctx)
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Authorization", this.oauthClient.AuthorizationHeader(&this.config.Access, method, u, params))
+
+	if err := this.limiter.Wait(ctx); err != nil { return nil,err }
+	r, err := this.client.Do(req)
 	if err != nil { return nil,err }
 
 	defer r.Body.Close()
 
 	if r.StatusCode != 200 {
-		return nil,&Error{r.Status}
+		return nil,&StatusError{r.StatusCode, r.Status}
 	}
 
 	return ioutil.ReadAll(r.Body)
 }
 
-func (this *FlickrAPI) getAllPages(data FlickrPagedResponse, fn func()) error {
-	var wg sync.WaitGroup
-	form := this.form
+// Fetch every page of a paged method. The first page says how many pages
+// there are and the rest are then fetched in parallel. fn gets called with
+// each page, one at a time and in page order, as soon as it and the pages
+// before it have arrived.
+func (this *FlickrAPI) getAllPages(ctx context.Context, form url.Values, newPage func() FlickrPagedResponse, fn func(FlickrPagedResponse)) error {
+	first := newPage()
+	if err := this.get(ctx, &form, first); err != nil {
+		return err
+	}
+	fn(first)
 
-	err := this.get(&form, data)
-	if err != nil {
-		log.Fatal(err)
+	n := first.Pages()
+	if n < 2 {
+		return nil
+	}
+
+	// stop fetching once a page fails, waiting for the ones on their way
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pages := make([]FlickrPagedResponse, n)
+	errs := make([]error, n)
+	done := make([]chan bool, n)
+	for i := range done {
+		done[i] = make(chan bool)
 	}
-	wg.Add(data.Pages())
-	//go func() {
-	func() {
+
+	// ask for the rest of the pages in order, a few at a time
+	wg.Add(1)
+	go func() {
 		defer wg.Done()
-		fn()
+		sem := make(chan bool, maxParallelPages)
+		for page := 2; page <= n; page++ {
+			select {
+			case sem <- true:
+			case <-ctx.Done():
+				for ; page <= n; page++ {
+					errs[page-1] = ctx.Err()
+					close(done[page-1])
+				}
+				return
+			}
+
+			wg.Add(1)
+			go func(page int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				defer close(done[page-1])
+
+				pages[page-1], errs[page-1] = this.getPage(ctx, form, page, newPage)
+			}(page)
+		}
 	}()
 
-	// get the rest of the pages
-	for page := 2; page <= data.Pages(); page++ {
-		// comment out the parallel requesting as the flickr api seems occasionally return a dup page response
-		//go func(page int, data FlickrPagedResponse) { 
-		func(page int, data FlickrPagedResponse) {
-			defer wg.Done()
+	for i := 1; i < n; i++ {
+		<-done[i]
+		if errs[i] != nil {
+			return errs[i]
+		}
+		fn(pages[i])
+	}
 
-			form.Set("page", strconv.Itoa(page))
-			defer form.Del("page")
+	return nil
+}
 
-			data.Reset()
-			err := this.get(&form, data)
-			if err != nil {
-				log.Fatal(err)
-			}
+// Fetch a single page. The flickr api occasionally hands back a different
+// page than the one asked for so check and ask again when that happens.
+func (this *FlickrAPI) getPage(ctx context.Context, form url.Values, page int, newPage func() FlickrPagedResponse) (FlickrPagedResponse, error) {
+	pageForm := url.Values{}
+	for k, v := range form {
+		pageForm[k] = v
+	}
+	pageForm.Set("page", strconv.Itoa(page))
 
-			fn()
-		}(page, data)
+	var data FlickrPagedResponse
+	for attempt := 0; attempt < 3; attempt++ {
+		data = newPage()
+		if err := this.get(ctx, &pageForm, data); err != nil {
+			return nil, err
+		}
+		if data.Page() == page {
+			return data, nil
+		}
 	}
 
-	wg.Wait()
+	return nil, Error{fmt.Sprintf("asked for page %d but kept getting page %d", page, data.Page())}
+}
 
-	return nil
+// A new set of form values with the defaults every call needs
+func (this *FlickrAPI) newForm() url.Values {
+	return url.Values{
+		"format": {"json"},
+		"nojsoncallback": {"1"},
+	}
+}
+
+func (this *FlickrAPI) searchMedia(ctx context.Context, user *FlickrUser, media string, since time.Time) (*PhotosMap, error) {
+	form := this.newForm()
+	form.Set("user_id", user.Id)
+	form.Set("media", media)
+	if !since.IsZero() {
+		form.Set("min_upload_date", strconv.FormatInt(since.Unix(), 10))
+	}
+
+	return this.SearchContext(ctx, &form)
+}
+
+// Size of the multipart framing around a single file field
+func multipartOverhead(boundary, field, filename string) (int64, error) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	if err := w.SetBoundary(boundary); err != nil {
+		return 0, err
+	}
+	if _, err := w.CreateFormFile(field, filename); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return int64(b.Len()), nil
+}
+
+// Reports the bytes read so far as they are pulled through
+type progressReader struct {
+	r     io.Reader
+	sent  int64
+	total int64
+	fn    ProgressFunc
+}
+
+func (this *progressReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.sent += int64(n)
+	if this.fn != nil && n > 0 {
+		this.fn(this.sent, this.total)
+	}
+	return n, err
 }
@@ -0,0 +1,74 @@
+package photosync_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Reisender/photosync"
+	"github.com/Reisender/photosync/photosynctest"
+)
+
+// Every page of a search is loaded and handed on in page order
+func TestSearchPages(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	srv.MaxPerPage = 1
+	for _, title := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		srv.AddPhoto(title, "photo")
+	}
+
+	cfg := testConfig(srv)
+	api := photosync.NewFlickrAPI(&cfg)
+	var out lockedBuffer
+	api.Out = &out
+	user, err := api.GetLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	photos, err := api.GetPhotos(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*photos) != 8 {
+		t.Fatalf("photos %v", *photos)
+	}
+	if n := srv.Calls("flickr.photos.search"); n != 8 {
+		t.Fatal("pages asked for", n)
+	}
+
+	want := "\rloading: 12%\rloading: 25%\rloading: 37%\rloading: 50%\rloading: 62%\rloading: 75%\rloading: 87%\rloading: 100%\n"
+	if got := out.String(); got != want {
+		t.Fatalf("progress %q", strings.Replace(got, "\r", " ", -1))
+	}
+}
+
+// A cancelled upload stops waiting on Flickr and says why
+func TestUploadCancel(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	srv.UploadDelay = 10 * time.Second
+	cfg := testConfig(srv)
+	api := photosync.NewFlickrAPI(&cfg)
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"slow.jpg": "x"})
+	path := filepath.Join(dir, "slow.jpg")
+	f, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := api.UploadContext(ctx, path, f, nil); err != context.DeadlineExceeded {
+		t.Fatal("upload", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatal("returned after", d)
+	}
+}
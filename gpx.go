@@ -0,0 +1,109 @@
+package photosync
+
+import (
+	"encoding/xml"
+	"os"
+	"sort"
+	"time"
+)
+
+// how far a photo can be from the nearest track point when the config doesn't say
+const defaultGpxMaxGap = 5 * time.Minute
+
+// A GPX track log, every point of every track in time order
+type GpxTrack struct {
+	points []gpxPoint
+}
+
+type gpxPoint struct {
+	Lat  float64   `xml:"lat,attr"`
+	Lon  float64   `xml:"lon,attr"`
+	Time time.Time `xml:"time"`
+}
+
+// just enough of the GPX schema to get at the track points
+type gpxFile struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+func LoadGpx(path string) (*GpxTrack, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var gpx gpxFile
+	if err := xml.NewDecoder(f).Decode(&gpx); err != nil {
+		return nil, err
+	}
+
+	track := &GpxTrack{}
+	for _, trk := range gpx.Tracks {
+		for _, seg := range trk.Segments {
+			for _, p := range seg.Points {
+				if !p.Time.IsZero() { // can't place a photo against a point without a time
+					track.points = append(track.points, p)
+				}
+			}
+		}
+	}
+	sort.SliceStable(track.points, func(i, j int) bool {
+		return track.points[i].Time.Before(track.points[j].Time)
+	})
+
+	return track, nil
+}
+
+// Where the track was at time t. Between two points close enough together
+// the position is interpolated, otherwise the nearest point is used if it
+// is within maxGap.
+func (this *GpxTrack) Position(t time.Time, maxGap time.Duration) (float64, float64, bool) {
+	pts := this.points
+	if len(pts) == 0 {
+		return 0, 0, false
+	}
+	if maxGap <= 0 {
+		maxGap = defaultGpxMaxGap
+	}
+
+	// first point at or after t
+	i := sort.Search(len(pts), func(i int) bool { return !pts[i].Time.Before(t) })
+
+	switch {
+	case i < len(pts) && pts[i].Time.Equal(t):
+		return pts[i].Lat, pts[i].Lon, true
+	case i == 0:
+		return nearPoint(pts[0], t, maxGap)
+	case i == len(pts):
+		return nearPoint(pts[len(pts)-1], t, maxGap)
+	}
+
+	before, after := pts[i-1], pts[i]
+	gap := after.Time.Sub(before.Time)
+	if gap > maxGap {
+		// a hole in the log, only trust a point close by
+		if t.Sub(before.Time) < after.Time.Sub(t) {
+			return nearPoint(before, t, maxGap)
+		}
+		return nearPoint(after, t, maxGap)
+	}
+
+	f := float64(t.Sub(before.Time)) / float64(gap)
+	return before.Lat + (after.Lat-before.Lat)*f, before.Lon + (after.Lon-before.Lon)*f, true
+}
+
+func nearPoint(p gpxPoint, t time.Time, maxGap time.Duration) (float64, float64, bool) {
+	d := p.Time.Sub(t)
+	if d < 0 {
+		d = -d
+	}
+	if d > maxGap {
+		return 0, 0, false
+	}
+	return p.Lat, p.Lon, true
+}
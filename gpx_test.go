@@ -0,0 +1,139 @@
+package photosync_test
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Reisender/photosync"
+)
+
+// Two tracks, the later one first in the file, with a half hour hole between them
+const testGpx = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test">
+  <trk><trkseg>
+    <trkpt lat="10" lon="10"><time>2016-05-01T10:30:00Z</time></trkpt>
+    <trkpt lat="11" lon="10"><time>2016-05-01T10:31:00Z</time></trkpt>
+  </trkseg></trk>
+  <trk>
+    <trkseg>
+      <trkpt lat="0" lon="0"><time>2016-05-01T10:00:00Z</time></trkpt>
+      <trkpt lat="1" lon="2"><time>2016-05-01T10:01:00Z</time></trkpt>
+    </trkseg>
+    <trkseg>
+      <trkpt lat="50" lon="50"></trkpt>
+      <trkpt lat="2" lon="4"><time>2016-05-01T10:02:00Z</time></trkpt>
+    </trkseg>
+  </trk>
+</gpx>
+`
+
+func writeGpx(t *testing.T) string {
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"track.gpx": testGpx})
+	return dir
+}
+
+func at(clock string) time.Time {
+	t, err := time.Parse("15:04:05", clock)
+	if err != nil {
+		panic(err)
+	}
+	return time.Date(2016, 5, 1, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+func TestGpxPosition(t *testing.T) {
+	track, err := photosync.LoadGpx(filepath.Join(writeGpx(t), "track.gpx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		t        time.Time
+		maxGap   time.Duration
+		lat, lon float64
+		ok       bool
+	}{
+		{"on a point", at("10:01:00"), 0, 1, 2, true},
+		{"half way", at("10:00:30"), 0, 0.5, 1, true},
+		{"a quarter of the way", at("10:01:15"), 0, 1.25, 2.5, true},
+		{"across segments", at("10:01:30"), 0, 1.5, 3, true},
+		{"other time zones", at("10:00:30").In(time.FixedZone("+02:00", 2*3600)), 0, 0.5, 1, true},
+		{"just before the track", at("09:58:00"), 0, 0, 0, true},
+		{"long before the track", at("09:50:00"), 0, 0, 0, false},
+		{"just after the track", at("10:34:00"), 0, 11, 10, true},
+		{"long after the track", at("10:40:00"), 0, 0, 0, false},
+		{"in the hole near its start", at("10:04:00"), 0, 2, 4, true},
+		{"in the middle of the hole", at("10:16:00"), 0, 0, 0, false},
+		{"in the hole near its end", at("10:27:00"), 0, 10, 10, true},
+		{"a hole within a bigger max gap", at("10:16:00"), 30 * time.Minute, 6, 7, true},
+		{"points further apart than the max gap", at("10:00:20"), 30 * time.Second, 0, 0, true},
+		{"and nearer the later one", at("10:00:40"), 30 * time.Second, 1, 2, true},
+		{"beyond a small max gap", at("10:33:00"), time.Minute, 0, 0, false},
+	}
+	for _, test := range tests {
+		lat, lon, ok := track.Position(test.t, test.maxGap)
+		if ok != test.ok || math.Abs(lat-test.lat) > 1e-9 || math.Abs(lon-test.lon) > 1e-9 {
+			t.Errorf("%s: got %v,%v %v, want %v,%v %v", test.name, lat, lon, ok, test.lat, test.lon, test.ok)
+		}
+	}
+
+	if _, _, ok := (&photosync.GpxTrack{}).Position(at("10:00:00"), 0); ok {
+		t.Error("position from an empty track")
+	}
+}
+
+func TestGetLocation(t *testing.T) {
+	dir := writeGpx(t)
+
+	taken := func(date string) *photosync.ExifToolOutput {
+		exif := &photosync.ExifToolOutput{}
+		exif.ExifIFD.DateTimeOriginal = date
+		exif.ExifIFD.OffsetTimeOriginal = "+00:00"
+		return exif
+	}
+	withGps := taken("2016:05:01 10:00:30")
+	withGps.GPS.GPSLatitude, withGps.GPS.GPSLatitudeRef = "33.5", "South"
+	withGps.GPS.GPSLongitude, withGps.GPS.GPSLongitudeRef = "151.25", "East"
+
+	tests := []struct {
+		name     string
+		cfg      photosync.WatchDirConfig
+		exif     *photosync.ExifToolOutput
+		lat, lon float64
+		ok       bool
+	}{
+		{"gps first", photosync.WatchDirConfig{Gpx: "track.gpx"}, withGps, -33.5, 151.25, true},
+		{"then the track", photosync.WatchDirConfig{Gpx: "track.gpx"}, taken("2016:05:01 10:00:30"), 0.5, 1, true},
+		{"the track with an absolute path", photosync.WatchDirConfig{Gpx: filepath.Join(dir, "track.gpx")}, taken("2016:05:01 10:00:30"), 0.5, 1, true},
+		{"too far from the track", photosync.WatchDirConfig{Gpx: "track.gpx"}, taken("2016:05:01 10:16:00"), 0, 0, false},
+		{"the configured max gap", photosync.WatchDirConfig{Gpx: "track.gpx", GpxMaxGap: photosync.Duration(30 * time.Minute)}, taken("2016:05:01 10:16:00"), 6, 7, true},
+		{"no date", photosync.WatchDirConfig{Gpx: "track.gpx"}, &photosync.ExifToolOutput{}, 0, 0, false},
+		{"no track", photosync.WatchDirConfig{}, taken("2016:05:01 10:00:30"), 0, 0, false},
+		{"gps without a track", photosync.WatchDirConfig{}, withGps, -33.5, 151.25, true},
+		{"stripped", photosync.WatchDirConfig{Gpx: "track.gpx", StripLocation: true}, withGps, 0, 0, false},
+	}
+	for _, test := range tests {
+		cfg := test.cfg
+		cfg.Dir = dir
+		if err := cfg.LoadGeo(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		lat, lon, ok := cfg.GetLocation(test.exif)
+		if ok != test.ok || math.Abs(lat-test.lat) > 1e-9 || math.Abs(lon-test.lon) > 1e-9 {
+			t.Errorf("%s: got %v,%v %v, want %v,%v %v", test.name, lat, lon, ok, test.lat, test.lon, test.ok)
+		}
+	}
+
+	for _, cfg := range []photosync.WatchDirConfig{
+		{Dir: dir, Gpx: "missing.gpx"},
+		{Dir: dir, Gpx: "track.gpx", GeoAccuracy: 17},
+	} {
+		if err := cfg.LoadGeo(); err == nil {
+			t.Errorf("loaded %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package photosync
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A kind of file we know how to sync
+type MediaType struct {
+	Name  string   // jpeg, heic, raw...
+	Media string   // photo or video
+	Exts  []string // upper case with the dot, the first is the usual one
+	Mimes []string // content types it sniffs as
+	Raw   bool     // Flickr won't take it, it has to be converted or previewed first
+}
+
+// Everything we recognise. Flickr takes all of them as is except the RAW formats.
+var MediaTypes = []*MediaType{
+	{Name: "jpeg", Media: "photo", Exts: []string{".JPG", ".JPEG", ".JPE"}, Mimes: []string{"image/jpeg"}},
+	{Name: "heic", Media: "photo", Exts: []string{".HEIC", ".HEIF"}, Mimes: []string{"image/heic", "image/heif"}},
+	{Name: "png", Media: "photo", Exts: []string{".PNG"}, Mimes: []string{"image/png"}},
+	{Name: "gif", Media: "photo", Exts: []string{".GIF"}, Mimes: []string{"image/gif"}},
+	{Name: "tiff", Media: "photo", Exts: []string{".TIF", ".TIFF"}, Mimes: []string{"image/tiff"}},
+	{Name: "raw", Media: "photo", Raw: true, Exts: []string{".CR2", ".CR3", ".CRW", ".NEF", ".NRW", ".ARW", ".SR2", ".SRF", ".DNG", ".RAF", ".ORF", ".RW2", ".PEF", ".SRW", ".3FR", ".IIQ", ".X3F"}},
+	{Name: "quicktime", Media: "video", Exts: []string{".MOV", ".QT"}, Mimes: []string{"video/quicktime"}},
+	{Name: "mp4", Media: "video", Exts: []string{".MP4", ".M4V"}, Mimes: []string{"video/mp4"}},
+	{Name: "3gp", Media: "video", Exts: []string{".3GP", ".3G2"}, Mimes: []string{"video/3gpp"}},
+	{Name: "avi", Media: "video", Exts: []string{".AVI"}, Mimes: []string{"video/avi"}},
+	{Name: "mts", Media: "video", Exts: []string{".MTS", ".M2TS"}},
+	{Name: "mpeg", Media: "video", Exts: []string{".MPG", ".MPEG"}, Mimes: []string{"video/mpeg"}},
+	{Name: "wmv", Media: "video", Exts: []string{".WMV"}, Mimes: []string{"video/x-ms-wmv"}},
+	{Name: "ogg", Media: "video", Exts: []string{".OGV", ".OGG"}, Mimes: []string{"application/ogg", "video/ogg"}},
+}
+
+// The media type for a file extension, nil if we don't know it
+func MediaTypeForExt(ext string) *MediaType {
+	ext = strings.ToUpper(ext)
+	for _, mt := range MediaTypes {
+		for _, e := range mt.Exts {
+			if e == ext {
+				return mt
+			}
+		}
+	}
+	return nil
+}
+
+// The media type for a content type, nil if we don't know it
+func MediaTypeForMime(mime string) *MediaType {
+	for _, mt := range MediaTypes {
+		for _, m := range mt.Mimes {
+			if m == mime {
+				return mt
+			}
+		}
+	}
+	return nil
+}
+
+// Work out the media type from the extension, or the contents when there is
+// no extension. A file with an extension we don't know is left alone, sidecars
+// like .THM are JPEGs that aren't meant to be synced. Returns nil for files we
+// don't sync.
+func DetectMediaType(path string) (*MediaType, error) {
+	ext := ""
+	if i := strings.LastIndex(path, "."); i >= 0 && !strings.ContainsAny(path[i:], `/\`) {
+		ext = path[i:]
+	}
+	if len(ext) > 0 {
+		return MediaTypeForExt(ext), nil
+	}
+
+	mime, err := SniffMime(path)
+	if err != nil {
+		return nil, err
+	}
+	return MediaTypeForMime(mime), nil
+}
+
+// The content type of a file from its first bytes. Knows the ISO media
+// brands on top of what net/http does, other brands like M4A audio or AVIF
+// come back as application/octet-stream.
+func SniffMime(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	head = head[:n]
+
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		switch string(head[8:12]) {
+		case "heic", "heix", "heim", "heis", "hevc", "hevx":
+			return "image/heic", nil
+		case "mif1", "msf1":
+			return "image/heif", nil
+		case "qt  ":
+			return "video/quicktime", nil
+		case "3gp4", "3gp5", "3gp6", "3g2a":
+			return "video/3gpp", nil
+		case "isom", "iso2", "mp41", "mp42", "M4V ":
+			return "video/mp4", nil
+		}
+		return "application/octet-stream", nil
+	}
+	if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		return "image/tiff", nil
+	}
+	if len(head) >= 8 {
+		switch string(head[4:8]) {
+		case "moov", "mdat", "wide", "free", "pnot":
+			return "video/quicktime", nil
+		}
+	}
+
+	// strip any parameters like charset
+	return strings.SplitN(http.DetectContentType(head), ";", 2)[0], nil
+}
+
+// Check a list of media type names, kinds (photo, video) or extensions from the config
+func validMediaNames(names []string) error {
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if name == "photo" || name == "video" {
+			continue
+		}
+		known := false
+		for _, mt := range MediaTypes {
+			if mt.Name == name {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown media type %q", name)
+		}
+	}
+	return nil
+}
+
+// Whether the media type is one of the names, kinds or extensions in the list
+func (this *MediaType) matches(names []string, ext string) bool {
+	for _, name := range names {
+		if name == this.Name || name == this.Media || strings.EqualFold(name, ext) {
+			return true
+		}
+	}
+	return false
+}
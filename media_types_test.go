@@ -0,0 +1,152 @@
+package photosync_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Reisender/photosync"
+)
+
+// The start of an ISO media file with the given major brand
+func ftyp(brand string) string {
+	return "\x00\x00\x00\x18ftyp" + brand + "\x00\x00\x00\x00" + brand + "isom"
+}
+
+var testMedia = map[string]string{
+	"photo.heic":  ftyp("heic"),
+	"heic":        ftyp("heic"),
+	"mif1":        ftyp("mif1"),
+	"qt":          ftyp("qt  "),
+	"isom":        ftyp("isom"),
+	"m4a":         ftyp("M4A "),
+	"old-movie":   "\x00\x00\x00\x08wide\x00\x00\x00\x10mdat",
+	"jpeg":        "\xff\xd8\xff\xe0\x00\x10JFIF\x00",
+	"png":         "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR",
+	"tiff":        "II*\x00\x08\x00\x00\x00",
+	"text":        "just some notes",
+	"empty":       "",
+	"movie.JPG":   ftyp("isom"), // the extension isn't what's in it
+	"photo.mov":   "\xff\xd8\xff\xe0\x00\x10JFIF\x00",
+	"notes.txt":   "\xff\xd8\xff\xe0\x00\x10JFIF\x00",
+	"clip.THM":    "\xff\xd8\xff\xe0\x00\x10JFIF\x00",
+	"raw.CR2":     "II*\x00\x10\x00\x00\x00CR",
+	"dir.jpg/img": "\xff\xd8\xff\xe0\x00\x10JFIF\x00", // a dot in a folder isn't an extension
+}
+
+func TestSniffMime(t *testing.T) {
+	dir := tempDir(t)
+	writeFiles(t, dir, testMedia)
+
+	tests := []struct {
+		name, mime string
+	}{
+		{"heic", "image/heic"},
+		{"mif1", "image/heif"},
+		{"qt", "video/quicktime"},
+		{"isom", "video/mp4"},
+		{"m4a", "application/octet-stream"},
+		{"old-movie", "video/quicktime"},
+		{"jpeg", "image/jpeg"},
+		{"png", "image/png"},
+		{"tiff", "image/tiff"},
+		{"text", "text/plain"},
+		{"empty", "text/plain"},
+		{"movie.JPG", "video/mp4"},
+	}
+	for _, test := range tests {
+		mime, err := photosync.SniffMime(filepath.Join(dir, test.name))
+		if err != nil || mime != test.mime {
+			t.Errorf("%s: got %q %v, want %q", test.name, mime, err, test.mime)
+		}
+	}
+
+	if _, err := photosync.SniffMime(filepath.Join(dir, "missing")); err == nil {
+		t.Error("sniffed a missing file")
+	}
+}
+
+func TestDetectMediaType(t *testing.T) {
+	dir := tempDir(t)
+	writeFiles(t, dir, testMedia)
+
+	tests := []struct {
+		name, mediaType string
+	}{
+		{"photo.heic", "heic"},
+		{"heic", "heic"},
+		{"mif1", "heic"},
+		{"qt", "quicktime"},
+		{"isom", "mp4"},
+		{"old-movie", "quicktime"},
+		{"jpeg", "jpeg"},
+		{"png", "png"},
+		{"tiff", "tiff"},
+		{"raw.CR2", "raw"},
+		{"dir.jpg/img", "jpeg"},
+
+		// the extension wins over what's in the file
+		{"movie.JPG", "jpeg"},
+		{"photo.mov", "quicktime"},
+
+		// types we don't sync
+		{"m4a", ""},
+		{"text", ""},
+		{"empty", ""},
+		{"notes.txt", ""},
+		{"clip.THM", ""},
+	}
+	for _, test := range tests {
+		mt, err := photosync.DetectMediaType(filepath.Join(dir, test.name))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		name := ""
+		if mt != nil {
+			name = mt.Name
+		}
+		if name != test.mediaType {
+			t.Errorf("%s: got %q, want %q", test.name, name, test.mediaType)
+		}
+	}
+
+	// only the extension is needed when there is one
+	if mt, err := photosync.DetectMediaType(filepath.Join(dir, "missing.mp4")); err != nil || mt == nil || mt.Name != "mp4" {
+		t.Errorf("missing.mp4: got %v %v", mt, err)
+	}
+	if _, err := photosync.DetectMediaType(filepath.Join(dir, "missing")); err == nil {
+		t.Error("detected a missing file without an extension")
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	jpeg := photosync.MediaTypeForExt(".jpg")
+	mov := photosync.MediaTypeForExt(".MOV")
+	raw := photosync.MediaTypeForExt(".cr2")
+
+	tests := []struct {
+		name             string
+		include, exclude []string
+		mt               *photosync.MediaType
+		ext              string
+		want             bool
+	}{
+		{"everything by default", nil, nil, jpeg, ".JPG", true},
+		{"included kind", []string{"photo"}, nil, jpeg, ".jpg", true},
+		{"kind not included", []string{"photo"}, nil, mov, ".MOV", false},
+		{"included type", []string{"quicktime"}, nil, mov, ".MOV", true},
+		{"included extension in any case", []string{".mov"}, nil, mov, ".MOV", true},
+		{"other extension of an included type", []string{".JPEG"}, nil, jpeg, ".JPG", false},
+		{"excluded kind", nil, []string{"video"}, mov, ".MOV", false},
+		{"excluded type", nil, []string{"raw"}, raw, ".CR2", false},
+		{"excluded extension", nil, []string{".cr2"}, raw, ".CR2", false},
+		{"exclude wins over include", []string{"photo"}, []string{"raw"}, raw, ".CR2", false},
+		{"not excluded", []string{"photo"}, []string{"raw"}, jpeg, ".JPG", true},
+	}
+	for _, test := range tests {
+		cfg := photosync.WatchDirConfig{Include: test.include, Exclude: test.exclude}
+		if got := cfg.Accepts(test.mt, test.ext); got != test.want {
+			t.Errorf("%s: got %v", test.name, got)
+		}
+	}
+}
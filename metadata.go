@@ -0,0 +1,260 @@
+package photosync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reads the metadata we care about out of photos and videos. Both backends
+// fill in ExifToolOutput the way `exiftool -g1 -json` would.
+type MetadataReader interface {
+	// Read a single file. Files without metadata we understand come back
+	// empty, only failing to read the file at all is an error.
+	Read(ctx context.Context, path string) (*ExifToolOutput, error)
+
+	// Read every file under dir, apart from those skip is true for (and
+	// everything in folders it is true for) when it isn't nil. Files that
+	// can't be read are left out rather than failing the lot.
+	ReadDir(ctx context.Context, dir string, skip func(path string) bool) (*[]ExifToolOutput, error)
+}
+
+// names for PhotosyncConfig.Metadata
+const (
+	NativeMetadata   = "native"
+	ExifToolMetadata = "exiftool"
+)
+
+// Used when the config doesn't pick a reader and by GetExifData and friends
+var DefaultMetadataReader MetadataReader = NativeReader{}
+
+// The reader for a PhotosyncConfig.Metadata name. Empty gives the default.
+func NewMetadataReader(name string) (MetadataReader, error) {
+	switch name {
+	case "":
+		return DefaultMetadataReader, nil
+	case NativeMetadata:
+		return NativeReader{}, nil
+	case ExifToolMetadata:
+		return &ExifToolReader{}, nil
+	}
+	return nil, fmt.Errorf("unknown metadata reader %q, must be %s or %s", name, NativeMetadata, ExifToolMetadata)
+}
+
+// ExifToolReader reads with exiftool, starting one for every read unless it
+// is given a session to share. It needs exiftool (and perl) installed.
+type ExifToolReader struct {
+	Path    string // the exiftool to run, found on the PATH when empty
+	Session *ExifToolSession
+}
+
+func (this *ExifToolReader) Read(ctx context.Context, path string) (*ExifToolOutput, error) {
+	exifs, err := this.run(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(*exifs) == 0 {
+		return nil, Error{"no exif data found"}
+	}
+	return &(*exifs)[0], nil
+}
+
+func (this *ExifToolReader) ReadDir(ctx context.Context, dir string, skip func(path string) bool) (*[]ExifToolOutput, error) {
+	exifs, err := this.run(ctx, dir)
+	if err != nil || skip == nil {
+		return exifs, err
+	}
+
+	// exiftool has no patterns to leave files out with, drop them after
+	kept := []ExifToolOutput{}
+	for _, exif := range *exifs {
+		if !skip(exif.SourceFile) {
+			kept = append(kept, exif)
+		}
+	}
+	return &kept, nil
+}
+
+func (this *ExifToolReader) run(ctx context.Context, path string) (*[]ExifToolOutput, error) {
+	args := []string{"-a", "-u", "-g1", "-json", "-r", path}
+
+	var out []byte
+	var err error
+	if this.Session != nil {
+		out, err = this.Session.Execute(ctx, args...)
+	} else {
+		bin := this.Path
+		if len(bin) == 0 {
+			bin = "exiftool"
+		}
+		out, err = exec.CommandContext(ctx, bin, args...).Output()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// kill new lines
+	out = []byte(strings.Replace(string(out), "\n", "", -1))
+
+	var exif []ExifToolOutput
+	if err := json.Unmarshal(out, &exif); err != nil {
+		return nil, fmt.Errorf("unmarshal error: %v", err)
+	}
+
+	return &exif, nil
+}
+
+// exiftool -json prints anything that looks like a number as one
+type FlexString string
+
+func (this *FlexString) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*this = FlexString(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*this = FlexString(n)
+	return nil
+}
+
+// When the photo or video was taken. Tries the EXIF capture time, then the
+// QuickTime dates, then the IFD0 modify date.
+func (this *ExifToolOutput) DateTaken() (time.Time, bool) {
+	if t, ok := exifTime(this.ExifIFD.DateTimeOriginal, this.ExifIFD.SubSecTimeOriginal, this.ExifIFD.OffsetTimeOriginal); ok {
+		return t, true
+	}
+	if t, ok := exifTime(this.ExifIFD.CreateDate, this.ExifIFD.SubSecTimeDigitized, this.ExifIFD.OffsetTimeDigitized); ok {
+		return t, true
+	}
+
+	// phones write the local time with its offset, prefer it to the UTC movie header
+	if t, err := time.Parse("2006:01:02 15:04:05-07:00", this.Keys.CreationDate); err == nil {
+		return t, true
+	}
+	if t, err := time.ParseInLocation(ExifTimeLayout, this.QuickTime.CreateDate, time.UTC); err == nil && !t.IsZero() {
+		return t.Local(), true
+	}
+
+	return exifTime(this.Ifd.ModifyDate, this.ExifIFD.SubSecTime, this.ExifIFD.OffsetTime)
+}
+
+// Parse an EXIF date with its optional sub seconds and offset. Without an
+// offset the date is taken to be local time.
+func exifTime(date string, subsec FlexString, offset string) (time.Time, bool) {
+	if len(date) < len(ExifTimeLayout) {
+		return time.Time{}, false
+	}
+
+	value, layout := date[:len(ExifTimeLayout)], ExifTimeLayout
+	if digits := strings.TrimSpace(string(subsec)); len(digits) > 0 {
+		if _, err := strconv.Atoi(digits); err == nil {
+			value += "." + digits
+			layout += ".999999999"
+		}
+	}
+
+	loc := time.Local
+	if len(offset) > 0 {
+		if o, err := time.Parse("-07:00", offset); err == nil {
+			_, secs := o.Zone()
+			loc = time.FixedZone(offset, secs)
+		}
+	}
+
+	t, err := time.ParseInLocation(layout, value, loc)
+	if err != nil || t.Year() < 1900 { // exiftool shows unset dates as 0000:00:00
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Where the photo was taken in decimal degrees, south and west negative
+func (this *ExifToolOutput) Position() (float64, float64, bool) {
+	lat, ok := parseExifCoord(string(this.GPS.GPSLatitude), this.GPS.GPSLatitudeRef)
+	if !ok {
+		return 0, 0, false
+	}
+	lon, ok := parseExifCoord(string(this.GPS.GPSLongitude), this.GPS.GPSLongitudeRef)
+	if !ok {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// Meters above sea level, negative below it
+func (this *ExifToolOutput) Altitude() (float64, bool) {
+	v := strings.Fields(string(this.GPS.GPSAltitude))
+	if len(v) == 0 {
+		return 0, false
+	}
+	alt, err := strconv.ParseFloat(v[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	if strings.HasPrefix(this.GPS.GPSAltitudeRef, "Below") || this.GPS.GPSAltitudeRef == "1" {
+		alt = -alt
+	}
+	return alt, true
+}
+
+// The make and model from whichever part of the file had them
+func (this *ExifToolOutput) Camera() string {
+	for _, mm := range [][2]string{
+		{this.Ifd.Make, this.Ifd.Model},
+		{this.Keys.Make, this.Keys.Model},
+		{this.UserData.Make, this.UserData.Model},
+	} {
+		if len(mm[0]) > 0 || len(mm[1]) > 0 {
+			// models often repeat the make
+			if strings.HasPrefix(mm[1], mm[0]) {
+				return strings.TrimSpace(mm[1])
+			}
+			return strings.TrimSpace(mm[0] + " " + mm[1])
+		}
+	}
+	return ""
+}
+
+// 37 deg 46' 30.00" N, or a plain number when exiftool ran with -n
+var exifCoordRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?) deg (\d+(?:\.\d+)?)' (\d+(?:\.\d+)?)"\s*([NSEW]?)$`)
+
+func parseExifCoord(value, ref string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	var deg float64
+	if m := exifCoordRegexp.FindStringSubmatch(value); m != nil {
+		d, _ := strconv.ParseFloat(m[1], 64)
+		min, _ := strconv.ParseFloat(m[2], 64)
+		sec, _ := strconv.ParseFloat(m[3], 64)
+		deg = d + min/60 + sec/3600
+		if len(m[4]) > 0 {
+			ref = m[4]
+		}
+	} else if f, err := strconv.ParseFloat(value, 64); err == nil {
+		deg = f
+	} else {
+		return 0, false
+	}
+
+	if strings.HasPrefix(ref, "S") || strings.HasPrefix(ref, "W") {
+		deg = -deg
+	}
+	return deg, true
+}
+
+// make sure the backends keep satisfying the interface
+var _ MetadataReader = NativeReader{}
+var _ MetadataReader = (*ExifToolReader)(nil)
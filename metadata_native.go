@@ -0,0 +1,911 @@
+package photosync
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NativeReader reads metadata in Go without shelling out. It understands
+// EXIF in JPEG, TIFF (and the RAW formats built on it) and HEIC, and the
+// movie header and make/model atoms in QuickTime and MP4 files.
+type NativeReader struct{}
+
+func (this NativeReader) Read(ctx context.Context, path string) (*ExifToolOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	exif := &ExifToolOutput{SourceFile: path}
+	if info.IsDir() {
+		return exif, nil
+	}
+
+	// broken metadata isn't fatal, flag it the way exiftool does
+	if err := readMetadata(f, info.Size(), exif); err != nil {
+		exif.ExifTool.Warning = err.Error()
+	}
+
+	return exif, nil
+}
+
+func (this NativeReader) ReadDir(ctx context.Context, dir string, skip func(path string) bool) (*[]ExifToolOutput, error) {
+	exifs := []ExifToolOutput{}
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			// one unreadable file or folder shouldn't stop the rest
+			log.Println("error reading metadata for", path, err)
+			return nil
+		}
+		if skip != nil && skip(path) {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if f.IsDir() {
+			return nil
+		}
+
+		exif, err := this.Read(ctx, path)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Println("error reading metadata for", path, err)
+			return nil
+		}
+		exifs = append(exifs, *exif)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &exifs, nil
+}
+
+var errBadMetadata = errors.New("malformed metadata")
+
+// Figure out the container from the first few bytes and read what we can out of it
+func readMetadata(r io.ReaderAt, size int64, exif *ExifToolOutput) error {
+	head := make([]byte, 12)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8}):
+		return readJpeg(r, size, exif)
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return readTiff(io.NewSectionReader(r, 0, size), exif)
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		switch string(head[8:12]) {
+		case "heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1", "avif":
+			return readHeif(r, size, exif)
+		}
+		return readQuickTime(r, size, exif)
+	case len(head) >= 8:
+		switch string(head[4:8]) {
+		case "moov", "mdat", "wide", "free", "skip", "pnot":
+			// old QuickTime files don't start with ftyp
+			return readQuickTime(r, size, exif)
+		}
+	}
+
+	return nil // nothing we know how to read
+}
+
+// ***** JPEG *****
+
+// Walk the JPEG segments up to the image data looking for the EXIF APP1
+func readJpeg(r io.ReaderAt, size int64, exif *ExifToolOutput) error {
+	off := int64(2)
+	buf := make([]byte, 4)
+	for off+4 <= size {
+		if _, err := r.ReadAt(buf, off); err != nil {
+			return err
+		}
+		if buf[0] != 0xFF {
+			return fmt.Errorf("%v: bad JPEG marker at %d", errBadMetadata, off)
+		}
+
+		marker := buf[1]
+		switch {
+		case marker == 0xFF: // fill byte
+			off++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7): // no length
+			off += 2
+			continue
+		case marker == 0xDA || marker == 0xD9: // start of scan or end of image
+			return nil
+		}
+
+		length := int64(binary.BigEndian.Uint16(buf[2:]))
+		if length < 2 {
+			return fmt.Errorf("%v: bad JPEG segment length at %d", errBadMetadata, off)
+		}
+
+		if marker == 0xE1 && length > 8 {
+			sig := make([]byte, 6)
+			if _, err := r.ReadAt(sig, off+4); err != nil {
+				return err
+			}
+			if string(sig) == "Exif\x00\x00" {
+				return readTiff(io.NewSectionReader(r, off+10, length-8), exif)
+			}
+		}
+
+		off += 2 + length
+	}
+	return nil
+}
+
+// ***** TIFF / EXIF *****
+
+// tag ids we read out of IFD0
+const (
+	tagMake        = 0x010F
+	tagModel       = 0x0110
+	tagOrientation = 0x0112
+	tagModifyDate  = 0x0132
+	tagExifIfd     = 0x8769
+	tagGpsIfd      = 0x8825
+)
+
+// tag ids in the EXIF IFD
+const (
+	tagExposureTime        = 0x829A
+	tagFNumber             = 0x829D
+	tagISO                 = 0x8827
+	tagDateTimeOriginal    = 0x9003
+	tagCreateDate          = 0x9004
+	tagOffsetTime          = 0x9010
+	tagOffsetTimeOriginal  = 0x9011
+	tagOffsetTimeDigitized = 0x9012
+	tagFocalLength         = 0x920A
+	tagSubSecTime          = 0x9290
+	tagSubSecTimeOriginal  = 0x9291
+	tagSubSecTimeDigitized = 0x9292
+	tagLensModel           = 0xA434
+)
+
+// tag ids in the GPS IFD
+const (
+	tagGpsLatitudeRef  = 0x01
+	tagGpsLatitude     = 0x02
+	tagGpsLongitudeRef = 0x03
+	tagGpsLongitude    = 0x04
+	tagGpsAltitudeRef  = 0x05
+	tagGpsAltitude     = 0x06
+)
+
+// how exiftool prints the orientation values
+var orientationNames = map[uint32]string{
+	1: "Horizontal (normal)",
+	2: "Mirror horizontal",
+	3: "Rotate 180",
+	4: "Mirror vertical",
+	5: "Mirror horizontal and rotate 270 CW",
+	6: "Rotate 90 CW",
+	7: "Mirror horizontal and rotate 90 CW",
+	8: "Rotate 270 CW",
+}
+
+// bytes per value for each TIFF field type
+var tiffTypeSizes = map[uint16]int64{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// One IFD entry with its value bytes
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	data  []byte
+	order binary.ByteOrder
+}
+
+func (this *tiffEntry) String() string {
+	if this.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(this.data), "\x00"))
+}
+
+// The i-th value of a RATIONAL or SRATIONAL
+func (this *tiffEntry) Rational(i int) (float64, bool) {
+	if uint32(i) >= this.count || (this.typ != 5 && this.typ != 10) {
+		return 0, false
+	}
+	num := this.order.Uint32(this.data[i*8:])
+	den := this.order.Uint32(this.data[i*8+4:])
+	if den == 0 {
+		return 0, false
+	}
+	if this.typ == 10 {
+		return float64(int32(num)) / float64(int32(den)), true
+	}
+	return float64(num) / float64(den), true
+}
+
+func (this *tiffEntry) Uint() (uint32, bool) {
+	if this.count == 0 {
+		return 0, false
+	}
+	switch this.typ {
+	case 1, 7:
+		return uint32(this.data[0]), true
+	case 3:
+		return uint32(this.order.Uint16(this.data)), true
+	case 4:
+		return this.order.Uint32(this.data), true
+	}
+	return 0, false
+}
+
+// A parsed TIFF structure. Offsets are from the start of the TIFF header.
+type tiffReader struct {
+	r     *io.SectionReader
+	order binary.ByteOrder
+}
+
+func readTiff(r *io.SectionReader, exif *ExifToolOutput) error {
+	t, ifd0, err := newTiffReader(r)
+	if err != nil {
+		return err
+	}
+
+	entries, err := t.readIfd(ifd0)
+	if err != nil {
+		return err
+	}
+
+	if e, ok := entries[tagMake]; ok {
+		exif.Ifd.Make = e.String()
+	}
+	if e, ok := entries[tagModel]; ok {
+		exif.Ifd.Model = e.String()
+	}
+	if e, ok := entries[tagModifyDate]; ok {
+		exif.Ifd.ModifyDate = e.String()
+	}
+	if e, ok := entries[tagOrientation]; ok {
+		if v, ok := e.Uint(); ok {
+			if name, ok := orientationNames[v]; ok {
+				exif.Ifd.Orientation = name
+			} else {
+				exif.Ifd.Orientation = fmt.Sprintf("Unknown (%d)", v)
+			}
+		}
+	}
+
+	if e, ok := entries[tagExifIfd]; ok {
+		if off, ok := e.Uint(); ok {
+			sub, err := t.readIfd(off)
+			if err != nil {
+				return err
+			}
+			readExifIfd(sub, exif)
+		}
+	}
+
+	if e, ok := entries[tagGpsIfd]; ok {
+		if off, ok := e.Uint(); ok {
+			sub, err := t.readIfd(off)
+			if err != nil {
+				return err
+			}
+			readGpsIfd(sub, exif)
+		}
+	}
+
+	return nil
+}
+
+// Fill in ExifIFD printing the values the way exiftool does
+func readExifIfd(entries map[uint16]*tiffEntry, exif *ExifToolOutput) {
+	str := func(tag uint16) string {
+		if e, ok := entries[tag]; ok {
+			return e.String()
+		}
+		return ""
+	}
+
+	exif.ExifIFD.DateTimeOriginal = str(tagDateTimeOriginal)
+	exif.ExifIFD.CreateDate = str(tagCreateDate)
+	exif.ExifIFD.SubSecTime = FlexString(str(tagSubSecTime))
+	exif.ExifIFD.SubSecTimeOriginal = FlexString(str(tagSubSecTimeOriginal))
+	exif.ExifIFD.SubSecTimeDigitized = FlexString(str(tagSubSecTimeDigitized))
+	exif.ExifIFD.OffsetTime = str(tagOffsetTime)
+	exif.ExifIFD.OffsetTimeOriginal = str(tagOffsetTimeOriginal)
+	exif.ExifIFD.OffsetTimeDigitized = str(tagOffsetTimeDigitized)
+	exif.ExifIFD.LensModel = FlexString(str(tagLensModel))
+
+	if e, ok := entries[tagISO]; ok {
+		if v, ok := e.Uint(); ok {
+			exif.ExifIFD.ISO = FlexString(strconv.Itoa(int(v)))
+		}
+	}
+	if e, ok := entries[tagExposureTime]; ok {
+		if v, ok := e.Rational(0); ok {
+			if v > 0 && v < 0.25001 {
+				exif.ExifIFD.ExposureTime = FlexString(fmt.Sprintf("1/%d", int(0.5+1/v)))
+			} else {
+				exif.ExifIFD.ExposureTime = FlexString(strings.TrimSuffix(fmt.Sprintf("%.1f", v), ".0"))
+			}
+		}
+	}
+	if e, ok := entries[tagFNumber]; ok {
+		if v, ok := e.Rational(0); ok {
+			exif.ExifIFD.FNumber = FlexString(fmt.Sprintf("%.1f", v))
+		}
+	}
+	if e, ok := entries[tagFocalLength]; ok {
+		if v, ok := e.Rational(0); ok {
+			exif.ExifIFD.FocalLength = FlexString(fmt.Sprintf("%.1f mm", v))
+		}
+	}
+}
+
+// Fill in GPS printing the values the way exiftool does
+func readGpsIfd(entries map[uint16]*tiffEntry, exif *ExifToolOutput) {
+	coord := func(tag uint16) FlexString {
+		e, ok := entries[tag]
+		if !ok {
+			return ""
+		}
+		deg := 0.0
+		for i, div := range []float64{1, 60, 3600} {
+			v, ok := e.Rational(i)
+			if !ok {
+				break
+			}
+			deg += v / div
+		}
+		d := int(deg)
+		m := int((deg - float64(d)) * 60)
+		sec := (deg - float64(d) - float64(m)/60) * 3600
+		return FlexString(fmt.Sprintf("%d deg %d' %.2f\"", d, m, sec))
+	}
+	ref := func(tag uint16, names map[string]string) string {
+		if e, ok := entries[tag]; ok {
+			return names[e.String()]
+		}
+		return ""
+	}
+
+	exif.GPS.GPSLatitude = coord(tagGpsLatitude)
+	exif.GPS.GPSLatitudeRef = ref(tagGpsLatitudeRef, map[string]string{"N": "North", "S": "South"})
+	exif.GPS.GPSLongitude = coord(tagGpsLongitude)
+	exif.GPS.GPSLongitudeRef = ref(tagGpsLongitudeRef, map[string]string{"E": "East", "W": "West"})
+
+	if e, ok := entries[tagGpsAltitude]; ok {
+		if v, ok := e.Rational(0); ok {
+			exif.GPS.GPSAltitude = FlexString(strconv.FormatFloat(v, 'f', -1, 64) + " m")
+		}
+	}
+	if e, ok := entries[tagGpsAltitudeRef]; ok {
+		if v, ok := e.Uint(); ok {
+			if v == 1 {
+				exif.GPS.GPSAltitudeRef = "Below Sea Level"
+			} else {
+				exif.GPS.GPSAltitudeRef = "Above Sea Level"
+			}
+		}
+	}
+}
+
+// Check the header and return the offset of IFD0
+func newTiffReader(r *io.SectionReader) (*tiffReader, uint32, error) {
+	head := make([]byte, 8)
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return nil, 0, fmt.Errorf("%v: short TIFF header", errBadMetadata)
+	}
+
+	t := &tiffReader{r: r}
+	switch string(head[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("%v: bad TIFF byte order", errBadMetadata)
+	}
+	if t.order.Uint16(head[2:]) != 42 {
+		return nil, 0, fmt.Errorf("%v: bad TIFF magic", errBadMetadata)
+	}
+
+	return t, t.order.Uint32(head[4:]), nil
+}
+
+// Read the entries of the IFD at off keyed by tag
+func (this *tiffReader) readIfd(off uint32) (map[uint16]*tiffEntry, error) {
+	size := this.r.Size()
+
+	buf := make([]byte, 2)
+	if _, err := this.r.ReadAt(buf, int64(off)); err != nil {
+		return nil, fmt.Errorf("%v: IFD offset %d out of range", errBadMetadata, off)
+	}
+	n := int64(this.order.Uint16(buf))
+
+	raw := make([]byte, n*12)
+	if _, err := this.r.ReadAt(raw, int64(off)+2); err != nil {
+		return nil, fmt.Errorf("%v: IFD at %d is truncated", errBadMetadata, off)
+	}
+
+	entries := make(map[uint16]*tiffEntry)
+	for i := int64(0); i < n; i++ {
+		e := raw[i*12 : i*12+12]
+		tag := this.order.Uint16(e)
+		typ := this.order.Uint16(e[2:])
+		count := this.order.Uint32(e[4:])
+
+		typeSize, ok := tiffTypeSizes[typ]
+		if !ok {
+			continue // unknown type, skip it like exiftool does
+		}
+		length := typeSize * int64(count)
+		if length > size {
+			return nil, fmt.Errorf("%v: tag 0x%04x is too big", errBadMetadata, tag)
+		}
+
+		var data []byte
+		if length <= 4 {
+			data = e[8 : 8+length]
+		} else {
+			data = make([]byte, length)
+			if _, err := this.r.ReadAt(data, int64(this.order.Uint32(e[8:]))); err != nil {
+				return nil, fmt.Errorf("%v: tag 0x%04x points outside the EXIF data", errBadMetadata, tag)
+			}
+		}
+
+		entries[tag] = &tiffEntry{typ: typ, count: count, data: data, order: this.order}
+	}
+
+	return entries, nil
+}
+
+// ***** ISO base media (HEIC, QuickTime, MP4) *****
+
+// A box (atom) with the position and size of its payload
+type bmffBox struct {
+	typ  string
+	off  int64
+	size int64
+}
+
+// Call fn for each box between off and end
+func readBoxes(r io.ReaderAt, off, end int64, fn func(box bmffBox) error) error {
+	head := make([]byte, 16)
+	for off+8 <= end {
+		if _, err := r.ReadAt(head[:8], off); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(head))
+		typ := string(head[4:8])
+		hdr := int64(8)
+
+		switch size {
+		case 0: // runs to the end
+			size = end - off
+		case 1: // 64 bit size follows
+			if _, err := r.ReadAt(head[8:16], off+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(head[8:]))
+			hdr = 16
+		}
+		if size < hdr || off+size > end {
+			return fmt.Errorf("%v: bad %q box size at %d", errBadMetadata, typ, off)
+		}
+
+		if err := fn(bmffBox{typ, off + hdr, size - hdr}); err != nil {
+			return err
+		}
+		off += size
+	}
+	return nil
+}
+
+// Read the payload of a box, refusing anything silly large
+func readBox(r io.ReaderAt, box bmffBox) ([]byte, error) {
+	if box.size > 1<<20 {
+		return nil, fmt.Errorf("%v: %q box is too big", errBadMetadata, box.typ)
+	}
+	b := make([]byte, box.size)
+	if _, err := r.ReadAt(b, box.off); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reads big endian fields off the front of a byte slice
+type beReader struct {
+	b   []byte
+	err error
+}
+
+func (this *beReader) uint(n int) uint64 {
+	if this.err != nil {
+		return 0
+	}
+	if n > len(this.b) {
+		this.err = fmt.Errorf("%v: box is truncated", errBadMetadata)
+		return 0
+	}
+	var v uint64
+	for _, c := range this.b[:n] {
+		v = v<<8 | uint64(c)
+	}
+	this.b = this.b[n:]
+	return v
+}
+
+func (this *beReader) bytes(n int) []byte {
+	if this.err != nil {
+		return nil
+	}
+	if n > len(this.b) {
+		this.err = fmt.Errorf("%v: box is truncated", errBadMetadata)
+		return nil
+	}
+	v := this.b[:n]
+	this.b = this.b[n:]
+	return v
+}
+
+// HEIC keeps the EXIF as an item in the meta box
+func readHeif(r io.ReaderAt, size int64, exif *ExifToolOutput) error {
+	var meta *bmffBox
+	err := readBoxes(r, 0, size, func(box bmffBox) error {
+		if box.typ == "meta" && meta == nil {
+			meta = &box
+		}
+		return nil
+	})
+	if err != nil || meta == nil {
+		return err
+	}
+
+	// meta is a full box, skip the version and flags
+	exifId := uint64(0)
+	var iloc []byte
+	err = readBoxes(r, meta.off+4, meta.off+meta.size, func(box bmffBox) error {
+		switch box.typ {
+		case "iinf":
+			id, err := heifExifItem(r, box)
+			if err != nil {
+				return err
+			}
+			exifId = id
+		case "iloc":
+			b, err := readBox(r, box)
+			if err != nil {
+				return err
+			}
+			iloc = b
+		}
+		return nil
+	})
+	if err != nil || exifId == 0 || iloc == nil {
+		return err
+	}
+
+	off, length, err := heifItemExtent(iloc, exifId)
+	if err != nil || length < 4 {
+		return err
+	}
+
+	// the item starts with the offset to the TIFF header, usually past "Exif\0\0"
+	buf := make([]byte, 4)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return err
+	}
+	skip := int64(binary.BigEndian.Uint32(buf)) + 4
+	if skip >= length {
+		return fmt.Errorf("%v: bad HEIC Exif item header", errBadMetadata)
+	}
+
+	return readTiff(io.NewSectionReader(r, off+skip, length-skip), exif)
+}
+
+// The id of the Exif item listed in the iinf box, 0 if there isn't one
+func heifExifItem(r io.ReaderAt, iinf bmffBox) (uint64, error) {
+	b, err := readBox(r, iinf)
+	if err != nil {
+		return 0, err
+	}
+
+	br := &beReader{b: b}
+	version := br.uint(1)
+	br.uint(3)
+	if version == 0 {
+		br.uint(2)
+	} else {
+		br.uint(4)
+	}
+	if br.err != nil {
+		return 0, br.err
+	}
+
+	start := iinf.off + int64(len(b)-len(br.b))
+	var id uint64
+	err = readBoxes(r, start, iinf.off+iinf.size, func(box bmffBox) error {
+		if box.typ != "infe" || id != 0 {
+			return nil
+		}
+		infe, err := readBox(r, box)
+		if err != nil {
+			return err
+		}
+
+		ir := &beReader{b: infe}
+		v := ir.uint(1)
+		ir.uint(3)
+		if v < 2 {
+			return nil // too old to have item types
+		}
+		var itemId uint64
+		if v == 2 {
+			itemId = ir.uint(2)
+		} else {
+			itemId = ir.uint(4)
+		}
+		ir.uint(2) // protection index
+		itemType := string(ir.bytes(4))
+		if ir.err != nil {
+			return ir.err
+		}
+		if itemType == "Exif" {
+			id = itemId
+		}
+		return nil
+	})
+
+	return id, err
+}
+
+// The file offset and length of the first extent of the item from the iloc box
+func heifItemExtent(iloc []byte, itemId uint64) (int64, int64, error) {
+	br := &beReader{b: iloc}
+	version := br.uint(1)
+	br.uint(3)
+	sizes := br.uint(2)
+	offsetSize := int(sizes >> 12 & 0xF)
+	lengthSize := int(sizes >> 8 & 0xF)
+	baseOffsetSize := int(sizes >> 4 & 0xF)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xF)
+	}
+
+	var count uint64
+	if version < 2 {
+		count = br.uint(2)
+	} else {
+		count = br.uint(4)
+	}
+
+	for i := uint64(0); i < count && br.err == nil; i++ {
+		var id uint64
+		if version < 2 {
+			id = br.uint(2)
+		} else {
+			id = br.uint(4)
+		}
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			method = br.uint(2) & 0xF
+		}
+		br.uint(2) // data reference index
+		base := br.uint(baseOffsetSize)
+		extents := br.uint(2)
+
+		for j := uint64(0); j < extents && br.err == nil; j++ {
+			br.uint(indexSize)
+			off := br.uint(offsetSize)
+			length := br.uint(lengthSize)
+			if id == itemId && j == 0 {
+				if method != 0 {
+					return 0, 0, fmt.Errorf("%v: unsupported HEIC item construction", errBadMetadata)
+				}
+				return int64(base + off), int64(length), br.err
+			}
+		}
+	}
+
+	return 0, 0, br.err
+}
+
+// seconds between the QuickTime epoch (1904) and the unix one
+const quickTimeEpochOffset = 2082844800
+
+// Pull the dates out of the movie header and make and model out of the user data and keys
+func readQuickTime(r io.ReaderAt, size int64, exif *ExifToolOutput) error {
+	return readBoxes(r, 0, size, func(box bmffBox) error {
+		if box.typ != "moov" {
+			return nil
+		}
+		return readBoxes(r, box.off, box.off+box.size, func(box bmffBox) error {
+			switch box.typ {
+			case "mvhd":
+				return readMovieHeader(r, box, exif)
+			case "udta":
+				return readUserData(r, box, exif)
+			case "meta":
+				return readKeys(r, box, exif)
+			}
+			return nil
+		})
+	})
+}
+
+func readMovieHeader(r io.ReaderAt, box bmffBox, exif *ExifToolOutput) error {
+	b, err := readBox(r, box)
+	if err != nil {
+		return err
+	}
+
+	br := &beReader{b: b}
+	n := 4
+	if br.uint(1) == 1 {
+		n = 8
+	}
+	br.uint(3)
+	created := br.uint(n)
+	modified := br.uint(n)
+	if br.err != nil {
+		return br.err
+	}
+
+	exif.QuickTime.CreateDate = quickTimeDate(created)
+	exif.QuickTime.ModifyDate = quickTimeDate(modified)
+	return nil
+}
+
+// exiftool's format for a QuickTime timestamp, empty when it isn't set
+func quickTimeDate(secs uint64) string {
+	if secs < quickTimeEpochOffset {
+		return ""
+	}
+	return time.Unix(int64(secs-quickTimeEpochOffset), 0).UTC().Format(ExifTimeLayout)
+}
+
+// the ©mak and ©mod text atoms in udta
+func readUserData(r io.ReaderAt, udta bmffBox, exif *ExifToolOutput) error {
+	return readBoxes(r, udta.off, udta.off+udta.size, func(box bmffBox) error {
+		var dst *string
+		switch box.typ {
+		case "\xa9mak":
+			dst = &exif.UserData.Make
+		case "\xa9mod":
+			dst = &exif.UserData.Model
+		default:
+			return nil
+		}
+
+		b, err := readBox(r, box)
+		if err != nil {
+			return err
+		}
+		br := &beReader{b: b}
+		n := br.uint(2)
+		br.uint(2) // language
+		text := br.bytes(int(n))
+		if br.err != nil {
+			return br.err
+		}
+		*dst = strings.TrimRight(string(text), "\x00")
+		return nil
+	})
+}
+
+// the com.apple.quicktime.* keys that iPhones and the like write
+func readKeys(r io.ReaderAt, meta bmffBox, exif *ExifToolOutput) error {
+	start := meta.off
+	// the ISO flavour of meta is a full box, the QuickTime one isn't
+	buf := make([]byte, 4)
+	if _, err := r.ReadAt(buf, start); err == nil && binary.BigEndian.Uint32(buf) == 0 {
+		start += 4
+	}
+
+	var keys []string
+	var ilst *bmffBox
+	err := readBoxes(r, start, meta.off+meta.size, func(box bmffBox) error {
+		switch box.typ {
+		case "keys":
+			b, err := readBox(r, box)
+			if err != nil {
+				return err
+			}
+			br := &beReader{b: b}
+			br.uint(4) // version and flags
+			count := br.uint(4)
+			for i := uint64(0); i < count && br.err == nil; i++ {
+				n := br.uint(4)
+				if n < 8 {
+					return fmt.Errorf("%v: bad key size", errBadMetadata)
+				}
+				br.uint(4) // namespace
+				keys = append(keys, string(br.bytes(int(n-8))))
+			}
+			return br.err
+		case "ilst":
+			ilst = &box
+		}
+		return nil
+	})
+	if err != nil || ilst == nil {
+		return err
+	}
+
+	return readBoxes(r, ilst.off, ilst.off+ilst.size, func(item bmffBox) error {
+		// items are named by their 1 based index into keys
+		idx := int(binary.BigEndian.Uint32([]byte(item.typ)))
+		if idx < 1 || idx > len(keys) {
+			return nil
+		}
+
+		var dst *string
+		switch keys[idx-1] {
+		case "com.apple.quicktime.make":
+			dst = &exif.Keys.Make
+		case "com.apple.quicktime.model":
+			dst = &exif.Keys.Model
+		case "com.apple.quicktime.creationdate":
+			dst = &exif.Keys.CreationDate
+		default:
+			return nil
+		}
+
+		return readBoxes(r, item.off, item.off+item.size, func(box bmffBox) error {
+			if box.typ != "data" {
+				return nil
+			}
+			b, err := readBox(r, box)
+			if err != nil {
+				return err
+			}
+			br := &beReader{b: b}
+			br.uint(8) // type and locale
+			if br.err != nil {
+				return br.err
+			}
+			*dst = keysValue(string(br.b))
+			return nil
+		})
+	})
+}
+
+// exiftool shows the ISO 8601 creation date in its own layout
+func keysValue(v string) string {
+	for _, layout := range []string{"2006-01-02T15:04:05-0700", "2006-01-02T15:04:05Z07:00"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.Format("2006:01:02 15:04:05-07:00")
+		}
+	}
+	return v
+}
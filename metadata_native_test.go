@@ -0,0 +1,410 @@
+package photosync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ***** fixtures *****
+
+// One IFD entry for buildTiff, value holds the raw value bytes
+type testTag struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func asciiTag(tag uint16, s string) testTag {
+	return testTag{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func shortTag(tag uint16, v uint16) testTag {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return testTag{tag, 3, 1, b}
+}
+
+func byteTag(tag uint16, v byte) testTag {
+	return testTag{tag, 1, 1, []byte{v}}
+}
+
+// A RATIONAL tag from numerator, denominator pairs
+func rationalTag(tag uint16, v ...uint32) testTag {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(b[i*4:], x)
+	}
+	return testTag{tag, 5, uint32(len(v) / 2), b}
+}
+
+// A little endian TIFF with IFD0 and, when given, the EXIF and GPS IFDs
+func buildTiff(ifd0, exifIfd, gpsIfd []testTag) []byte {
+	ifds := [][]testTag{append([]testTag{}, ifd0...)}
+	if exifIfd != nil {
+		ifds[0] = append(ifds[0], testTag{tagExifIfd, 4, 1, nil})
+		ifds = append(ifds, exifIfd)
+	}
+	if gpsIfd != nil {
+		ifds[0] = append(ifds[0], testTag{tagGpsIfd, 4, 1, nil})
+		ifds = append(ifds, gpsIfd)
+	}
+
+	offsets := make([]uint32, len(ifds))
+	next := uint32(8)
+	for i, ifd := range ifds {
+		offsets[i] = next
+		next += 2 + 12*uint32(len(ifd)) + 4
+	}
+	pointer := map[uint16]uint32{}
+	if exifIfd != nil {
+		pointer[tagExifIfd] = offsets[1]
+	}
+	if gpsIfd != nil {
+		pointer[tagGpsIfd] = offsets[len(offsets)-1]
+	}
+
+	le := binary.LittleEndian
+	var out, data bytes.Buffer
+	out.WriteString("II*\x00")
+	binary.Write(&out, le, uint32(8))
+	for _, ifd := range ifds {
+		binary.Write(&out, le, uint16(len(ifd)))
+		for _, t := range ifd {
+			binary.Write(&out, le, t.tag)
+			binary.Write(&out, le, t.typ)
+			binary.Write(&out, le, t.count)
+			value := make([]byte, 4)
+			if off, ok := pointer[t.tag]; ok && t.value == nil {
+				le.PutUint32(value, off)
+			} else if len(t.value) <= 4 {
+				copy(value, t.value)
+			} else {
+				le.PutUint32(value, next+uint32(data.Len()))
+				data.Write(t.value)
+			}
+			out.Write(value)
+		}
+		binary.Write(&out, le, uint32(0)) // no next IFD
+	}
+	out.Write(data.Bytes())
+	return out.Bytes()
+}
+
+// The TIFF most of the tests read, with values in all three IFDs
+func sampleTiff() []byte {
+	return buildTiff(
+		[]testTag{
+			asciiTag(tagMake, "Canon"),
+			asciiTag(tagModel, "Canon EOS 5D"),
+			shortTag(tagOrientation, 6),
+			asciiTag(tagModifyDate, "2016:05:02 08:00:00"),
+		},
+		[]testTag{
+			asciiTag(tagDateTimeOriginal, "2016:05:01 10:10:10"),
+			asciiTag(tagOffsetTimeOriginal, "+02:00"),
+			asciiTag(tagSubSecTimeOriginal, "123"),
+			shortTag(tagISO, 200),
+			rationalTag(tagExposureTime, 1, 125),
+			rationalTag(tagFNumber, 28, 10),
+			rationalTag(tagFocalLength, 50, 1),
+			asciiTag(tagLensModel, "EF50mm f/1.8"),
+		},
+		[]testTag{
+			asciiTag(tagGpsLatitudeRef, "S"),
+			rationalTag(tagGpsLatitude, 40, 1, 26, 1, 4630, 100),
+			asciiTag(tagGpsLongitudeRef, "W"),
+			rationalTag(tagGpsLongitude, 79, 1, 58, 1, 5600, 100),
+			byteTag(tagGpsAltitudeRef, 1),
+			rationalTag(tagGpsAltitude, 100, 1),
+		},
+	)
+}
+
+// A JPEG with the TIFF in an APP1 segment after an APP0 one
+func buildJpeg(tiff []byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	b.Write([]byte{0xFF, 0xE0, 0x00, 0x07})
+	b.WriteString("JFIF\x00")
+	b.Write([]byte{0xFF, 0xE1})
+	binary.Write(&b, binary.BigEndian, uint16(2+6+len(tiff)))
+	b.WriteString("Exif\x00\x00")
+	b.Write(tiff)
+	b.Write([]byte{0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9})
+	return b.Bytes()
+}
+
+// An ISO base media box
+func box(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], typ)
+	return append(b, body...)
+}
+
+func be16(v uint16) []byte { b := make([]byte, 2); binary.BigEndian.PutUint16(b, v); return b }
+func be32(v uint32) []byte { b := make([]byte, 4); binary.BigEndian.PutUint32(b, v); return b }
+
+// A version 0 iloc box with one extent for each item, offsets and lengths 4 bytes each
+func ilocV0(items ...[3]uint32) []byte {
+	b := [][]byte{{0, 0, 0, 0}, be16(0x4400), be16(uint16(len(items)))}
+	for _, it := range items {
+		b = append(b, be16(uint16(it[0])), be16(0), be16(1), be32(it[1]), be32(it[2]))
+	}
+	return box("iloc", b...)
+}
+
+// A HEIC with the TIFF as its Exif item in an mdat box
+func buildHeif(tiff []byte) []byte {
+	infe := box("infe", []byte{2, 0, 0, 0}, be16(1), be16(0), []byte("Exif\x00"))
+	iinf := box("iinf", []byte{0, 0, 0, 0}, be16(1), infe)
+	item := append(append(be32(6), "Exif\x00\x00"...), tiff...)
+
+	head := box("ftyp", []byte("heic"), be32(0), []byte("mif1heic"))
+	// the iloc is the same size whatever it points at, so size it first
+	meta := box("meta", []byte{0, 0, 0, 0}, iinf, ilocV0([3]uint32{1, 0, 0}))
+	off := uint32(len(head) + len(meta) + 8)
+	meta = box("meta", []byte{0, 0, 0, 0}, iinf, ilocV0([3]uint32{1, off, uint32(len(item))}))
+
+	return bytes.Join([][]byte{head, meta, box("mdat", item)}, nil)
+}
+
+// A QuickTime movie with a movie header, ©mak in udta and the Apple keys
+func buildQuickTime(created time.Time) []byte {
+	secs := uint32(created.Unix() + quickTimeEpochOffset)
+	mvhd := box("mvhd", []byte{0, 0, 0, 0}, be32(secs), be32(secs), make([]byte, 88))
+	mak := box("\xa9mak", be16(5), be16(0x55c4), []byte("Apple"))
+
+	key := func(name string) []byte {
+		return append(append(be32(uint32(8+len(name))), "mdta"...), name...)
+	}
+	keys := box("keys", be32(0), be32(2), key("com.apple.quicktime.model"), key("com.apple.quicktime.creationdate"))
+	data := func(v string) []byte { return box("data", be32(1), be32(0), []byte(v)) }
+	ilst := box("ilst",
+		box("\x00\x00\x00\x01", data("iPhone 7")),
+		box("\x00\x00\x00\x02", data("2016-05-01T10:10:10+0200")),
+	)
+	meta := box("meta", box("hdlr", make([]byte, 25)), keys, ilst)
+
+	return bytes.Join([][]byte{
+		box("ftyp", []byte("qt  "), be32(0), []byte("qt  ")),
+		box("moov", mvhd, box("udta", mak), meta),
+		box("mdat"),
+	}, nil)
+}
+
+func readBytes(b []byte) (*ExifToolOutput, error) {
+	exif := &ExifToolOutput{}
+	err := readMetadata(bytes.NewReader(b), int64(len(b)), exif)
+	return exif, err
+}
+
+// ***** tests *****
+
+func TestReadMetadata(t *testing.T) {
+	tiff := sampleTiff()
+	created := time.Date(2016, 5, 1, 10, 10, 10, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		check func(e *ExifToolOutput) bool
+	}{
+		{"tiff", tiff, func(e *ExifToolOutput) bool {
+			return e.Ifd.Make == "Canon" && e.Ifd.Model == "Canon EOS 5D" && e.Ifd.Orientation == "Rotate 90 CW" &&
+				e.Ifd.ModifyDate == "2016:05:02 08:00:00"
+		}},
+		{"tiff exif", tiff, func(e *ExifToolOutput) bool {
+			x := e.ExifIFD
+			return x.DateTimeOriginal == "2016:05:01 10:10:10" && x.OffsetTimeOriginal == "+02:00" &&
+				x.SubSecTimeOriginal == "123" && x.ISO == "200" && x.ExposureTime == "1/125" &&
+				x.FNumber == "2.8" && x.FocalLength == "50.0 mm" && x.LensModel == "EF50mm f/1.8"
+		}},
+		{"tiff gps", tiff, func(e *ExifToolOutput) bool {
+			g := e.GPS
+			return g.GPSLatitude == `40 deg 26' 46.30"` && g.GPSLatitudeRef == "South" &&
+				g.GPSLongitude == `79 deg 58' 56.00"` && g.GPSLongitudeRef == "West" &&
+				g.GPSAltitude == "100 m" && g.GPSAltitudeRef == "Below Sea Level"
+		}},
+		{"jpeg", buildJpeg(tiff), func(e *ExifToolOutput) bool {
+			return e.Ifd.Make == "Canon" && e.ExifIFD.DateTimeOriginal == "2016:05:01 10:10:10" && e.GPS.GPSLatitudeRef == "South"
+		}},
+		{"jpeg without exif", []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9}, func(e *ExifToolOutput) bool {
+			return e.Ifd.Make == ""
+		}},
+		{"heic", buildHeif(tiff), func(e *ExifToolOutput) bool {
+			return e.Ifd.Make == "Canon" && e.ExifIFD.DateTimeOriginal == "2016:05:01 10:10:10"
+		}},
+		{"quicktime", buildQuickTime(created), func(e *ExifToolOutput) bool {
+			return e.QuickTime.CreateDate == "2016:05:01 10:10:10" && e.QuickTime.ModifyDate == "2016:05:01 10:10:10" &&
+				e.UserData.Make == "Apple" && e.Keys.Model == "iPhone 7" && e.Keys.CreationDate == "2016:05:01 10:10:10+02:00"
+		}},
+		{"unknown", []byte("just some text"), func(e *ExifToolOutput) bool {
+			return *e == ExifToolOutput{}
+		}},
+		{"empty", nil, func(e *ExifToolOutput) bool {
+			return *e == ExifToolOutput{}
+		}},
+	}
+
+	for _, test := range tests {
+		exif, err := readBytes(test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.check(exif) {
+			t.Errorf("%s: read %+v", test.name, *exif)
+		}
+	}
+}
+
+func TestReadIfd(t *testing.T) {
+	le := binary.LittleEndian
+	tiff := func(b []byte) *tiffReader {
+		return &tiffReader{r: io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), order: le}
+	}
+
+	// IFD0 with one entry whose value is the 8 bytes at off
+	withValue := func(count uint32, off uint32) []byte {
+		b := buildTiff([]testTag{rationalTag(tagModel, 1, 2)}, nil, nil)
+		le.PutUint32(b[8+2+4:], count)
+		le.PutUint32(b[8+2+8:], off)
+		return b[:len(b)-8] // without the value
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		off  uint32
+		err  string
+	}{
+		{"past the end", buildTiff(nil, nil, nil), 1000, "out of range"},
+		{"entry count past the end", []byte("II*\x00\x08\x00\x00\x00\xff\xff"), 8, "truncated"},
+		{"value count past the end", withValue(0x7fffffff, 8), 8, "too big"},
+		{"value offset past the end", withValue(1, 1000), 8, "outside the EXIF data"},
+		{"value offset overflowing", withValue(1, 0xffffffff), 8, "outside the EXIF data"},
+	}
+	for _, test := range tests {
+		_, err := tiff(test.data).readIfd(test.off)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		}
+	}
+
+	// the EXIF and GPS IFDs pointing back at IFD0 are read once and don't loop
+	loop := buildTiff([]testTag{asciiTag(tagMake, "Loop"), {tagExifIfd, 4, 1, []byte{8, 0, 0, 0}}, {tagGpsIfd, 4, 1, []byte{8, 0, 0, 0}}}, nil, nil)
+	exif, err := readBytes(loop)
+	if err != nil || exif.Ifd.Make != "Loop" {
+		t.Fatalf("loop %+v %v", exif.Ifd, err)
+	}
+
+	// unknown types are skipped
+	skip := buildTiff([]testTag{{tagModel, 99, 1, []byte{1}}, asciiTag(tagMake, "Canon")}, nil, nil)
+	if entries, err := tiff(skip).readIfd(8); err != nil || len(entries) != 1 || entries[tagMake].String() != "Canon" {
+		t.Fatalf("unknown type %v %v", entries, err)
+	}
+}
+
+func TestHeifItemExtent(t *testing.T) {
+	payload := func(b []byte) []byte { return b[8:] } // the iloc box without its header
+
+	v1 := [][]byte{{1, 0, 0, 0}, be16(0x4400), be16(1), be16(7), be16(1), be16(0), be16(1), be32(100), be32(20)}
+	tests := []struct {
+		name        string
+		iloc        []byte
+		id          uint64
+		off, length int64
+		err         bool
+	}{
+		{"first item", payload(ilocV0([3]uint32{1, 100, 20}, [3]uint32{2, 200, 30})), 1, 100, 20, false},
+		{"second item", payload(ilocV0([3]uint32{1, 100, 20}, [3]uint32{2, 200, 30})), 2, 200, 30, false},
+		{"missing item", payload(ilocV0([3]uint32{1, 100, 20})), 5, 0, 0, false},
+		{"built from other items", bytes.Join(v1, nil), 7, 0, 0, true},
+		{"truncated", payload(ilocV0([3]uint32{1, 100, 20}))[:12], 1, 0, 0, true},
+		{"item count past the end", []byte{0, 0, 0, 0, 0x44, 0x00, 0xff, 0xff}, 1, 0, 0, true},
+		{"empty", nil, 1, 0, 0, true},
+	}
+	for _, test := range tests {
+		off, length, err := heifItemExtent(test.iloc, test.id)
+		if (err != nil) != test.err || off != test.off || length != test.length {
+			t.Errorf("%s: got %d %d %v", test.name, off, length, err)
+		}
+	}
+}
+
+func TestReadKeys(t *testing.T) {
+	data := box("data", be32(1), be32(0), []byte("Apple"))
+	tests := []struct {
+		name string
+		meta []byte
+		make string
+		err  bool
+	}{
+		{"quicktime meta", box("meta", box("keys", be32(0), be32(1), be32(32), []byte("mdtacom.apple.quicktime.make")), box("ilst", box("\x00\x00\x00\x01", data))), "Apple", false},
+		{"iso meta", box("meta", be32(0), box("keys", be32(0), be32(1), be32(32), []byte("mdtacom.apple.quicktime.make")), box("ilst", box("\x00\x00\x00\x01", data))), "Apple", false},
+		{"index past the keys", box("meta", box("keys", be32(0), be32(1), be32(32), []byte("mdtacom.apple.quicktime.make")), box("ilst", box("\x00\x00\x00\x09", data))), "", false},
+		{"key size too small", box("meta", box("keys", be32(0), be32(1), be32(4), []byte("mdta"))), "", true},
+		{"key count past the end", box("meta", box("keys", be32(0), be32(1000))), "", true},
+	}
+	for _, test := range tests {
+		exif := &ExifToolOutput{}
+		r := bytes.NewReader(test.meta)
+		err := readKeys(r, bmffBox{"meta", 8, int64(len(test.meta) - 8)}, exif)
+		if (err != nil) != test.err || exif.Keys.Make != test.make {
+			t.Errorf("%s: got %q %v", test.name, exif.Keys.Make, err)
+		}
+	}
+}
+
+// Cut short or scribbled on files give an error or nothing, never a panic or a hang
+func TestReadMetadataCorrupt(t *testing.T) {
+	tiff := sampleTiff()
+	files := map[string][]byte{
+		"tiff":      tiff,
+		"jpeg":      buildJpeg(tiff),
+		"heic":      buildHeif(tiff),
+		"quicktime": buildQuickTime(time.Date(2016, 5, 1, 10, 10, 10, 0, time.UTC)),
+	}
+
+	for name, b := range files {
+		for n := 0; n < len(b); n++ {
+			done := make(chan bool)
+			go func() {
+				defer close(done)
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("%s cut to %d bytes: %v", name, n, r)
+					}
+				}()
+				readBytes(b[:n])
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s cut to %d bytes never returned", name, n)
+			}
+		}
+
+		for i := range b {
+			for _, v := range []byte{0x00, 0x7f, 0xff} {
+				bad := append([]byte{}, b...)
+				bad[i] = v
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Errorf("%s with byte %d set to %#x: %v", name, i, v, r)
+						}
+					}()
+					readBytes(bad)
+				}()
+			}
+		}
+	}
+}
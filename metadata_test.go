@@ -0,0 +1,124 @@
+package photosync
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestExifTime(t *testing.T) {
+	plus2 := time.FixedZone("+02:00", 2*3600)
+	minus530 := time.FixedZone("-05:30", -(5*3600 + 30*60))
+
+	tests := []struct {
+		date   string
+		subsec FlexString
+		offset string
+		want   time.Time
+		ok     bool
+	}{
+		{"2016:05:01 10:10:10", "", "", time.Date(2016, 5, 1, 10, 10, 10, 0, time.Local), true},
+		{"2016:05:01 10:10:10", "", "+02:00", time.Date(2016, 5, 1, 10, 10, 10, 0, plus2), true},
+		{"2016:05:01 10:10:10", "", "-05:30", time.Date(2016, 5, 1, 10, 10, 10, 0, minus530), true},
+		{"2016:05:01 10:10:10", "", "+00:00", time.Date(2016, 5, 1, 10, 10, 10, 0, time.UTC), true},
+		{"2016:05:01 10:10:10", "5", "", time.Date(2016, 5, 1, 10, 10, 10, 500000000, time.Local), true},
+		{"2016:05:01 10:10:10", "123", "+02:00", time.Date(2016, 5, 1, 10, 10, 10, 123000000, plus2), true},
+		{"2016:05:01 10:10:10", "045", "", time.Date(2016, 5, 1, 10, 10, 10, 45000000, time.Local), true},
+		{"2016:05:01 10:10:10", " 12 ", "", time.Date(2016, 5, 1, 10, 10, 10, 120000000, time.Local), true},
+		{"2016:05:01 10:10:10", "abc", "", time.Date(2016, 5, 1, 10, 10, 10, 0, time.Local), true},  // bad sub seconds are left off
+		{"2016:05:01 10:10:10", "", "CEST", time.Date(2016, 5, 1, 10, 10, 10, 0, time.Local), true}, // bad offsets too
+		{"2016:05:01 10:10:10+02:00", "", "+02:00", time.Date(2016, 5, 1, 10, 10, 10, 0, plus2), true},
+		{"0000:00:00 00:00:00", "", "", time.Time{}, false},
+		{"2016:05:01", "", "", time.Time{}, false},
+		{"2016-05-01 10:10:10", "", "", time.Time{}, false},
+		{"", "", "", time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, ok := exifTime(test.date, test.subsec, test.offset)
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("exifTime(%q, %q, %q) = %v %v, want %v", test.date, test.subsec, test.offset, got, ok, test.want)
+		}
+
+		// the offset is kept, not just the instant
+		_, gotOffset := got.Zone()
+		_, wantOffset := test.want.Zone()
+		if ok && gotOffset != wantOffset {
+			t.Errorf("exifTime(%q, %q, %q) offset %d, want %d", test.date, test.subsec, test.offset, gotOffset, wantOffset)
+		}
+	}
+}
+
+func TestParseExifCoord(t *testing.T) {
+	tests := []struct {
+		value, ref string
+		want       float64
+		ok         bool
+	}{
+		{`37 deg 46' 30.00"`, "North", 37.775, true},
+		{`37 deg 46' 30.00"`, "South", -37.775, true},
+		{`122 deg 25' 9.00"`, "East", 122.419167, true},
+		{`122 deg 25' 9.00"`, "West", -122.419167, true},
+		{`33 deg 52' 4.20" S`, "", -33.867833, true}, // the ref can come with the value
+		{`33 deg 52' 4.20" S`, "North", -33.867833, true},
+		{`0 deg 0' 0.00"`, "S", 0, true},
+		{"37.775", "N", 37.775, true}, // exiftool -n
+		{"37.775", "S", -37.775, true},
+		{"122.419167", "W", -122.419167, true},
+		{" 12.5 ", "", 12.5, true},
+		{"", "N", 0, false},
+		{"north", "", 0, false},
+		{`37 deg 46'`, "N", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseExifCoord(test.value, test.ref)
+		if ok != test.ok || math.Abs(got-test.want) > 1e-6 {
+			t.Errorf("parseExifCoord(%q, %q) = %v %v, want %v", test.value, test.ref, got, ok, test.want)
+		}
+	}
+}
+
+func TestDateTaken(t *testing.T) {
+	plus2 := time.FixedZone("+02:00", 2*3600)
+
+	original := func(e *ExifToolOutput) {
+		e.ExifIFD.DateTimeOriginal = "2016:05:01 10:10:10"
+		e.ExifIFD.SubSecTimeOriginal = "25"
+		e.ExifIFD.OffsetTimeOriginal = "+02:00"
+	}
+	created := func(e *ExifToolOutput) {
+		e.ExifIFD.CreateDate = "2016:05:02 10:10:10"
+		e.ExifIFD.OffsetTimeDigitized = "+02:00"
+	}
+	keys := func(e *ExifToolOutput) { e.Keys.CreationDate = "2016:05:03 10:10:10+02:00" }
+	movie := func(e *ExifToolOutput) { e.QuickTime.CreateDate = "2016:05:04 08:10:10" }
+	modified := func(e *ExifToolOutput) {
+		e.Ifd.ModifyDate = "2016:05:05 10:10:10"
+		e.ExifIFD.OffsetTime = "+02:00"
+	}
+
+	tests := []struct {
+		name string
+		set  []func(e *ExifToolOutput)
+		want time.Time
+		ok   bool
+	}{
+		{"original first", []func(*ExifToolOutput){original, created, keys, movie, modified}, time.Date(2016, 5, 1, 10, 10, 10, 250000000, plus2), true},
+		{"then the create date", []func(*ExifToolOutput){created, keys, movie, modified}, time.Date(2016, 5, 2, 10, 10, 10, 0, plus2), true},
+		{"then the phone's creation date", []func(*ExifToolOutput){keys, movie, modified}, time.Date(2016, 5, 3, 10, 10, 10, 0, plus2), true},
+		{"then the movie header in UTC", []func(*ExifToolOutput){movie, modified}, time.Date(2016, 5, 4, 8, 10, 10, 0, time.UTC), true},
+		{"then the modify date", []func(*ExifToolOutput){modified}, time.Date(2016, 5, 5, 10, 10, 10, 0, plus2), true},
+		{"an unset movie header is skipped", []func(*ExifToolOutput){modified, func(e *ExifToolOutput) { e.QuickTime.CreateDate = "0000:00:00 00:00:00" }}, time.Date(2016, 5, 5, 10, 10, 10, 0, plus2), true},
+		{"an unset original is skipped", []func(*ExifToolOutput){created, func(e *ExifToolOutput) { e.ExifIFD.DateTimeOriginal = "0000:00:00 00:00:00" }}, time.Date(2016, 5, 2, 10, 10, 10, 0, plus2), true},
+		{"nothing", nil, time.Time{}, false},
+	}
+	for _, test := range tests {
+		exif := &ExifToolOutput{}
+		for _, set := range test.set {
+			set(exif)
+		}
+		got, ok := exif.DateTaken()
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("%s: got %v %v, want %v", test.name, got, ok, test.want)
+		}
+	}
+}
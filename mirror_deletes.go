@@ -0,0 +1,220 @@
+package photosync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// names for MirrorDeletesConfig.Action
+const (
+	MirrorPrivate = "private" // make the photo private, the default
+	MirrorDelete  = "delete"  // delete the photo, needs delete perms
+)
+
+const defaultMirrorGrace = 24 * time.Hour
+const defaultMirrorMaxPerGrace = 10
+const defaultMirrorMaxMissing = 0.5
+
+// name of the mirror deletes allowance in the state db
+const mirrorAllowance = "mirror_deletes"
+
+// What to do on Flickr when a file synced from a watched directory is deleted.
+// A file has to stay gone for the grace period first, only so many photos are
+// changed each grace period, and nothing is done about a directory that is
+// empty or missing too many of its files, so a drive that didn't mount can't
+// empty the account.
+type MirrorDeletesConfig struct {
+	Enabled     bool     `json:"enabled"`
+	Action      string   `json:"action"`        // private or delete
+	Grace       Duration `json:"grace"`         // how long a file must be gone for, 24h by default
+	MaxPerGrace int      `json:"max_per_grace"` // most photos changed each grace period, 10 by default
+	MaxMissing  float64  `json:"max_missing"`   // most of a directory's synced files that can be gone, 0.5 by default
+}
+
+// Check the settings make sense, perms is what the access token was granted
+func (this *MirrorDeletesConfig) Validate(perms string) error {
+	switch this.Action {
+	case "", MirrorPrivate:
+	case MirrorDelete:
+		if this.Enabled && perms != "delete" {
+			return fmt.Errorf("mirror_deletes: deleting photos needs perms delete, set it and run `syncphotos auth` again")
+		}
+	default:
+		return fmt.Errorf("mirror_deletes: action must be %s or %s", MirrorPrivate, MirrorDelete)
+	}
+	if this.Grace < 0 || this.MaxPerGrace < 0 {
+		return fmt.Errorf("mirror_deletes: grace and max_per_grace can't be negative")
+	}
+	if this.MaxMissing < 0 || this.MaxMissing > 1 {
+		return fmt.Errorf("mirror_deletes: max_missing must be between 0 and 1")
+	}
+	return nil
+}
+
+func (this *MirrorDeletesConfig) GetAction() string {
+	if len(this.Action) == 0 {
+		return MirrorPrivate
+	}
+	return this.Action
+}
+
+func (this *MirrorDeletesConfig) GetGrace() time.Duration {
+	if this.Grace == 0 {
+		return defaultMirrorGrace
+	}
+	return this.Grace.Duration()
+}
+
+func (this *MirrorDeletesConfig) GetMaxPerGrace() int {
+	if this.MaxPerGrace == 0 {
+		return defaultMirrorMaxPerGrace
+	}
+	return this.MaxPerGrace
+}
+
+func (this *MirrorDeletesConfig) GetMaxMissing() float64 {
+	if this.MaxMissing == 0 {
+		return defaultMirrorMaxMissing
+	}
+	return this.MaxMissing
+}
+
+// Take one of the photos mirror deletes may change this grace period, false
+// when they're used up. The count is kept in the state db so it holds across
+// runs and the daemon planning over and over.
+func (this *syncer) useMirrorAllowance(config *PhotosyncConfig) bool {
+	if this.state == nil {
+		return true
+	}
+	md := &config.MirrorDeletes
+	ok, err := this.state.UseAllowance(mirrorAllowance, md.GetGrace(), md.GetMaxPerGrace())
+	if err != nil {
+		log.Println("error reading sync state", err)
+		return false
+	}
+	return ok
+}
+
+// The config of the watched directory a path is in, nil if it isn't in one
+func (this *PhotosyncConfig) watchDirFor(path string) *WatchDirConfig {
+	var found *WatchDirConfig
+	for i := range this.WatchDir {
+		dir := &this.WatchDir[i]
+		if within(dir.Dir, path) && (found == nil || len(dir.Dir) > len(found.Dir)) {
+			found = dir
+		}
+	}
+	return found
+}
+
+// Work out what to do on Flickr about synced files that were deleted here.
+// planned is the rest of the plan, a file linked in it to a photo means the
+// photo has moved rather than gone. Noting when files were first seen to be
+// gone, which is what the grace period counts from, is left to actions too so
+// planning doesn't change the state db.
+func (this *syncer) planDeletes(planned []Action) ([]Action, error) {
+	md := &this.config.MirrorDeletes
+	if !md.Enabled || this.state == nil {
+		return nil, nil
+	}
+
+	// photos that still have a file here, maybe under a different name
+	kept := make(map[string]bool)
+	for _, a := range planned {
+		if a.Type == ActionLink {
+			kept[a.PhotoId] = true
+		}
+	}
+
+	var gone, back []*FileState
+	synced := make(map[*WatchDirConfig]int)
+	missing := make(map[*WatchDirConfig]int)
+	err := this.state.Files(func(rec *FileState) error {
+		dirCfg := this.config.watchDirFor(rec.Path)
+		if len(rec.PhotoId) == 0 || dirCfg == nil {
+			return nil // never synced or not watched any more
+		}
+		synced[dirCfg]++
+
+		_, err := os.Stat(rec.Path)
+		if err == nil {
+			kept[rec.PhotoId] = true
+			if !rec.Missing.IsZero() {
+				back = append(back, rec)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return nil
+		}
+		gone = append(gone, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// a watched dir that is gone, empty or missing lots of files is more
+	// likely unmounted than emptied
+	for _, rec := range gone {
+		if !kept[rec.PhotoId] {
+			missing[this.config.watchDirFor(rec.Path)]++
+		}
+	}
+	skip := make(map[*WatchDirConfig]bool)
+	for dirCfg, n := range missing {
+		infos, err := ioutil.ReadDir(dirCfg.Dir)
+		switch {
+		case err != nil || len(infos) == 0:
+			log.Printf("not mirroring deletes from %s, it's empty or can't be read, is it mounted?", dirCfg.Dir)
+			skip[dirCfg] = true
+		case float64(n) > md.GetMaxMissing()*float64(synced[dirCfg]):
+			log.Printf("not mirroring deletes from %s, %d of its %d synced files are gone, is it mounted?", dirCfg.Dir, n, synced[dirCfg])
+			skip[dirCfg] = true
+		}
+	}
+
+	var actions []Action
+	for _, rec := range back {
+		actions = append(actions, Action{Type: ActionMarkBack, Path: rec.Path})
+	}
+
+	now := time.Now()
+	var due []*FileState
+	for _, rec := range gone {
+		switch {
+		case skip[this.config.watchDirFor(rec.Path)]:
+		case kept[rec.PhotoId]:
+			// moved, the record under the new name carries on
+			actions = append(actions, Action{Type: ActionForget, Path: rec.Path})
+		case rec.Missing.IsZero():
+			actions = append(actions, Action{Type: ActionMarkGone, Path: rec.Path})
+		case now.Sub(rec.Missing) >= md.GetGrace():
+			due = append(due, rec)
+		}
+	}
+
+	// the longest gone go first
+	sort.Slice(due, func(i, j int) bool { return due[i].Missing.Before(due[j].Missing) })
+	left, err := this.state.Allowance(mirrorAllowance, md.GetGrace(), md.GetMaxPerGrace())
+	if err != nil {
+		return nil, err
+	}
+	if len(due) > left {
+		log.Printf("%d deleted files to mirror to Flickr, only %d more allowed in this %s", len(due), left, md.GetGrace())
+		due = due[:left]
+	}
+
+	t := ActionMakePrivate
+	if md.GetAction() == MirrorDelete {
+		t = ActionDeletePhoto
+	}
+	for _, rec := range due {
+		actions = append(actions, Action{Type: t, Path: rec.Path, PhotoId: rec.PhotoId, Title: rec.Title, Media: rec.Media})
+	}
+	return actions, nil
+}
@@ -0,0 +1,198 @@
+package photosync_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Reisender/photosync"
+	"github.com/Reisender/photosync/photosynctest"
+)
+
+// A watched dir of four synced files with mirror deletes on
+func mirrorSetup(t *testing.T, action string, grace time.Duration, maxPerGrace int) (*photosynctest.Server, *photosync.FlickrAPI, *photosync.PhotosyncConfig, *photosync.SyncState, string) {
+	srv := photosynctest.NewServer()
+	t.Cleanup(srv.Close)
+	dir := tempDir(t)
+	watch := filepath.Join(dir, "watch")
+	writeFiles(t, watch, map[string]string{"a.jpg": "aaa", "b.jpg": "bbb", "c.jpg": "ccc", "d.jpg": "ddd"})
+
+	cfg := testConfig(srv)
+	cfg.Perms = "delete"
+	cfg.WatchDir = []photosync.WatchDirConfig{{Dir: watch}}
+	cfg.WatchDir[0].CreateTemplates()
+	cfg.MirrorDeletes = photosync.MirrorDeletesConfig{Enabled: true, Action: action, Grace: photosync.Duration(grace), MaxPerGrace: maxPerGrace}
+	if err := cfg.MirrorDeletes.Validate(cfg.Perms); err != nil {
+		t.Fatal(err)
+	}
+	api := photosync.NewFlickrAPI(&cfg)
+	state := openState(t, dir)
+
+	var out lockedBuffer
+	if got := runSync(t, api, &cfg, state, &out); got.uploaded != 4 {
+		t.Fatalf("first sync %+v\n%s", got, out.String())
+	}
+	return srv, api, &cfg, state, watch
+}
+
+// How many photos everyone can still see
+func visible(srv *photosynctest.Server) int {
+	n := 0
+	for _, p := range srv.Photos() {
+		if !p.Private {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMirrorDeletes(t *testing.T) {
+	for _, action := range []string{photosync.MirrorPrivate, photosync.MirrorDelete} {
+		t.Run(action, func(t *testing.T) {
+			grace := 300 * time.Millisecond
+			srv, api, cfg, state, watch := mirrorSetup(t, action, grace, 1)
+			var out lockedBuffer
+
+			os.Remove(filepath.Join(watch, "a.jpg"))
+			os.Remove(filepath.Join(watch, "c.jpg"))
+			os.Rename(filepath.Join(watch, "b.jpg"), filepath.Join(watch, "b2.jpg"))
+
+			// nothing happens during the grace period, and moving isn't deleting
+			runSync(t, api, cfg, state, &out)
+			if n := visible(srv); n != 4 {
+				t.Fatal("visible in the grace period", n)
+			}
+
+			// only one a grace period, however often it runs
+			time.Sleep(grace)
+			runSync(t, api, cfg, state, &out)
+			runSync(t, api, cfg, state, &out)
+			if n := visible(srv); n != 3 {
+				t.Fatal("visible once the grace period was up", n)
+			}
+			time.Sleep(grace)
+			runSync(t, api, cfg, state, &out)
+			if n := visible(srv); n != 2 {
+				t.Fatal("visible in the next grace period", n)
+			}
+			if action == photosync.MirrorDelete && len(srv.Photos()) != 2 {
+				t.Fatal("photos left", len(srv.Photos()))
+			}
+			photoTitled(t, srv, "b") // the moved file's photo is still there
+		})
+	}
+
+	cfg := photosync.MirrorDeletesConfig{Enabled: true, Action: photosync.MirrorDelete}
+	if err := cfg.Validate("write"); err == nil {
+		t.Fatal("deleting allowed without delete perms")
+	}
+	cfg = photosync.MirrorDeletesConfig{Enabled: true, MaxMissing: 2}
+	if err := cfg.Validate("write"); err == nil {
+		t.Fatal("max_missing over 1 allowed")
+	}
+}
+
+// Planning leaves the state db alone, noting deleted files is left to applying
+func TestMirrorDeletesPlan(t *testing.T) {
+	srv, api, cfg, state, watch := mirrorSetup(t, photosync.MirrorPrivate, time.Hour, 10)
+	os.Remove(filepath.Join(watch, "a.jpg"))
+	os.Rename(filepath.Join(watch, "b.jpg"), filepath.Join(watch, "b2.jpg"))
+
+	user, err := api.GetLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	photos, videos, err := photosync.LoadLibrary(api, state, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albums := &photosync.AlbumsMap{}
+	var out lockedBuffer
+	opt := &photosync.Options{Out: &out}
+
+	plan, err := photosync.PlanSync(cfg, state, photos, videos, albums, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Count(photosync.ActionMarkGone) != 1 || plan.Count(photosync.ActionForget) != 1 {
+		t.Fatalf("plan\n%s", planString(plan))
+	}
+	rec, err := state.GetFile(filepath.Join(watch, "a.jpg"))
+	if err != nil || rec == nil || !rec.Missing.IsZero() {
+		t.Fatalf("deleted file's record after planning %+v %v", rec, err)
+	}
+	if rec, err := state.GetFile(filepath.Join(watch, "b.jpg")); err != nil || rec == nil {
+		t.Fatalf("moved file's record after planning %+v %v", rec, err)
+	}
+
+	if _, _, _, er, err := photosync.ApplyPlan(api, cfg, state, photos, videos, albums, plan, opt); err != nil || er != 0 {
+		t.Fatalf("apply %d failed %v\n%s", er, err, out.String())
+	}
+	rec, err = state.GetFile(filepath.Join(watch, "a.jpg"))
+	if err != nil || rec == nil || rec.Missing.IsZero() {
+		t.Fatalf("deleted file's record after applying %+v %v", rec, err)
+	}
+	if rec, err := state.GetFile(filepath.Join(watch, "b.jpg")); err != nil || rec != nil {
+		t.Fatalf("moved file's record after applying %+v %v", rec, err)
+	}
+
+	// back again before the grace period is up
+	writeFiles(t, watch, map[string]string{"a.jpg": "aaa"})
+	plan, err = photosync.PlanSync(cfg, state, photos, videos, albums, opt)
+	if err != nil || plan.Count(photosync.ActionMarkBack) != 1 {
+		t.Fatalf("plan %v\n%s", err, planString(plan))
+	}
+	if _, _, _, er, err := photosync.ApplyPlan(api, cfg, state, photos, videos, albums, plan, opt); err != nil || er != 0 {
+		t.Fatalf("apply %d failed %v\n%s", er, err, out.String())
+	}
+	rec, err = state.GetFile(filepath.Join(watch, "a.jpg"))
+	if err != nil || rec == nil || !rec.Missing.IsZero() {
+		t.Fatalf("returned file's record %+v %v", rec, err)
+	}
+	if n := visible(srv); n != 4 {
+		t.Fatal("visible", n)
+	}
+}
+
+// The plan one action a line
+func planString(plan *photosync.Plan) string {
+	if plan == nil {
+		return ""
+	}
+	var b strings.Builder
+	plan.Print(&b)
+	return b.String()
+}
+
+// A watched dir that looks unmounted is left alone
+func TestMirrorDeletesUnmounted(t *testing.T) {
+	grace := 100 * time.Millisecond
+	for name, remove := range map[string]func(watch string){
+		"gone": func(watch string) { os.RemoveAll(watch) },
+		"empty": func(watch string) {
+			for _, n := range []string{"a", "b", "c", "d"} {
+				os.Remove(filepath.Join(watch, n+".jpg"))
+			}
+		},
+		"mostly missing": func(watch string) {
+			for _, n := range []string{"a", "b", "c"} {
+				os.Remove(filepath.Join(watch, n+".jpg"))
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv, api, cfg, state, watch := mirrorSetup(t, photosync.MirrorPrivate, grace, 10)
+			var out lockedBuffer
+
+			remove(watch)
+			runSync(t, api, cfg, state, &out)
+			time.Sleep(grace)
+			runSync(t, api, cfg, state, &out)
+			if n := visible(srv); n != 4 {
+				t.Fatal("visible", n)
+			}
+		})
+	}
+}
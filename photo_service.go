@@ -0,0 +1,34 @@
+package photosync
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// PhotoService is the set of operations Sync needs from a photo hosting backend.
+// FlickrAPI is the default implementation.
+type PhotoService interface {
+	GetLoginContext(ctx context.Context) (*FlickrUser, error)
+	GetPhotosContext(ctx context.Context, user *FlickrUser) (*PhotosMap, error)
+	GetVideosContext(ctx context.Context, user *FlickrUser) (*PhotosMap, error)
+	GetPhotosSinceContext(ctx context.Context, user *FlickrUser, since time.Time) (*PhotosMap, error)
+	GetVideosSinceContext(ctx context.Context, user *FlickrUser, since time.Time) (*PhotosMap, error)
+	GetLibraryContext(ctx context.Context, user *FlickrUser) (*PhotosMap, error)
+	GetLibrarySinceContext(ctx context.Context, user *FlickrUser, since time.Time) (*PhotosMap, error)
+	GetAlbumsContext(ctx context.Context, user *FlickrUser) (*AlbumsMap, error)
+	UploadContext(ctx context.Context, path string, file os.FileInfo, progress ProgressFunc) (*FlickrUploadResponse, error)
+	AddTagsContext(ctx context.Context, photoId, tags string) error
+	AddToAlbumContext(ctx context.Context, photoId string, album *Album) error
+	SetAlbumOrderContext(ctx context.Context, photoSetId string, photoIds []string) error
+	SetDateContext(ctx context.Context, photoId, date string) error
+	SetLocationContext(ctx context.Context, photoId string, lat, lon float64, accuracy int) error
+	SetPermsContext(ctx context.Context, photoId string, public, friend, family bool) error
+	DeleteContext(ctx context.Context, photoId string) error
+	GetInfoContext(ctx context.Context, p *Photo) (*PhotoInfo, error)
+	DownloadContext(ctx context.Context, p *Photo, path string, progress ProgressFunc) error
+	OriginalSizeContext(ctx context.Context, p *Photo) (int64, error)
+}
+
+// make sure FlickrAPI keeps satisfying the interface
+var _ PhotoService = (*FlickrAPI)(nil)
@@ -1,16 +1,19 @@
 package photosync
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/garyburd/go-oauth/oauth"
-	"github.com/go-fsnotify/fsnotify"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,6 +29,11 @@ type Options struct {
 	Daemon      bool
 	RetroTags   bool
 	RetroAlbums bool
+	StatePath   string    // sync state db, no state is kept when empty
+	Jobs        int       // number of upload workers, overrides the config when set
+	Out         io.Writer // progress messages, os.Stdout when nil
+
+	Reload <-chan struct{} // the daemon reloads the config from ConfigPath on each value
 }
 
 type PhotosMap map[string]Photo
@@ -33,13 +41,29 @@ type PhotosMap map[string]Photo
 type OauthConfig struct {
 	Consumer oauth.Credentials
 	Access   oauth.Credentials
+	Perms    string `json:"perms"` // what `syncphotos auth` asks for: read, write or delete
 }
 
 type PhotosyncConfig struct {
 	OauthConfig
+	ApiBase             string               `json:"api_base"` // defaults to DefaultApiBase
+	Jobs                int                  `json:"jobs"`     // number of upload workers
+	Retry               RetryConfig          `json:"retry"`
+	RateLimit           RateLimitConfig      `json:"rate_limit"`
+	HttpTimeout         Duration             `json:"http_timeout"`   // per api call, uploads aren't limited
+	ShutdownGrace       Duration             `json:"shutdown_grace"` // how long uploads in progress get to finish when stopped
+	Settle              Duration             `json:"settle"`         // how long new files must be unchanged before the daemon syncs them
+	Rescan              Duration             `json:"rescan"`         // how often the daemon walks the directories again, off when unset
+	RemoteRefresh       Duration             `json:"remote_refresh"` // how often the daemon lists Flickr again, off when unset
+	Metadata            string               `json:"metadata"`       // native (default) or exiftool
+	RawConverter        []string             `json:"raw_converter"`  // command making a JPEG from {in} to {out}
 	Filenames           []FilenameConfig     `json:"filenames"`
 	WatchDir            []WatchDirConfig     `json:"directories"`
 	FilenameTimeFormats []FilenameTimeFormat `json:"filename_time_formats"`
+	TwoWay              TwoWayConfig         `json:"two_way"`        // bring changes made on Flickr back here
+	MirrorDeletes       MirrorDeletesConfig  `json:"mirror_deletes"` // take files deleted here off Flickr
+
+	metadataReader MetadataReader // from Metadata when the config is loaded
 }
 
 type FilenameTimeFormat struct {
@@ -48,6 +72,7 @@ type FilenameTimeFormat struct {
 	Postfix []string
 }
 
+// The metadata for a file, laid out like `exiftool -g1 -json` prints it
 type ExifToolOutput struct {
 	SourceFile string
 	ExifTool   struct {
@@ -59,6 +84,42 @@ type ExifToolOutput struct {
 		Model       string
 		ModifyDate  string
 	} `json:"IFD0"`
+	ExifIFD struct {
+		DateTimeOriginal    string
+		CreateDate          string
+		SubSecTime          FlexString
+		SubSecTimeOriginal  FlexString
+		SubSecTimeDigitized FlexString
+		OffsetTime          string
+		OffsetTimeOriginal  string
+		OffsetTimeDigitized string
+		LensModel           FlexString
+		ISO                 FlexString
+		ExposureTime        FlexString
+		FNumber             FlexString
+		FocalLength         FlexString
+	}
+	GPS struct {
+		GPSLatitude     FlexString
+		GPSLatitudeRef  string
+		GPSLongitude    FlexString
+		GPSLongitudeRef string
+		GPSAltitude     FlexString
+		GPSAltitudeRef  string
+	}
+	QuickTime struct { // the movie header
+		CreateDate string
+		ModifyDate string
+	}
+	Keys struct { // com.apple.quicktime.* from phones
+		Make         string
+		Model        string
+		CreationDate string
+	}
+	UserData struct { // the older udta atoms
+		Make  string
+		Model string
+	}
 }
 
 // Load the consumer key and secret in from the config file
@@ -72,130 +133,429 @@ func LoadConfig(configPath *string, config *PhotosyncConfig) error {
 		return err
 	}
 
+	if err := ValidAuthPerms(config.Perms); err != nil {
+		return err
+	}
+
+	reader, err := NewMetadataReader(config.Metadata)
+	if err != nil {
+		return err
+	}
+	config.metadataReader = reader
+
 	// precompile the filename regexps
 	for i := 0; i < len(config.Filenames); i++ {
-		config.Filenames[i].Load()
+		if err := config.Filenames[i].Load(); err != nil {
+			return fmt.Errorf("filename %s: %v", config.Filenames[i].Match, err)
+		}
 	}
 
 	// create the templates
 	for i := 0; i < len(config.WatchDir); i++ {
-		config.WatchDir[i].CreateTemplates()
+		if err := config.WatchDir[i].LoadTemplates(); err != nil {
+			return err
+		}
+		if err := config.WatchDir[i].LoadGeo(); err != nil {
+			return err
+		}
+		if err := config.WatchDir[i].LoadMedia(); err != nil {
+			return err
+		}
+		if err := config.WatchDir[i].LoadWatcher(); err != nil {
+			return err
+		}
+		if config.WatchDir[i].Raw == RawConvert && len(config.RawConverter) == 0 {
+			return fmt.Errorf("%s: raw is convert but there is no raw_converter", config.WatchDir[i].Dir)
+		}
+	}
+
+	if err := config.TwoWay.Validate(config.WatchDir); err != nil {
+		return err
+	}
+	if err := config.MirrorDeletes.Validate(config.Perms); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func Sync(api *FlickrAPI, photos *PhotosMap, videos *PhotosMap, albums *AlbumsMap, opt *Options) (int, int, int, int, error) {
-	renCnt := 0
-	exCnt := 0
-	upCnt := 0
-	errCnt := 0
+// Walk the configured directories and push anything new to the photo service
+func Sync(api PhotoService, config *PhotosyncConfig, state *SyncState, photos *PhotosMap, videos *PhotosMap, albums *AlbumsMap, opt *Options) (int, int, int, int, error) {
+	return SyncContext(context.Background(), api, config, state, photos, videos, albums, opt)
+}
 
-	// process all the directories in the config
-	for _, dir := range api.config.WatchDir {
-		// ensure the path exists
-		if _, err := os.Stat(dir.Dir); os.IsNotExist(err) {
-			fmt.Printf("no such file or directory: %s", dir.Dir)
-			continue
-		}
+// Sync that stops when the context is done. In daemon mode that is the only way it returns.
+func SyncContext(ctx context.Context, api PhotoService, config *PhotosyncConfig, state *SyncState, photos *PhotosMap, videos *PhotosMap, albums *AlbumsMap, opt *Options) (int, int, int, int, error) {
+	s := newSyncer(ctx, api, config, state, photos, videos, albums, opt)
+	defer s.close()
 
-		exifAry, er := GetAllExifData(dir.Dir)
-		if er != nil {
-			return renCnt, exCnt, upCnt, errCnt, er
-		}
+	// work out everything that needs doing then do it, or just show it on a dry run
+	plan, err := s.planDirs()
+	if err != nil {
+		return s.counts(err)
+	}
+	if opt.Dryrun {
+		plan.Print(s.out)
+		atomic.AddInt64(&s.renCnt, int64(plan.Count(ActionRename)))
+		atomic.AddInt64(&s.upCnt, int64(plan.Count(ActionUpload)))
+	} else {
+		s.applyAll(plan.Actions)
+	}
 
-		exifs := make(map[string]ExifToolOutput)
-		for _, ex := range *exifAry {
-			exifs[ex.SourceFile] = ex
-		}
+	// start the daemon, stopping it is the normal way out
+	if opt.Daemon {
+		s.daemon()
+	}
 
-		err := filepath.Walk(dir.Dir, func(path string, f os.FileInfo, err error) error {
-			return processFile(api, &dir, path, f, &exifs, photos, videos, albums, &renCnt, &exCnt, &upCnt, &errCnt, opt)
-		})
+	return s.counts(nil)
+}
 
-		if err != nil {
-			return renCnt, exCnt, upCnt, errCnt, err
-		}
+// Work out what Sync would do without changing anything
+func PlanSync(config *PhotosyncConfig, state *SyncState, photos *PhotosMap, videos *PhotosMap, albums *AlbumsMap, opt *Options) (*Plan, error) {
+	return PlanSyncContext(context.Background(), config, state, photos, videos, albums, opt)
+}
+
+func PlanSyncContext(ctx context.Context, config *PhotosyncConfig, state *SyncState, photos *PhotosMap, videos *PhotosMap, albums *AlbumsMap, opt *Options) (*Plan, error) {
+	s := newSyncer(ctx, nil, config, state, photos, videos, albums, opt)
+	defer s.close()
+
+	return s.planDirs()
+}
+
+// Carry out a plan from PlanSync, usually saved by an earlier run
+func ApplyPlan(api PhotoService, config *PhotosyncConfig, state *SyncState, photos *PhotosMap, videos *PhotosMap, albums *AlbumsMap, plan *Plan, opt *Options) (int, int, int, int, error) {
+	return ApplyPlanContext(context.Background(), api, config, state, photos, videos, albums, plan, opt)
+}
+
+func ApplyPlanContext(ctx context.Context, api PhotoService, config *PhotosyncConfig, state *SyncState, photos *PhotosMap, videos *PhotosMap, albums *AlbumsMap, plan *Plan, opt *Options) (int, int, int, int, error) {
+	s := newSyncer(ctx, api, config, state, photos, videos, albums, opt)
+	defer s.close()
+
+	if err := plan.Validate(); err != nil {
+		return s.counts(err)
+	}
+	if opt.Dryrun {
+		plan.Print(s.out)
+		atomic.AddInt64(&s.renCnt, int64(plan.Count(ActionRename)))
+		atomic.AddInt64(&s.upCnt, int64(plan.Count(ActionUpload)))
+		return s.counts(nil)
 	}
 
-	// now same album ordering that changed
-	updateAlbumsOrder(api, albums)
+	s.applyAll(plan.Actions)
+	return s.counts(ctx.Err())
+}
 
-	// start the daemon
-	if opt.Daemon {
-		log.Println("starting...")
+// Shared state for a sync run. Files are discovered and checked on the
+// walking goroutine, which plans what to do with them. Uploads are handed
+// to a pool of upload workers when the plan is applied.
+type syncer struct {
+	ctx    context.Context // done when the sync should stop taking on work
+	work   context.Context // for work already started, outlives ctx by the shutdown grace
+	api    PhotoService
+	config *PhotosyncConfig
+	state  *SyncState
+	opt    *Options
+	jobs   int
+	out    io.Writer
+
+	meta     MetadataReader
+	exiftool *ExifToolSession // shared by every exiftool run, only started when needed
+
+	mu      sync.Mutex // guards photos, videos, hashes, pending and recent
+	photos  *PhotosMap
+	videos  *PhotosMap
+	hashes  HashesMap
+	pending map[string]bool         // content hashes planned for upload
+	recent  map[string]recentUpload // uploads by photo id, a listing may not show them yet
+
+	// files the walk leaves for later, the daemon holds back ones still changing
+	holdBack func(path string, f os.FileInfo) bool
+
+	albumsMu sync.Mutex // guards albums and the albums within it
+	albums   *AlbumsMap
+
+	// counters, only touch with sync/atomic
+	renCnt int64
+	exCnt  int64
+	upCnt  int64
+	errCnt int64
+
+	queue chan *uploadJob
+	wg    sync.WaitGroup
+
+	// batches of actions the daemon left to be applied in order, so it never
+	// waits on the upload queue
+	backlogMu    sync.Mutex
+	backlog      []backlogged
+	backlogReady chan struct{}
+
+	cancelWork context.CancelFunc
+}
 
-		watcher, err := fsnotify.NewWatcher()
-		if err != nil {
-			log.Fatal(err)
+// An upload waiting for a worker, with the actions that need its photo id
+// and the config when it was queued
+type uploadJob struct {
+	action Action
+	after  []Action
+	config *PhotosyncConfig
+}
+
+// how long uploads in progress get to finish once a sync is stopped
+const defaultShutdownGrace = time.Minute
+
+func newSyncer(ctx context.Context, api PhotoService, config *PhotosyncConfig, state *SyncState, photos, videos *PhotosMap, albums *AlbumsMap, opt *Options) *syncer {
+	// the command line wins over the config
+	jobs := opt.Jobs
+	if jobs <= 0 {
+		jobs = config.Jobs
+	}
+	if jobs <= 0 {
+		jobs = 1
+	}
+
+	out := opt.Out
+	if out == nil {
+		out = os.Stdout
+	}
+
+	// keep one exiftool running instead of starting one for every file
+	session := NewExifToolSession("")
+	meta := config.MetadataReader()
+	if r, ok := meta.(*ExifToolReader); ok && r.Session == nil {
+		session.Path = r.Path
+		meta = &ExifToolReader{Path: r.Path, Session: session}
+	}
+
+	grace := config.ShutdownGrace.Duration()
+	if grace <= 0 {
+		grace = defaultShutdownGrace
+	}
+	work, cancelWork := context.WithCancel(context.Background())
+
+	// the listings keyed by title keep one photo per title, the saved one
+	// has them all
+	hashes := IndexByHash(photos, videos)
+	if state != nil {
+		for _, media := range []string{"photo", "video"} {
+			saved, err := state.RemotePhotos(media)
+			if err != nil {
+				log.Println("error reading sync state", err)
+				break
+			}
+			for hash, p := range IndexByHash(saved) {
+				hashes[hash] = p
+			}
 		}
+	}
 
-		done := make(chan bool)
-		dirCfgs := make(map[string]WatchDirConfig)
+	s := &syncer{
+		ctx:      ctx,
+		work:     work,
+		api:      api,
+		config:   config,
+		state:    state,
+		opt:      opt,
+		jobs:     jobs,
+		out:      out,
+		meta:     meta,
+		exiftool: session,
+		photos:   photos,
+		videos:   videos,
+		hashes:   hashes,
+		pending:  make(map[string]bool),
+		recent:   make(map[string]recentUpload),
+		albums:   albums,
+
+		cancelWork: cancelWork,
+	}
+	go s.cutOffAfter(grace)
+	return s
+}
 
-		go func() {
-			for {
-				select {
-				case event := <-watcher.Events:
-					//log.Println("event:", event)
-					if event.Op&fsnotify.Create == fsnotify.Create {
-						log.Println("created file:", event.Name)
-						f, err := os.Stat(event.Name)
-						if err != nil {
-							log.Println("error getting file info for ", event.Name)
-							continue
-						}
+// Once the sync is stopped give the work in progress the grace period to
+// finish before cutting it off
+func (this *syncer) cutOffAfter(grace time.Duration) {
+	select {
+	case <-this.ctx.Done():
+	case <-this.work.Done():
+		return // closed
+	}
 
-						// get the dir config
-						var cfg *WatchDirConfig
-						for dir, dirCfg := range dirCfgs {
-							if event.Name[:len(dir)] == dir {
-								cfg = &dirCfg
-							}
-						}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		log.Println("stopping the uploads still going after", grace)
+	case <-this.work.Done():
+	}
+	this.cancelWork()
+}
 
-						processFile(api, cfg, event.Name, f, nil, photos, videos, albums, &renCnt, &exCnt, &upCnt, &errCnt, opt)
+// Let go of everything the sync started
+func (this *syncer) close() {
+	this.cancelWork()
+	this.exiftool.Close()
+}
 
-						// update album order if changed
-						updateAlbumsOrder(api, albums)
-					}
-				case err := <-watcher.Errors:
-					log.Println("error:", err)
+// Start the upload workers
+func (this *syncer) start() {
+	this.queue = make(chan *uploadJob, this.jobs)
+	for i := 0; i < this.jobs; i++ {
+		this.wg.Add(1)
+		go func() {
+			defer this.wg.Done()
+			for job := range this.queue {
+				if this.ctx.Err() != nil {
+					continue // drain what's left without uploading it
+				}
+				this.upload(job)
+
+				// nothing else will flush the album order while watching
+				if this.opt.Daemon {
+					this.updateAlbumsOrder()
 				}
 			}
 		}()
+	}
+}
 
-		for _, dir := range api.config.WatchDir {
-			// ensure the path exists
-			if _, err := os.Stat(dir.Dir); os.IsNotExist(err) {
-				fmt.Printf("no such file or directory: %s", dir.Dir)
-				continue
-			}
+// Wait for the queued uploads to finish and stop the workers
+func (this *syncer) stop() {
+	close(this.queue)
+	this.wg.Wait()
+}
 
-			dirCfgs[dir.Dir] = dir // add to map of configs for the event handler to use
+func (this *syncer) counts(err error) (int, int, int, int, error) {
+	return int(atomic.LoadInt64(&this.renCnt)),
+		int(atomic.LoadInt64(&this.exCnt)),
+		int(atomic.LoadInt64(&this.upCnt)),
+		int(atomic.LoadInt64(&this.errCnt)),
+		err
+}
 
-			err = watcher.Add(dir.Dir)
-			if err != nil {
-				log.Fatal(err)
+// The media type of a file if the dir syncs it, nil otherwise
+func (this *syncer) mediaType(dirCfg *WatchDirConfig, path, ext string) *MediaType {
+	mt, err := DetectMediaType(path)
+	if err != nil || mt == nil || !dirCfg.Accepts(mt, ext) {
+		return nil
+	}
+
+	if mt.Raw {
+		if dirCfg.GetRaw() == RawSkip {
+			return nil
+		}
+		if hasSidecar(path) {
+			if !this.opt.Daemon {
+				fmt.Fprintln(this.out, path, "-- has a JPEG next to it, skipping the RAW")
 			}
+			return nil
+		}
+	}
+	return mt
+}
+
+// Walk the configured directories and work out what needs doing
+func (this *syncer) planDirs() (*Plan, error) {
+	plan := &Plan{}
 
+	// process all the directories in the config
+	for i := range this.config.WatchDir {
+		actions, err := this.planDir(&this.config.WatchDir[i])
+		if err != nil {
+			return nil, err
 		}
+		plan.Actions = append(plan.Actions, actions...)
+	}
 
-		<-done
+	// files deleted here since they were synced
+	deletes, err := this.planDeletes(plan.Actions)
+	if err != nil {
+		return nil, err
+	}
+	plan.Actions = append(plan.Actions, deletes...)
+
+	// now save the album ordering that changed
+	var reorders []Action
+	seen := make(map[string]bool)
+	for _, a := range plan.Actions {
+		if a.Type == ActionAddToAlbum && !seen[a.Album] {
+			seen[a.Album] = true
+			reorders = append(reorders, Action{Type: ActionReorderAlbum, Album: a.Album})
+		}
+	}
+	plan.Actions = append(plan.Actions, reorders...)
+
+	return plan, nil
+}
 
+// Walk one configured directory and work out what needs doing in it
+func (this *syncer) planDir(dir *WatchDirConfig) ([]Action, error) {
+	// ensure the path exists
+	if _, err := os.Stat(dir.Dir); os.IsNotExist(err) {
+		fmt.Fprintf(this.out, "no such file or directory: %s", dir.Dir)
+		return nil, nil
 	}
 
-	return renCnt, exCnt, upCnt, errCnt, nil
+	exifAry, er := this.meta.ReadDir(this.ctx, dir.Dir, dir.Ignores)
+	if er != nil {
+		return nil, er
+	}
+
+	exifs := make(map[string]ExifToolOutput)
+	for _, ex := range *exifAry {
+		exifs[ex.SourceFile] = ex
+	}
+
+	var actions []Action
+	err := filepath.Walk(dir.Dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir.Dir {
+				return err
+			}
+			// skip what can't be read and carry on with the rest
+			log.Println("error reading", path, err)
+			atomic.AddInt64(&this.errCnt, 1)
+			return nil
+		}
+		if err := this.ctx.Err(); err != nil {
+			return err // stop walking
+		}
+		if dir.Ignores(path) {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !f.IsDir() && this.holdBack != nil && this.holdBack(path, f) {
+			return nil
+		}
+		more, err := this.planFile(dir, path, f, &exifs)
+		if err != nil && this.ctx.Err() == nil {
+			log.Println("error checking", path, err)
+			atomic.AddInt64(&this.errCnt, 1)
+			return nil
+		}
+		actions = append(actions, more...)
+		return err
+	})
+	return actions, err
 }
 
-func processFile(api *FlickrAPI, dirCfg *WatchDirConfig, path string, f os.FileInfo, exifs *map[string]ExifToolOutput, photos, videos *PhotosMap, albums *AlbumsMap, renCnt, exCnt, upCnt, errCnt *int, opt *Options) error {
+// Work out what needs doing for one file. Nothing is changed, apart from
+// marking the content as planned for upload so copies of it aren't.
+func (this *syncer) planFile(dirCfg *WatchDirConfig, path string, f os.FileInfo, exifs *map[string]ExifToolOutput) ([]Action, error) {
+	opt := this.opt
+	state := this.state
+	out := this.out
+
+	var actions []Action
+
 	if !f.IsDir() { // make sure we aren't operating on a directory
 
 		var newPath, newKey string
 		var changed bool
 		dir, fname := filepath.Split(path)
 		ext := filepath.Ext(fname)
-		extUpper := strings.ToUpper(ext)
 		key := fname[:len(fname)-len(ext)]
 
 		var exif ExifToolOutput
@@ -203,16 +563,16 @@ func processFile(api *FlickrAPI, dirCfg *WatchDirConfig, path string, f os.FileI
 			var ok bool
 			exif, ok = (*exifs)[path]
 			if !ok {
-				tmpexif, err := GetExifData(path)
+				tmpexif, err := this.meta.Read(this.ctx, path)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				exif = *tmpexif
 			}
 		} else {
-			tmpexif, err := GetExifData(path)
+			tmpexif, err := this.meta.Read(this.ctx, path)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			exif = *tmpexif
 		}
@@ -227,160 +587,780 @@ func processFile(api *FlickrAPI, dirCfg *WatchDirConfig, path string, f os.FileI
 			exif:   exif,
 		}
 
+		// where the file is now, path is where it will be once renamed
+		src := path
+
 		// rename file if needed
 		// check again all filename configs
-		for _, fncfg := range api.GetFilenamesConfig() {
+		for _, fncfg := range this.config.Filenames {
 			newPath, newKey, changed = fncfg.GetNewPath(path, dirCfg, &exif)
 			if changed {
-				fmt.Println("rename to:", newPath)
-
-				if !opt.Dryrun {
-					os.Rename(path, newPath)
-					path = newPath // swith to the new file
-					key = newKey
-					var err error
-					f, err = os.Stat(path)
-					if err != nil {
-						return err
-					}
-
-					// update the context as well
-					context = DynamicValueContext{
-						path:   path,
-						dir:    dir,
-						ext:    ext,
-						title:  key,
-						dirCfg: *dirCfg,
-						exif:   exif,
-					}
-
-					*renCnt++
+				fmt.Fprintln(out, "rename to:", newPath)
+				actions = append(actions, Action{Type: ActionRename, From: path, Path: newPath})
+
+				path = newPath // plan the rest for the new name
+				key = newKey
+
+				// update the context as well
+				context = DynamicValueContext{
+					path:   path,
+					dir:    dir,
+					ext:    ext,
+					title:  key,
+					dirCfg: *dirCfg,
+					exif:   exif,
 				}
 
 				break // found our match to bail
 			}
 		}
 
-		if extUpper == ".JPG" || extUpper == ".MOV" || extUpper == ".MP4" {
+		if mt := this.mediaType(dirCfg, src, ext); mt != nil {
 			if !opt.Daemon {
-				fmt.Println(path)
+				fmt.Fprintln(out, path)
 			}
 
 			var exists bool
 			var exPhoto Photo
 
-			if extUpper == ".JPG" {
-				exPhoto, exists = (*photos)[key]
-			} else if extUpper == ".MOV" || extUpper == ".MP4" {
-				exPhoto, exists = (*videos)[key]
+			// the state db knows about files we uploaded before regardless of their title
+			var rec *FileState
+			if state != nil {
+				var err error
+				if opt.NoUpload {
+					// nothing gets uploaded so don't read the whole file for its hash
+					rec, err = state.GetFile(src)
+				} else {
+					rec, err = state.Track(src, f)
+				}
+				if err != nil {
+					return nil, err
+				}
+				if rec != nil && len(rec.PhotoId) > 0 {
+					exPhoto, exists = Photo{Id: rec.PhotoId, Title: rec.Title}, true
+
+					// bring back what was changed on Flickr since it was synced
+					remote, gone, err := this.remotePhoto(rec.PhotoId)
+					if err != nil {
+						return nil, err
+					}
+					tw := &this.config.TwoWay
+					if gone {
+						switch tw.GetOnDelete() {
+						case TwoWayUpload:
+							fmt.Fprintln(out, "deleted from flickr, uploading again")
+							exists = false
+						case TwoWayDelete:
+							return append(actions, Action{Type: ActionDeleteLocal, Path: path, PhotoId: rec.PhotoId}), nil
+						case TwoWayTrash:
+							return append(actions, Action{Type: ActionTrash, Path: path, PhotoId: rec.PhotoId, To: tw.trashPath(dirCfg, path, rec.PhotoId)}), nil
+						case TwoWayIgnore:
+							return actions, nil
+						}
+					} else if remote != nil && remote.Title != rec.Title {
+						exPhoto.Title = remote.Title // the link below remembers it
+
+						name := safeFilename(remote.Title)
+						if len(rec.Title) > 0 && len(name) > 0 && tw.GetOnRename() == TwoWayRename {
+							newPath := filepath.Join(filepath.Dir(path), name+ext)
+							if _, err := os.Stat(newPath); err == nil {
+								fmt.Fprintln(out, "retitled on flickr but there is already a", newPath)
+							} else {
+								fmt.Fprintln(out, "retitled on flickr, rename to:", newPath)
+								actions = append(actions, Action{Type: ActionRename, From: path, Path: newPath})
+								path, key = newPath, name
+								context.path, context.title = path, key
+							}
+						}
+					}
+				}
+			}
+
+			// only hash when we have to as it means reading the whole file
+			var hash string
+			if rec != nil {
+				hash = rec.Hash
+			}
+			getHash := func() (string, error) {
+				var err error
+				if len(hash) == 0 {
+					hash, err = FileHash(src)
+				}
+				return hash, err
 			}
 
 			if !exists {
-				if opt.Daemon {
-					fmt.Println(path)
+				// check by title but a photo tagged with a different content hash is a different file
+				this.mu.Lock()
+				if mt.Media == "video" {
+					exPhoto, exists = (*this.videos)[key]
+				} else {
+					exPhoto, exists = (*this.photos)[key]
 				}
-				fmt.Print("|=====")
-
-				if !opt.Dryrun && !opt.NoUpload {
-					tmppath, done, er := FixExif(key, path, f)
+				this.mu.Unlock()
 
-					path = tmppath // update the path to the potentially new path
-					if er != nil {
-						*errCnt++
-						return nil
-					}
-					res, err := api.Upload(path, f)
+				if exists && len(exPhoto.ContentHash()) > 0 && !opt.NoUpload {
+					h, err := getHash()
 					if err != nil {
-						*errCnt++
-						return nil
+						return nil, err
 					}
+					exists = exPhoto.ContentHash() == h
+				}
+			}
 
-					defer done(api, res.PhotoId)
+			if !exists && !opt.NoUpload {
+				// check by content in case it was renamed or moved since it was uploaded
+				h, err := getHash()
+				if err != nil {
+					return nil, err
+				}
 
-					// set the tags in config
-					if len(dirCfg.Tags) > 0 {
-						tags, err := dirCfg.GetTags(&context)
-						if err == nil {
-							api.AddTags(res.PhotoId, tags)
-						}
-					}
+				var queued bool
+				this.mu.Lock()
+				hPhoto, ok := this.hashes[h]
+				if !ok {
+					// another copy of the same file is already on its way up
+					queued = this.pending[h]
+				}
+				this.mu.Unlock()
 
-					if len(dirCfg.Albums) > 0 {
-						applyAlbums(api, dirCfg, &context, albums, res.PhotoId)
+				if ok {
+					exPhoto, exists = hPhoto, true
+				} else if state != nil {
+					id, err := state.PhotoIdForHash(h)
+					if err != nil {
+						return nil, err
 					}
-
-					// add back in to photos and videos
-					newPhoto := Photo{
-						Id:     res.PhotoId,
-						Owner:  "",
-						Secret: "",
-						Title:  key,
+					if len(id) > 0 {
+						_, gone, err := this.remotePhoto(id)
+						if err != nil {
+							return nil, err
+						}
+						exists = !gone
+						exPhoto = Photo{Id: id, Title: key}
 					}
+				}
 
-					switch extUpper {
-					case ".JPG":
-						(*photos)[key] = newPhoto
-					case ".MOV":
-						fallthrough
-					case ".MP4":
-						(*videos)[key] = newPhoto
-					}
+				if exists {
+					fmt.Fprintln(out, "same content as:", exPhoto.Title)
+				} else if queued {
+					fmt.Fprintln(out, "same content as a queued upload")
+					atomic.AddInt64(&this.exCnt, 1)
+					return actions, nil
+				}
+			}
 
-					fmt.Println("=====| 100%")
-				} else {
-					fmt.Println("=====| 100% --+ dry run +--")
+			if !exists {
+				if opt.Daemon {
+					fmt.Fprintln(out, path)
 				}
 
-				*upCnt++
+				if !opt.NoUpload {
+					this.mu.Lock()
+					this.pending[hash] = true
+					this.mu.Unlock()
+
+					actions = append(actions, this.planUpload(dirCfg, path, key, mt, hash, f, &context)...)
+				}
 			} else {
 				// still apply retroactive tags
-				if opt.RetroTags && len(dirCfg.Tags) > 0 {
-					fmt.Print("assign tags: ", dirCfg.Tags)
-					if !opt.Dryrun && !opt.NoUpload {
-						tags, err := dirCfg.GetTags(&context)
-						if err == nil {
-							api.AddTags(exPhoto.Id, tags)
-						}
-					} else {
-						fmt.Print(" --+ dry run +--")
+				if opt.RetroTags && !opt.NoUpload && len(dirCfg.Tags) > 0 {
+					if tags, err := dirCfg.GetTags(&context); err == nil {
+						actions = append(actions, Action{Type: ActionAddTags, Path: path, PhotoId: exPhoto.Id, Tags: tags})
+					}
+				}
+
+				// tag older uploads with their content hash as well
+				if opt.RetroTags && !opt.NoUpload && (rec == nil || len(rec.PhotoId) == 0) && len(exPhoto.ContentHash()) == 0 {
+					if h, err := getHash(); err == nil {
+						actions = append(actions, Action{Type: ActionAddTags, PhotoId: exPhoto.Id, Tags: HashMachineTag(h)})
 					}
-					fmt.Println()
 				}
 
 				// still apply albums
-				if opt.RetroAlbums && len(dirCfg.Albums) > 0 {
-					applyAlbums(api, dirCfg, &context, albums, exPhoto.Id)
+				if opt.RetroAlbums && !opt.NoUpload {
+					actions = append(actions, this.planAlbums(dirCfg, &context, path, exPhoto.Id)...)
 				}
 
-				*exCnt++
+				// remember files matched up by title or content so later runs find them by path
+				if rec != nil && !opt.NoUpload && (rec.PhotoId != exPhoto.Id || rec.Path != path || rec.Title != exPhoto.Title) {
+					actions = append(actions, Action{Type: ActionLink, Path: path, PhotoId: exPhoto.Id, Title: exPhoto.Title, Media: mt.Media})
+				}
+
+				atomic.AddInt64(&this.exCnt, 1)
 			}
 		}
 	}
 
-	return nil
+	return actions, nil
+}
+
+// The upload of a new file followed by everything done to the new photo
+func (this *syncer) planUpload(dirCfg *WatchDirConfig, path, key string, mt *MediaType, hash string, f os.FileInfo, context *DynamicValueContext) []Action {
+	up := Action{
+		Type:          ActionUpload,
+		Path:          path,
+		Title:         key,
+		Media:         mt.Media,
+		Hash:          hash,
+		StripLocation: dirCfg.StripLocation,
+	}
+	if mt.Raw {
+		up.Raw = dirCfg.GetRaw()
+	}
+	actions := []Action{up}
+
+	// set the tags in config along with the content hash
+	var tags string
+	if len(dirCfg.Tags) > 0 {
+		var err error
+		tags, err = dirCfg.GetTags(context)
+		if err != nil {
+			tags = ""
+		}
+	}
+	tags = strings.TrimSpace(tags + " " + HashMachineTag(hash))
+	actions = append(actions, Action{Type: ActionAddTags, Path: path, Tags: tags})
+
+	if lat, lon, ok := dirCfg.GetLocation(&context.exif); ok {
+		actions = append(actions, Action{Type: ActionSetLocation, Path: path, Latitude: lat, Longitude: lon, Accuracy: dirCfg.GetGeoAccuracy()})
+	}
+
+	actions = append(actions, this.planAlbums(dirCfg, context, path, "")...)
+
+	if t, ok := uploadDate(this.config, key, mt, &context.exif, f); ok {
+		actions = append(actions, Action{Type: ActionSetDate, Path: path, Date: t.Format(FlickrTimeLayout)})
+	}
+
+	return actions
 }
 
-func applyAlbums(api *FlickrAPI, dirCfg *WatchDirConfig, context *DynamicValueContext, albums *AlbumsMap, photoId string) {
+// Adding the photo to the configured albums that exist
+func (this *syncer) planAlbums(dirCfg *WatchDirConfig, context *DynamicValueContext, path, photoId string) []Action {
+	this.albumsMu.Lock()
+	defer this.albumsMu.Unlock()
+
+	var actions []Action
 	for _, albName := range dirCfg.GetAlbums(context) {
-		if val, ok := (*albums)[albName]; ok {
-			api.AddToAlbum(photoId, val)
+		if _, ok := (*this.albums)[albName]; ok {
+			actions = append(actions, Action{Type: ActionAddToAlbum, Path: path, PhotoId: photoId, Album: albName})
+		}
+	}
+	return actions
+}
+
+// Apply every action with a pool of workers for the uploads
+func (this *syncer) applyAll(actions []Action) {
+	this.start()
+	reorders := this.apply(actions, this.config)
+
+	// let the uploads finish
+	this.stop()
+
+	// now save the album ordering that changed
+	this.reorderAlbums(reorders)
+}
+
+// Carry out the actions. Uploads are handed to the workers, which must be
+// running, along with the actions on the photo they'll make. Album reorders
+// come back to be done once the uploads are finished. config is the one the
+// actions were planned with, the daemon may have loaded another since.
+func (this *syncer) apply(actions []Action, config *PhotosyncConfig) []Action {
+	var reorders []Action
+
+	// the actions waiting on each upload for its photo id, by the upload's
+	// index. A later upload of the same path is a different file by that name.
+	after := make(map[int][]Action)
+	uploading := make(map[string]int)
+	for i, a := range actions {
+		if a.Type == ActionUpload {
+			uploading[a.Path] = i
+		} else if j, ok := uploading[a.Path]; ok && len(a.PhotoId) == 0 {
+			after[j] = append(after[j], a)
 		}
 	}
+
+	for i, a := range actions {
+		if this.ctx.Err() != nil {
+			break
+		}
+
+		switch a.Type {
+		case ActionRename:
+			fmt.Fprintln(this.out, "rename to:", a.Path)
+			if err := os.Rename(a.From, a.Path); err != nil {
+				log.Println("error renaming", a.From, err)
+				atomic.AddInt64(&this.errCnt, 1)
+				continue
+			}
+			if this.state != nil {
+				if err := this.state.MoveFile(a.From, a.Path); err != nil {
+					log.Println("error saving sync state for", a.Path, err)
+				}
+			}
+			atomic.AddInt64(&this.renCnt, 1)
+
+		case ActionUpload:
+			job := &uploadJob{action: a, after: after[i], config: config}
+
+			select {
+			case this.queue <- job:
+			case <-this.ctx.Done():
+			}
+
+		case ActionReorderAlbum:
+			reorders = append(reorders, a)
+
+		case ActionLink:
+			this.updateFile(a.Path, func(rec *FileState) {
+				rec.PhotoId = a.PhotoId
+				if len(a.Title) > 0 {
+					rec.Title = a.Title
+				}
+				if len(a.Media) > 0 {
+					rec.Media = a.Media
+				}
+				if rec.Synced.IsZero() {
+					rec.Synced = time.Now()
+				}
+			})
+
+		case ActionDeleteLocal:
+			if !this.useTwoWayAllowance(config) {
+				log.Println("not deleting", a.Path, "the two way deletes allowance is used up")
+				continue
+			}
+			fmt.Fprintln(this.out, a)
+			if err := os.Remove(a.Path); err != nil && !os.IsNotExist(err) {
+				log.Println("error deleting", a.Path, err)
+				atomic.AddInt64(&this.errCnt, 1)
+				continue
+			}
+			this.forgetFile(a.Path)
+
+		case ActionMakePrivate, ActionDeletePhoto:
+			if !this.useMirrorAllowance(config) {
+				log.Println("not changing", a.PhotoId, "on Flickr, the mirror deletes allowance is used up")
+				continue
+			}
+			fmt.Fprintln(this.out, a)
+			var err error
+			if a.Type == ActionDeletePhoto {
+				err = this.api.DeleteContext(this.ctx, a.PhotoId)
+			} else {
+				err = this.api.SetPermsContext(this.ctx, a.PhotoId, false, false, false)
+			}
+			if err != nil {
+				log.Println("error with", a, err)
+				atomic.AddInt64(&this.errCnt, 1)
+				continue
+			}
+			this.forgetFile(a.Path)
+			if a.Type == ActionDeletePhoto {
+				this.forgetPhoto(a.PhotoId)
+			}
+
+		case ActionMarkGone:
+			grace := config.MirrorDeletes.GetGrace()
+			fmt.Fprintln(this.out, "deleted:", a.Path, "-- Flickr follows in", grace)
+			this.changeRecord(a.Path, func(rec *FileState) {
+				if rec.Missing.IsZero() {
+					rec.Missing = time.Now()
+				}
+			})
+
+		case ActionMarkBack:
+			this.changeRecord(a.Path, func(rec *FileState) {
+				rec.Missing = time.Time{}
+			})
+
+		case ActionForget:
+			this.forgetFile(a.Path)
+
+		case ActionTrash:
+			if !this.useTwoWayAllowance(config) {
+				log.Println("not moving", a.Path, "to the trash, the two way deletes allowance is used up")
+				continue
+			}
+			fmt.Fprintln(this.out, a)
+			if err := os.MkdirAll(filepath.Dir(a.To), 0755); err != nil {
+				log.Println("error moving", a.Path, err)
+				atomic.AddInt64(&this.errCnt, 1)
+				continue
+			}
+			if err := os.Rename(a.Path, a.To); err != nil {
+				log.Println("error moving", a.Path, err)
+				atomic.AddInt64(&this.errCnt, 1)
+				continue
+			}
+			this.forgetFile(a.Path)
+
+		default:
+			if len(a.PhotoId) == 0 {
+				continue // done by the worker uploading it
+			}
+
+			fmt.Fprintln(this.out, a)
+			if err := this.applyTo(this.ctx, a, a.PhotoId); err != nil {
+				log.Println("error with", a, err)
+				atomic.AddInt64(&this.errCnt, 1)
+				continue
+			}
+
+			switch a.Type {
+			case ActionAddTags:
+				this.updateFile(a.Path, func(rec *FileState) {
+					rec.Tags = mergeStrings(rec.Tags, strings.Fields(a.Tags))
+				})
+			case ActionAddToAlbum:
+				this.updateFile(a.Path, func(rec *FileState) {
+					rec.Albums = mergeStrings(rec.Albums, []string{a.Album})
+				})
+			}
+		}
+	}
+
+	return reorders
 }
 
-func updateAlbumsOrder(api *FlickrAPI, albums *AlbumsMap) {
+// Make the change an action describes to a photo that is on Flickr
+func (this *syncer) applyTo(ctx context.Context, a Action, photoId string) error {
+	api := this.api
+
+	switch a.Type {
+	case ActionAddTags:
+		return api.AddTagsContext(ctx, photoId, a.Tags)
+	case ActionAddToAlbum:
+		this.albumsMu.Lock()
+		defer this.albumsMu.Unlock()
+
+		alb, ok := (*this.albums)[a.Album]
+		if !ok {
+			return fmt.Errorf("no album called %s", a.Album)
+		}
+		return api.AddToAlbumContext(ctx, photoId, alb)
+	case ActionSetDate:
+		fmt.Fprintf(this.out, "set time to: %s\n", a.Date)
+		return api.SetDateContext(ctx, photoId, a.Date)
+	case ActionSetLocation:
+		return api.SetLocationContext(ctx, photoId, a.Latitude, a.Longitude, a.Accuracy)
+	}
+	return fmt.Errorf("can't apply %s to a photo", a.Type)
+}
+
+// Change the state db record for a local file, if there is a state db
+func (this *syncer) updateFile(path string, fn func(rec *FileState)) {
+	if this.state == nil || len(path) == 0 {
+		return
+	}
+
+	f, err := os.Stat(path)
+	if err != nil {
+		log.Println("error saving sync state for", path, err)
+		return
+	}
+	rec, err := this.state.Track(path, f)
+	if err != nil {
+		log.Println("error saving sync state for", path, err)
+		return
+	}
+
+	fn(rec)
+	if err := this.state.PutFile(rec); err != nil {
+		log.Println("error saving sync state for", path, err)
+	}
+}
+
+// Change the state db record for a local file that may be gone, if there is
+// a record for it
+func (this *syncer) changeRecord(path string, fn func(rec *FileState)) {
+	if this.state == nil {
+		return
+	}
+	rec, err := this.state.GetFile(path)
+	if err != nil || rec == nil {
+		if err != nil {
+			log.Println("error reading sync state for", path, err)
+		}
+		return
+	}
+
+	fn(rec)
+	if err := this.state.PutFile(rec); err != nil {
+		log.Println("error saving sync state for", path, err)
+	}
+}
+
+// Drop the state db record for a local file that is gone
+func (this *syncer) forgetFile(path string) {
+	if this.state == nil {
+		return
+	}
+	if err := this.state.DeleteFile(path); err != nil {
+		log.Println("error saving sync state for", path, err)
+	}
+}
+
+// Drop a photo deleted from Flickr from the listings
+func (this *syncer) forgetPhoto(photoId string) {
+	this.mu.Lock()
+	for _, photos := range []*PhotosMap{this.photos, this.videos} {
+		for title, p := range *photos {
+			if p.Id == photoId {
+				delete(*photos, title)
+			}
+		}
+	}
+	for hash, p := range this.hashes {
+		if p.Id == photoId {
+			delete(this.hashes, hash)
+		}
+	}
+	this.mu.Unlock()
+
+	if this.state != nil {
+		if err := this.state.ForgetPhoto(photoId); err != nil {
+			log.Println("error saving sync state for", photoId, err)
+		}
+	}
+}
+
+// What the remote listing says about a photo synced from here, and whether it
+// was deleted from Flickr. Only two way syncs look. A photo missing from the
+// listing might just have been missed by it, so it only counts as deleted
+// once Flickr says it can't find it.
+func (this *syncer) remotePhoto(photoId string) (*RemotePhoto, bool, error) {
+	if !this.config.TwoWay.Enabled || this.state == nil {
+		return nil, false, nil
+	}
+
+	rp, err := this.state.RemotePhoto(photoId)
+	if err != nil || rp != nil {
+		return rp, false, err
+	}
+
+	// nothing listed yet, don't ask about every photo
+	this.mu.Lock()
+	listed := len(*this.photos) + len(*this.videos)
+	this.mu.Unlock()
+	if listed == 0 {
+		return nil, false, nil
+	}
+
+	// plans are made without the api, so a photo missing from the listing isn't taken as gone
+	if this.api == nil {
+		return nil, false, nil
+	}
+
+	_, err = this.api.GetInfoContext(this.ctx, &Photo{Id: photoId})
+	if e, ok := err.(*ApiError); ok && e.Code == photoNotFound {
+		return nil, true, nil
+	}
+	return nil, false, err
+}
+
+// Upload a file and apply the actions that go with it. Runs on an upload worker.
+func (this *syncer) upload(job *uploadJob) {
+	api := this.api
+	a := job.action
+	srcPath := a.Path
+
+	// whatever happens it is no longer pending
+	defer func() {
+		this.mu.Lock()
+		delete(this.pending, a.Hash)
+		this.mu.Unlock()
+	}()
+
+	f, err := os.Stat(srcPath)
+	if err != nil {
+		log.Println("error uploading", srcPath, err)
+		atomic.AddInt64(&this.errCnt, 1)
+		return
+	}
+
+	// only draw the bar when uploads aren't interleaved
+	var progress ProgressFunc
+	if this.jobs == 1 {
+		fmt.Fprint(this.out, "|")
+		progress = progressBar(this.out, 10)
+	}
+
+	// Flickr won't take RAW files so send a JPEG of them instead
+	origPath := srcPath
+	if len(a.Raw) > 0 {
+		jpg, cleanup, err := prepareRaw(this.work, job.config, this.exiftool, a.Raw, srcPath, a.Title)
+		if err != nil {
+			log.Println("error converting", srcPath, err)
+			atomic.AddInt64(&this.errCnt, 1)
+			return
+		}
+		defer cleanup()
+		if f, err = os.Stat(jpg); err != nil {
+			log.Println("error converting", srcPath, err)
+			atomic.AddInt64(&this.errCnt, 1)
+			return
+		}
+		origPath = jpg
+	}
+
+	path, er := fixExif(this.work, this.meta, this.exiftool, origPath, f)
+	if er != nil {
+		log.Println("error preparing", srcPath, er)
+		atomic.AddInt64(&this.errCnt, 1)
+		return
+	}
+	if path != origPath {
+		defer os.Remove(path) // the fixed up temp copy
+	}
+
+	uploadPath := path
+	if a.StripLocation {
+		stripped, err := stripLocation(this.work, this.exiftool, path)
+		if err != nil {
+			log.Println("error removing the location from", srcPath, err)
+			atomic.AddInt64(&this.errCnt, 1)
+			return
+		}
+		defer os.Remove(stripped)
+		uploadPath = stripped
+	}
+
+	res, err := api.UploadContext(this.work, uploadPath, f, progress)
+	if err != nil {
+		log.Println("error uploading", srcPath, err)
+		atomic.AddInt64(&this.errCnt, 1)
+		return
+	}
+
+	if this.jobs == 1 {
+		fmt.Fprintln(this.out, "| 100%")
+	} else {
+		fmt.Fprintln(this.out, "|==========| 100%", srcPath)
+	}
+
+	// now the tags, location, albums and date on the new photo
+	var appliedTags, appliedAlbums []string
+	for _, b := range job.after {
+		if err := this.applyTo(this.work, b, res.PhotoId); err != nil {
+			log.Println("error with", b, err)
+			continue
+		}
+		switch b.Type {
+		case ActionAddTags:
+			appliedTags = mergeStrings(appliedTags, strings.Fields(b.Tags))
+		case ActionAddToAlbum:
+			appliedAlbums = append(appliedAlbums, b.Album)
+		}
+	}
+
+	this.updateFile(srcPath, func(rec *FileState) {
+		rec.PhotoId = res.PhotoId
+		rec.Title = a.Title
+		rec.Media = a.Media
+		rec.Tags = appliedTags
+		rec.Albums = appliedAlbums
+		rec.Synced = time.Now()
+	})
+
+	// add back in to photos and videos
+	newPhoto := Photo{
+		Id:     res.PhotoId,
+		Owner:  "",
+		Secret: "",
+		Title:  a.Title,
+		Media:  a.Media,
+	}
+	if len(a.Hash) > 0 {
+		newPhoto.MachineTags = HashMachineTag(a.Hash)
+	}
+
+	// so two way syncs don't take it for deleted before the next listing
+	if this.state != nil {
+		if err := this.state.PutRemote(a.Media, &PhotosMap{newPhoto.Id: newPhoto}); err != nil {
+			log.Println("error saving sync state for", srcPath, err)
+		}
+	}
+
+	this.mu.Lock()
+	if len(a.Hash) > 0 {
+		this.hashes[a.Hash] = newPhoto
+	}
+	if a.Media == "video" {
+		(*this.videos)[a.Title] = newPhoto
+	} else {
+		(*this.photos)[a.Title] = newPhoto
+	}
+	this.recent[newPhoto.Id] = recentUpload{newPhoto, a.Media, time.Now()}
+	this.mu.Unlock()
+
+	atomic.AddInt64(&this.upCnt, 1)
+}
+
+// A ProgressFunc that draws a bar width characters wide as the bytes go out
+func progressBar(out io.Writer, width int) ProgressFunc {
+	drawn := 0
+	return func(sent, total int64) {
+		if total <= 0 {
+			return
+		}
+		for want := int(sent * int64(width) / total); drawn < want; drawn++ {
+			fmt.Fprint(out, "=")
+		}
+	}
+}
+
+func (this *syncer) updateAlbumsOrder() {
+	this.albumsMu.Lock()
+	defer this.albumsMu.Unlock()
+
+	updateAlbumsOrder(this.work, this.api, this.albums, this.out)
+}
+
+// Save the order of the albums in the reorder actions if adding to them changed it
+func (this *syncer) reorderAlbums(reorders []Action) {
+	this.albumsMu.Lock()
+	defer this.albumsMu.Unlock()
+
+	for _, a := range reorders {
+		if alb, ok := (*this.albums)[a.Album]; ok && alb.Dirty {
+			fmt.Fprintln(this.out, "update album order:", alb.GetTitle())
+			this.api.SetAlbumOrderContext(this.work, alb.Id, alb.PhotoIds)
+			alb.Dirty = false
+		}
+	}
+}
+
+// Append the values from b that aren't already in a
+func mergeStrings(a, b []string) []string {
+	for _, v := range b {
+		found := false
+		for _, ex := range a {
+			if ex == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a = append(a, v)
+		}
+	}
+	return a
+}
+
+func updateAlbumsOrder(ctx context.Context, api PhotoService, albums *AlbumsMap, out io.Writer) {
 	// loop over keys and index directly into albums to keep ref back to original
 	for _, alb := range *albums {
 		if alb.Dirty {
-			fmt.Println("update album order:", alb.GetTitle())
-			api.SetAlbumOrder(alb.Id, alb.PhotoIds)
+			fmt.Fprintln(out, "update album order:", alb.GetTitle())
+			api.SetAlbumOrderContext(ctx, alb.Id, alb.PhotoIds)
 			alb.Dirty = false
 		}
 	}
 }
 
-func getTimeFromTitle(api *FlickrAPI, title string) (*time.Time, error) {
-	for _, tf := range api.config.FilenameTimeFormats {
+func getTimeFromTitle(config *PhotosyncConfig, title string) (*time.Time, error) {
+	for _, tf := range config.FilenameTimeFormats {
 		var tmp = title
 
 		// check prefix
@@ -409,36 +1389,52 @@ func getTimeFromTitle(api *FlickrAPI, title string) (*time.Time, error) {
 	return nil, Error{"no timestamp in title"}
 }
 
-func GetExifData(path string) (*ExifToolOutput, error) {
-	exifs, err := GetAllExifData(path)
-	if err != nil {
-		return nil, err
-	}
-	if len(*exifs) == 0 {
-		return nil, Error{"no exif data found"}
+// The reader picked in the config, the default one if it didn't load a config
+func (this *PhotosyncConfig) MetadataReader() MetadataReader {
+	if this.metadataReader == nil {
+		return DefaultMetadataReader
 	}
-	return &(*exifs)[0], nil
+	return this.metadataReader
+}
+
+func GetExifData(path string) (*ExifToolOutput, error) {
+	return GetExifDataContext(context.Background(), path)
+}
+
+// Read the metadata for a file with the DefaultMetadataReader
+func GetExifDataContext(ctx context.Context, path string) (*ExifToolOutput, error) {
+	return DefaultMetadataReader.Read(ctx, path)
 }
 
 func GetAllExifData(path string) (*[]ExifToolOutput, error) {
-	out, err := exec.Command("exiftool", "-a", "-u", "-g1", "-json", "-r", path).Output()
-	foo := string(out)
-	final := ""
-	// kill new lines
-	final = strings.Replace(foo, "\n", "", -1)
-	out = []byte(final)
+	return GetAllExifDataContext(context.Background(), path)
+}
+
+// Read the metadata for every file under a dir with the DefaultMetadataReader
+func GetAllExifDataContext(ctx context.Context, path string) (*[]ExifToolOutput, error) {
+	return DefaultMetadataReader.ReadDir(ctx, path, nil)
+}
+
+// Copy the file without any location in it. The caller removes the copy.
+func stripLocation(ctx context.Context, session *ExifToolSession, path string) (string, error) {
+	if _, err := exec.LookPath("exiftool"); err != nil {
+		return "", fmt.Errorf("strip_location needs exiftool installed")
+	}
+
+	tmpfile, err := ioutil.TempFile("", filepath.Base(path)+".")
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	tmpfilePath := tmpfile.Name()
+	tmpfile.Close()
+	os.Remove(tmpfilePath) // exiftool won't write over an existing file
 
-	var exif []ExifToolOutput
-	if err := json.Unmarshal(out, &exif); err != nil {
-		log.Fatal(final)
-		log.Fatal("unmarshal error: ", err)
-		return nil, err
+	if _, err := runExifTool(ctx, session, "-location:all=", "-o", tmpfilePath, path); err != nil {
+		os.Remove(tmpfilePath)
+		return "", err
 	}
 
-	return &exif, nil
+	return tmpfilePath, nil
 }
 
 //
@@ -447,72 +1443,94 @@ func GetAllExifData(path string) (*[]ExifToolOutput, error) {
 // workingFile, done, err := FixExif(...)
 // defer done()
 //
-func FixExif(title string, path string, f os.FileInfo) (string, func(api *FlickrAPI, photoId string), error) {
-	ext := filepath.Ext(f.Name())
-	extUpper := strings.ToUpper(ext)
-	var timeFromFilename *time.Time
+func FixExif(config *PhotosyncConfig, title string, path string, f os.FileInfo) (string, func(api PhotoService, photoId string), error) {
+	return FixExifContext(context.Background(), config, title, path, f)
+}
 
-	_setDateTaken := func(api *FlickrAPI, photoId string) {
-		var err error
-		timeFromFilename, err = getTimeFromTitle(api, title)
-		if err != nil {
-			timeFromFilename = nil
+// FixExif where the exiftool runs and the date updates stop when the context is done
+func FixExifContext(ctx context.Context, config *PhotosyncConfig, title string, path string, f os.FileInfo) (string, func(api PhotoService, photoId string), error) {
+	meta := config.MetadataReader()
+	fixed, err := fixExif(ctx, meta, nil, path, f)
+
+	done := func(api PhotoService, photoId string) {
+		if len(fixed) > 0 && fixed != path {
+			os.Remove(fixed)
 		}
 
-		// check the file name
-		if timeFromFilename != nil {
-			fmt.Printf("set time from file name: %s\n", timeFromFilename.Format(FlickrTimeLayout))
-			api.SetDate(photoId, timeFromFilename.Format(FlickrTimeLayout)) // eat the error as this is optional
+		// they are done uploading the file so let's set it's date
+		mt, _ := DetectMediaType(path)
+		exif := &ExifToolOutput{}
+		if mt != nil && mt.Media == "video" {
+			if e, err := meta.Read(ctx, path); err == nil {
+				exif = e
+			}
+		}
+		if t, ok := uploadDate(config, title, mt, exif, f); ok {
+			fmt.Printf("set time to: %s\n", t.Format(FlickrTimeLayout))
+			api.SetDateContext(ctx, photoId, t.Format(FlickrTimeLayout)) // eat the error as this is optional
 		}
 	}
 
-	_setDateTakenMov := func(api *FlickrAPI, photoId string) {
-		// they are done uploading the file so let's set it's date
-		_setDateTaken(api, photoId)
+	return fixed, done, err
+}
 
-		if timeFromFilename == nil {
-			// fall back to the mod time
-			// we do this for MOV's because there isn't exif data to use
-			fmt.Printf("set time to: %s\n", f.ModTime().Format(FlickrTimeLayout))
-			api.SetDate(photoId, f.ModTime().Format(FlickrTimeLayout)) // eat the error as this is optional
-		}
+// The date to set once the file is uploaded. The one in the file name wins,
+// otherwise videos, whose dates Flickr doesn't read, get the QuickTime ones
+// or the mod time. Flickr reads the dates in photos itself.
+func uploadDate(config *PhotosyncConfig, title string, mt *MediaType, exif *ExifToolOutput, f os.FileInfo) (time.Time, bool) {
+	if t, err := getTimeFromTitle(config, title); err == nil {
+		return *t, true
+	}
+
+	if mt == nil || mt.Media != "video" {
+		return time.Time{}, false
 	}
+	if t, ok := exif.DateTaken(); ok {
+		return t, true
+	}
+	return f.ModTime(), true
+}
+
+// FixExif with the reader to check the file with and the exiftool session to
+// fix it with, if there is one. Returns the path to upload.
+func fixExif(ctx context.Context, meta MetadataReader, session *ExifToolSession, path string, f os.FileInfo) (string, error) {
+	mt, _ := DetectMediaType(path)
 
-	if extUpper == ".JPG" {
+	if mt != nil && mt.Name == "jpeg" {
 		// check for valid exif data
-		exif, err := GetExifData(path)
+		exif, err := meta.Read(ctx, path)
 		if err != nil {
-			return "", _setDateTaken, err
+			return "", err
 		}
 
 		if len(exif.ExifTool.Warning) > 0 {
 			// we have an exif error
+			if _, err := exec.LookPath("exiftool"); err != nil {
+				// rewriting needs exiftool, without it the original goes up as is
+				return path, nil
+			}
+
 			if len(exif.Ifd.ModifyDate) > 0 {
 				// we have a valid date already so just fix exif
 
 				// create tmp file and copy
 				tmpfile, err := ioutil.TempFile("", f.Name()+".")
 				if err != nil {
-					return "", _setDateTaken, err
+					return "", err
 				}
 
 				tmpfilePath := tmpfile.Name() // ensure it's a new file for the sake of
 				os.Remove(tmpfile.Name())
 
-				_, errr := exec.Command("exiftool", "-exif:all=", "-tagsfromfile", "@", "-all:all", "-unsafe", "-o", tmpfilePath, path).CombinedOutput()
-				if errr != nil {
-					return "", _setDateTaken, errr
+				if _, err := runExifTool(ctx, session, "-exif:all=", "-tagsfromfile", "@", "-all:all", "-unsafe", "-o", tmpfilePath, path); err != nil {
+					return "", err
 				}
 
-				// return the callback function that should get called when use of this image is complete
-				return tmpfilePath, func(api *FlickrAPI, photoId string) { os.Remove(tmpfilePath) }, errr
+				// the caller removes it when it is done with it
+				return tmpfilePath, nil
 			}
 		}
-
-	} else if extUpper == ".MOV" || extUpper == ".MP4" {
-		// always set to the file's modified date
-		return path, _setDateTakenMov, nil
 	}
 
-	return path, _setDateTaken, nil
+	return path, nil
 }
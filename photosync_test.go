@@ -0,0 +1,322 @@
+package photosync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Reisender/photosync"
+	"github.com/Reisender/photosync/photosynctest"
+)
+
+// A config for the fake server that doesn't wait between calls
+func testConfig(srv *photosynctest.Server) photosync.PhotosyncConfig {
+	cfg := srv.Config()
+	cfg.RateLimit.PerHour = -1
+	cfg.Retry.BaseDelay = photosync.Duration(time.Millisecond)
+	cfg.Retry.MaxDelay = photosync.Duration(10 * time.Millisecond)
+	return cfg
+}
+
+// A temp dir removed when the test is done
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "photosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// Write each file with its content, making the folders they go in
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func openState(t *testing.T, dir string) *photosync.SyncState {
+	state, err := photosync.OpenSyncState(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { state.Close() })
+	return state
+}
+
+// The counts from one run of Sync
+type counts struct {
+	renamed, existing, uploaded, failed int
+}
+
+// Run Sync against what's on the server now, failing the test on an error
+func runSync(t *testing.T, api *photosync.FlickrAPI, cfg *photosync.PhotosyncConfig, state *photosync.SyncState, out *lockedBuffer) counts {
+	user, err := api.GetLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	photos, videos, err := photosync.RefreshLibrary(api, state, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albums, err := api.GetAlbums(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, e, up, er, err := photosync.Sync(api, cfg, state, photos, videos, albums, &photosync.Options{Out: out, Jobs: 2})
+	if err != nil {
+		t.Fatal(err, out.String())
+	}
+	return counts{r, e, up, er}
+}
+
+// The photo on the server with the title
+func photoTitled(t *testing.T, srv *photosynctest.Server, title string) photosynctest.Photo {
+	for _, p := range srv.Photos() {
+		if p.Title == title {
+			return p
+		}
+	}
+	t.Fatalf("no photo titled %q on the server", title)
+	return photosynctest.Photo{}
+}
+
+func TestSync(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	dir := tempDir(t)
+	watch := filepath.Join(dir, "watch")
+	writeFiles(t, watch, map[string]string{
+		"a/IMG_1.JPG": "one",
+		"b/IMG_2.JPG": "two",
+		"b/clip.MOV":  "vid",
+		"b/copy.JPG":  "one", // same content as a/IMG_1.JPG
+		"b/notes.txt": "not a photo",
+	})
+	srv.AddAlbum("Alb")
+
+	cfg := testConfig(srv)
+	cfg.WatchDir = []photosync.WatchDirConfig{{Dir: watch, Tags: "t1", Albums: []string{"Alb"}}}
+	cfg.WatchDir[0].CreateTemplates()
+	api := photosync.NewFlickrAPI(&cfg)
+	state := openState(t, dir)
+
+	var out lockedBuffer
+	got := runSync(t, api, &cfg, state, &out)
+	if got.uploaded != 3 || got.failed != 0 {
+		t.Fatalf("first sync %+v\n%s", got, out.String())
+	}
+	if p := photoTitled(t, srv, "clip"); p.Media != "video" {
+		t.Error("clip uploaded as", p.Media)
+	}
+	for _, p := range srv.Photos() {
+		if len(p.Tags) == 0 || p.Tags[0] != "t1" {
+			t.Errorf("%s tags %v", p.Title, p.Tags)
+		}
+	}
+	albums := srv.Albums()
+	if len(albums) != 1 || len(albums[0].PhotoIds) != 3 {
+		t.Fatalf("albums %+v", albums)
+	}
+
+	out.Reset()
+	got = runSync(t, api, &cfg, state, &out)
+	if got.uploaded != 0 || got.failed != 0 {
+		t.Fatalf("second sync %+v\n%s", got, out.String())
+	}
+	if n := len(srv.Photos()); n != 3 {
+		t.Fatal("photos on the server", n)
+	}
+
+	// without a state db the titles and content hashes are enough
+	out.Reset()
+	got = runSync(t, api, &cfg, nil, &out)
+	if got.uploaded != 0 || got.failed != 0 {
+		t.Fatalf("sync without state %+v\n%s", got, out.String())
+	}
+}
+
+// Without uploads nothing is hashed or linked, a title on Flickr is enough
+func TestSyncNoUpload(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"a.JPG": "one", "b.JPG": "two"})
+	srv.AddPhoto("a", "photo")
+
+	cfg := testConfig(srv)
+	cfg.WatchDir = []photosync.WatchDirConfig{{Dir: dir}}
+	cfg.WatchDir[0].CreateTemplates()
+	api := photosync.NewFlickrAPI(&cfg)
+	state := openState(t, dir)
+	user, err := api.GetLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	photos, videos, err := photosync.LoadLibrary(api, state, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out lockedBuffer
+	_, ex, up, er, err := photosync.Sync(api, &cfg, state, photos, videos, &photosync.AlbumsMap{}, &photosync.Options{Out: &out, NoUpload: true})
+	if err != nil || ex != 1 || up != 0 || er != 0 {
+		t.Fatalf("%d existing %d uploaded %d failed %v\n%s", ex, up, er, err, out.String())
+	}
+	if n := len(srv.Photos()); n != 1 {
+		t.Fatal("photos on the server", n)
+	}
+	for _, name := range []string{"a.JPG", "b.JPG"} {
+		if rec, _ := state.GetFile(filepath.Join(dir, name)); rec != nil {
+			t.Fatalf("%s recorded %+v", name, rec)
+		}
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	dir := tempDir(t)
+	watch := filepath.Join(dir, "watch")
+	writeFiles(t, watch, map[string]string{
+		"IMG_20160501_101010.JPG": "one",
+		"clip.MOV":                "vid",
+		"copy.JPG":                "one",
+	})
+	srv.AddAlbum("Alb")
+
+	cfg := testConfig(srv)
+	cfg.FilenameTimeFormats = []photosync.FilenameTimeFormat{{Format: "20060102_150405", Prefix: []string{"IMG_"}}}
+	cfg.WatchDir = []photosync.WatchDirConfig{{Dir: watch, Albums: []string{"Alb"}}}
+	cfg.WatchDir[0].CreateTemplates()
+	api := photosync.NewFlickrAPI(&cfg)
+	state := openState(t, dir)
+	user, err := api.GetLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func() (*photosync.PhotosMap, *photosync.PhotosMap, *photosync.AlbumsMap) {
+		photos, videos, err := photosync.LoadLibrary(api, state, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		albums, err := api.GetAlbums(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return photos, videos, albums
+	}
+
+	var out lockedBuffer
+	photos, videos, albums := load()
+	plan, err := photosync.PlanSync(&cfg, state, photos, videos, albums, &photosync.Options{Out: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Photos()); n != 0 {
+		t.Fatal("planning uploaded", n)
+	}
+	if n := plan.Count(photosync.ActionUpload); n != 2 {
+		t.Fatal("uploads planned", n)
+	}
+
+	// a plan saved by one run is carried out by another
+	var buf bytes.Buffer
+	if err := plan.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "plan.json")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := photosync.ReadPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	photos, videos, albums = load()
+	_, _, up, er, err := photosync.ApplyPlan(api, &cfg, state, photos, videos, albums, saved, &photosync.Options{Out: &out, Jobs: 2})
+	if err != nil || up != 2 || er != 0 {
+		t.Fatalf("apply %d uploaded %d failed %v\n%s", up, er, err, out.String())
+	}
+	if p := photoTitled(t, srv, "IMG_20160501_101010"); p.DateTaken != "2016-05-01 10:10:10" {
+		t.Error("date taken", p.DateTaken)
+	}
+	if a := srv.Albums(); len(a) != 1 || len(a[0].PhotoIds) != 2 {
+		t.Errorf("albums %+v", a)
+	}
+
+	photos, videos, albums = load()
+	plan, err = photosync.PlanSync(&cfg, state, photos, videos, albums, &photosync.Options{Out: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := plan.Count(photosync.ActionUpload); n != 0 {
+		t.Fatal("uploads planned again", n)
+	}
+
+	// planning leaves the state db alone, even for files that changed or
+	// photos gone from Flickr
+	records := func() map[string]photosync.FileState {
+		recs := map[string]photosync.FileState{}
+		state.Files(func(rec *photosync.FileState) error {
+			recs[rec.Path] = *rec
+			return nil
+		})
+		return recs
+	}
+	before := records()
+	writeFiles(t, watch, map[string]string{"copy.JPG": "changed"})
+	srv.RemovePhoto(photoTitled(t, srv, "clip").Id)
+	if _, _, err := photosync.RefreshLibrary(api, state, user); err != nil {
+		t.Fatal(err)
+	}
+	cfg.TwoWay.Enabled = true
+	photos, videos, albums = load()
+	if _, err := photosync.PlanSync(&cfg, state, photos, videos, albums, &photosync.Options{Out: &out}); err != nil {
+		t.Fatal(err)
+	}
+	if after := records(); !reflect.DeepEqual(before, after) {
+		t.Fatalf("planning changed the state db\n%+v\n%+v", before, after)
+	}
+
+	// plans that can't be carried out are turned away when read
+	ioutil.WriteFile(path, []byte(`{"actions":[{"type":"add-tags","path":"x","tags":"a"}]}`), 0644)
+	if _, err := photosync.ReadPlan(path); err == nil {
+		t.Fatal("read a plan tagging a photo it doesn't know")
+	}
+}
+
+// An io.Writer the upload workers can share
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (this *lockedBuffer) Write(p []byte) (int, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.b.Write(p)
+}
+
+func (this *lockedBuffer) String() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.b.String()
+}
+
+func (this *lockedBuffer) Reset() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.b.Reset()
+}
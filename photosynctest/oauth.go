@@ -0,0 +1,126 @@
+package photosynctest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A request token handed out by the fake OAuth endpoints
+type oauthToken struct {
+	secret   string
+	callback string
+	perms    string
+	verifier string // set once the user "approves" it
+}
+
+// GrantedPerms returns the perms asked for by the last authorization to go through
+func (s *Server) GrantedPerms() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.grantedPerms
+}
+
+// oauthParams merges the oauth_ parameters from the Authorization header with the form
+func oauthParams(r *http.Request) url.Values {
+	r.ParseForm()
+	params := url.Values{}
+	for k, v := range r.Form {
+		params[k] = v
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "OAuth ") {
+		return params
+	}
+	for _, kv := range strings.Split(header[len("OAuth "):], ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		v, err := url.QueryUnescape(strings.Trim(parts[1], "\""))
+		if err != nil {
+			continue
+		}
+		params.Set(parts[0], v)
+	}
+	return params
+}
+
+func (s *Server) handleRequestToken(w http.ResponseWriter, r *http.Request) {
+	params := oauthParams(r)
+	callback := params.Get("oauth_callback")
+	if len(callback) == 0 {
+		http.Error(w, "oauth_problem=parameter_absent&oauth_parameters_absent=oauth_callback", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.calls["oauth.request_token"]++
+	token := "request-" + s.newId()
+	s.tokens[token] = &oauthToken{secret: "request-secret", callback: callback}
+	s.mu.Unlock()
+
+	fmt.Fprintf(w, "oauth_callback_confirmed=true&oauth_token=%s&oauth_token_secret=request-secret", token)
+}
+
+// Stands in for the page where the user approves the app. It approves right
+// away and either redirects to the callback or shows the verifier.
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	s.mu.Lock()
+	s.calls["oauth.authorize"]++
+	tok, ok := s.tokens[q.Get("oauth_token")]
+	if !ok {
+		s.mu.Unlock()
+		http.Error(w, "unknown oauth_token", http.StatusBadRequest)
+		return
+	}
+	tok.perms = q.Get("perms")
+	tok.verifier = "verifier-" + s.newId()
+	s.mu.Unlock()
+
+	if tok.callback == "oob" {
+		fmt.Fprintln(w, tok.verifier)
+		return
+	}
+
+	u, err := url.Parse(tok.callback)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cq := u.Query()
+	cq.Set("oauth_token", q.Get("oauth_token"))
+	cq.Set("oauth_verifier", tok.verifier)
+	u.RawQuery = cq.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (s *Server) handleAccessToken(w http.ResponseWriter, r *http.Request) {
+	params := oauthParams(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["oauth.access_token"]++
+	tok, ok := s.tokens[params.Get("oauth_token")]
+	if !ok || len(tok.verifier) == 0 || tok.verifier != params.Get("oauth_verifier") {
+		http.Error(w, "oauth_problem=token_rejected", http.StatusUnauthorized)
+		return
+	}
+	delete(s.tokens, params.Get("oauth_token"))
+	s.grantedPerms = tok.perms
+
+	vals := url.Values{
+		"fullname":           {"Photo Sync Test"},
+		"oauth_token":        {"access-token"},
+		"oauth_token_secret": {"access-secret"},
+		"user_nsid":          {s.UserId},
+		"username":           {s.Username},
+	}
+	fmt.Fprint(w, vals.Encode())
+}
@@ -0,0 +1,886 @@
+// Package photosynctest provides an in-process fake of the Flickr REST, upload
+// and OAuth services so the photosync pipeline can be exercised offline.
+//
+//	srv := photosynctest.NewServer()
+//	defer srv.Close()
+//
+//	config := srv.Config()
+//	api := photosync.NewFlickrAPI(&config)
+package photosynctest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Reisender/photosync"
+)
+
+// page sizes used when the request doesn't ask for one
+const defaultPerPage = 100
+const maxPerPage = 500
+
+// Photo is the server side record of an uploaded photo or video
+type Photo struct {
+	Id        string
+	Title     string
+	Media     string // "photo" or "video"
+	Tags      []string
+	DateTaken string
+	Filename  string
+	Size      int64
+	Content   []byte
+	Uploaded  time.Time
+
+	// set by geo.setLocation, Accuracy is 0 when there's no location
+	Latitude  float64
+	Longitude float64
+	Accuracy  int
+
+	// set by photos.setPerms, everyone can see it when all are false
+	Private bool
+	Friend  bool
+	Family  bool
+}
+
+// Album is the server side record of a photoset
+type Album struct {
+	Id       string
+	Title    string
+	Primary  string
+	PhotoIds []string
+}
+
+// Server is a fake Flickr API backed by an httptest.Server
+type Server struct {
+	*httptest.Server
+
+	UserId   string
+	Username string
+
+	// MaxPerPage caps the page size handed back to clients so tests can force paging
+	MaxPerPage int
+
+	// UploadDelay holds every upload up after it arrives, like a slow connection
+	UploadDelay time.Duration
+
+	mu     sync.Mutex
+	nextId int
+	photos []*Photo // in upload order
+	albums []*Album
+	calls  map[string]int
+	fails  map[string][]int // queued failure statuses by method
+	losses map[string][]int // queued statuses answering calls that went through
+
+	tokens       map[string]*oauthToken // outstanding request tokens
+	grantedPerms string
+}
+
+// NewServer starts a fake Flickr server. Call Close when done with it.
+func NewServer() *Server {
+	s := &Server{
+		UserId:     "12345678@N00",
+		Username:   "photosynctest",
+		MaxPerPage: maxPerPage,
+		nextId:     1000,
+		calls:      make(map[string]int),
+		fails:      make(map[string][]int),
+		losses:     make(map[string][]int),
+		tokens:     make(map[string]*oauthToken),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services/rest", s.handleRest)
+	mux.HandleFunc("/services/rest/", s.handleRest)
+	mux.HandleFunc("/services/upload/", s.handleUpload)
+	mux.HandleFunc("/originals/", s.handleOriginal)
+	mux.HandleFunc("/services/oauth/request_token", s.handleRequestToken)
+	mux.HandleFunc("/services/oauth/authorize", s.handleAuthorize)
+	mux.HandleFunc("/services/oauth/access_token", s.handleAccessToken)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// ApiBase is the value to use for PhotosyncConfig.ApiBase
+func (s *Server) ApiBase() string {
+	return s.URL + "/services"
+}
+
+// Config returns a config pointed at this server with dummy credentials
+func (s *Server) Config() photosync.PhotosyncConfig {
+	config := photosync.PhotosyncConfig{ApiBase: s.ApiBase()}
+	config.Consumer.Token = "consumer-key"
+	config.Consumer.Secret = "consumer-secret"
+	config.Access.Token = "access-token"
+	config.Access.Secret = "access-secret"
+	return config
+}
+
+// AddPhoto seeds the server with an existing photo or video
+func (s *Server) AddPhoto(title, media string) *Photo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := &Photo{Id: s.newId(), Title: title, Media: media, Uploaded: time.Now()}
+	s.photos = append(s.photos, p)
+	return p
+}
+
+// RemovePhoto deletes a photo or video as if it was deleted on Flickr,
+// taking it out of any albums too
+func (s *Server) RemovePhoto(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.removePhoto(id)
+}
+
+// Take a photo off the server and out of its albums. Called with s.mu held.
+func (s *Server) removePhoto(id string) bool {
+	for i, p := range s.photos {
+		if p.Id != id {
+			continue
+		}
+		s.photos = append(s.photos[:i], s.photos[i+1:]...)
+		for _, a := range s.albums {
+			for j, pid := range a.PhotoIds {
+				if pid == id {
+					a.PhotoIds = append(a.PhotoIds[:j], a.PhotoIds[j+1:]...)
+					break
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// SetTitle retitles a photo or video as if it was edited on Flickr
+func (s *Server) SetTitle(id, title string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p := s.findPhoto(id); p != nil {
+		p.Title = title
+		return true
+	}
+	return false
+}
+
+// AddAlbum seeds the server with an existing album containing the given photos
+func (s *Server) AddAlbum(title string, photoIds ...string) *Album {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := &Album{Id: s.newId(), Title: title, PhotoIds: append([]string{}, photoIds...)}
+	if len(photoIds) > 0 {
+		a.Primary = photoIds[0]
+	}
+	s.albums = append(s.albums, a)
+	return a
+}
+
+// Photos returns a copy of all the photos and videos on the server
+func (s *Server) Photos() []Photo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	photos := make([]Photo, len(s.photos))
+	for i, p := range s.photos {
+		photos[i] = *p
+		photos[i].Tags = append([]string{}, p.Tags...)
+	}
+	return photos
+}
+
+// Photo returns a copy of the photo with the given id
+func (s *Server) Photo(id string) (Photo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p := s.findPhoto(id); p != nil {
+		cp := *p
+		cp.Tags = append([]string{}, p.Tags...)
+		return cp, true
+	}
+	return Photo{}, false
+}
+
+// Albums returns a copy of all the albums on the server
+func (s *Server) Albums() []Album {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	albums := make([]Album, len(s.albums))
+	for i, a := range s.albums {
+		albums[i] = *a
+		albums[i].PhotoIds = append([]string{}, a.PhotoIds...)
+	}
+	return albums
+}
+
+// Calls returns how many times the given API method (or "upload", or
+// "oauth.request_token" and the like) has been called
+func (s *Server) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[method]
+}
+
+// FailNext makes the next n calls to method (or "upload") fail with the given
+// HTTP status. A status of http.StatusOK fails with Flickr's "service currently
+// unavailable" error instead.
+func (s *Server) FailNext(method string, n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		s.fails[method] = append(s.fails[method], status)
+	}
+}
+
+// LoseNext makes the next n calls to method go through but answer with the
+// given HTTP status, like a response lost on the way back
+func (s *Server) LoseNext(method string, n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		s.losses[method] = append(s.losses[method], status)
+	}
+}
+
+// Pop a queued failure for the method. Called with s.mu held.
+func (s *Server) nextFailure(method string) (int, bool) {
+	return pop(s.fails, method)
+}
+
+// Pop a queued lost response for the method. Called with s.mu held.
+func (s *Server) nextLoss(method string) (int, bool) {
+	return pop(s.losses, method)
+}
+
+func pop(queues map[string][]int, method string) (int, bool) {
+	queued := queues[method]
+	if len(queued) == 0 {
+		return 0, false
+	}
+	queues[method] = queued[1:]
+	return queued[0], true
+}
+
+// ***** Handlers *****
+
+type restHandler func(s *Server, form url.Values) (interface{}, *apiError)
+
+var restMethods = map[string]restHandler{
+	"flickr.test.login":                (*Server).testLogin,
+	"flickr.photos.search":             (*Server).photosSearch,
+	"flickr.photos.getInfo":            (*Server).photosGetInfo,
+	"flickr.photos.getSizes":           (*Server).photosGetSizes,
+	"flickr.photos.addTags":            (*Server).photosAddTags,
+	"flickr.photos.setDates":           (*Server).photosSetDates,
+	"flickr.photos.setMeta":            (*Server).photosSetMeta,
+	"flickr.photos.setPerms":           (*Server).photosSetPerms,
+	"flickr.photos.delete":             (*Server).photosDelete,
+	"flickr.photos.geo.setLocation":    (*Server).photosGeoSetLocation,
+	"flickr.photosets.getList":         (*Server).photosetsGetList,
+	"flickr.photosets.getPhotos":       (*Server).photosetsGetPhotos,
+	"flickr.photosets.addPhoto":        (*Server).photosetsAddPhoto,
+	"flickr.photosets.setPrimaryPhoto": (*Server).photosetsSetPrimaryPhoto,
+	"flickr.photosets.reorderPhotos":   (*Server).photosetsReorderPhotos,
+}
+
+type apiError struct {
+	Code    int
+	Message string
+}
+
+func (s *Server) handleRest(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	method := r.Form.Get("method")
+
+	s.mu.Lock()
+	s.calls[method]++
+	if status, failed := s.nextFailure(method); failed {
+		s.mu.Unlock()
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+		} else {
+			writeJSON(w, nil, &apiError{105, "Service currently unavailable"})
+		}
+		return
+	}
+	handler, ok := restMethods[method]
+	var data interface{}
+	var apiErr *apiError
+	if ok {
+		data, apiErr = handler(s, r.Form)
+	} else {
+		apiErr = &apiError{112, fmt.Sprintf("Method \"%s\" not found", method)}
+	}
+	status, lost := s.nextLoss(method)
+	s.mu.Unlock()
+
+	if lost {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	writeJSON(w, data, apiErr)
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "upload requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p := &Photo{Media: "photo"}
+	var gotFile bool
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b, err := io.ReadAll(part)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch part.FormName() {
+		case "photo":
+			gotFile = true
+			p.Filename = part.FileName()
+			p.Content = b
+			p.Size = int64(len(b))
+		case "title":
+			p.Title = string(b)
+		case "tags":
+			p.Tags = strings.Fields(string(b))
+		}
+	}
+
+	if s.UploadDelay > 0 {
+		select {
+		case <-time.After(s.UploadDelay):
+		case <-r.Context().Done():
+			return // the client gave up
+		}
+	}
+
+	s.mu.Lock()
+	s.calls["upload"]++
+	if status, failed := s.nextFailure("upload"); failed {
+		s.mu.Unlock()
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+		} else {
+			writeUploadFail(w, 105, "Service currently unavailable")
+		}
+		return
+	}
+	if !gotFile {
+		s.mu.Unlock()
+		writeUploadFail(w, 2, "No photo specified")
+		return
+	}
+
+	ext := filepath.Ext(p.Filename)
+	if p.Title == "" {
+		p.Title = p.Filename[:len(p.Filename)-len(ext)]
+	}
+	switch strings.ToLower(ext) {
+	case ".mov", ".mp4", ".m4v", ".avi", ".3gp", ".mts":
+		p.Media = "video"
+	}
+	p.Id = s.newId()
+	p.Uploaded = time.Now()
+	s.photos = append(s.photos, p)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\" ?>\n<rsp stat=\"ok\">\n<photoid>%s</photoid>\n</rsp>\n", p.Id)
+}
+
+// Serve the content of an upload like the static photo hosts do, with
+// ranges for resuming downloads
+func (s *Server) handleOriginal(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/originals/")
+
+	s.mu.Lock()
+	s.calls["original"]++
+	status, failed := s.nextFailure("original")
+	p := s.findPhoto(id)
+	var content []byte
+	var modified time.Time
+	if p != nil {
+		content, modified = p.Content, p.Uploaded
+	}
+	s.mu.Unlock()
+
+	if failed {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeContent(w, r, "", modified, bytes.NewReader(content))
+}
+
+// ***** REST methods *****
+// these are all called with s.mu held
+
+func (s *Server) testLogin(form url.Values) (interface{}, *apiError) {
+	return map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":       s.UserId,
+			"username": content(s.Username),
+		},
+	}, nil
+}
+
+func (s *Server) photosSearch(form url.Values) (interface{}, *apiError) {
+	if uid := form.Get("user_id"); uid != "" && uid != "me" && uid != s.UserId {
+		return nil, &apiError{2, "Unknown user"}
+	}
+
+	var minUpload int64
+	if v := form.Get("min_upload_date"); v != "" {
+		minUpload, _ = strconv.ParseInt(v, 10, 64)
+	}
+
+	var matches []*Photo
+	// newest first like the real search
+	for i := len(s.photos) - 1; i >= 0; i-- {
+		p := s.photos[i]
+		switch form.Get("media") {
+		case "photos":
+			if p.Media != "photo" {
+				continue
+			}
+		case "videos":
+			if p.Media != "video" {
+				continue
+			}
+		}
+		if p.Uploaded.Unix() < minUpload {
+			continue
+		}
+		matches = append(matches, p)
+	}
+
+	start, end, info := s.paginate(form, len(matches))
+	list := []interface{}{}
+	for _, p := range matches[start:end] {
+		list = append(list, s.photoJSON(p))
+	}
+	info["photo"] = list
+
+	return map[string]interface{}{"photos": info}, nil
+}
+
+func (s *Server) photosGetInfo(form url.Values) (interface{}, *apiError) {
+	p := s.findPhoto(form.Get("photo_id"))
+	if p == nil {
+		return nil, &apiError{1, "Photo not found"}
+	}
+
+	return map[string]interface{}{
+		"photo": map[string]interface{}{
+			"id":             p.Id,
+			"secret":         "abcdef",
+			"originalformat": originalFormat(p),
+			"rotation":       0,
+			"media":          p.Media,
+			"title":          content(p.Title),
+			"dates":          map[string]interface{}{"taken": dateTaken(p)},
+		},
+	}, nil
+}
+
+func (s *Server) photosGetSizes(form url.Values) (interface{}, *apiError) {
+	p := s.findPhoto(form.Get("photo_id"))
+	if p == nil {
+		return nil, &apiError{1, "Photo not found"}
+	}
+
+	label := "Original"
+	if p.Media == "video" {
+		label = "Video Original"
+	}
+	return map[string]interface{}{
+		"sizes": map[string]interface{}{
+			"size": []interface{}{
+				map[string]interface{}{"label": "Thumbnail", "source": s.URL + "/originals/" + p.Id + "?thumb", "media": p.Media},
+				map[string]interface{}{"label": label, "source": s.URL + "/originals/" + p.Id, "media": p.Media},
+			},
+		},
+	}, nil
+}
+
+func (s *Server) photosAddTags(form url.Values) (interface{}, *apiError) {
+	p := s.findPhoto(form.Get("photo_id"))
+	if p == nil {
+		return nil, &apiError{1, "Photo not found"}
+	}
+
+	for _, tag := range strings.Fields(form.Get("tags")) {
+		if !contains(p.Tags, tag) {
+			p.Tags = append(p.Tags, tag)
+		}
+	}
+	return nil, nil
+}
+
+func (s *Server) photosSetDates(form url.Values) (interface{}, *apiError) {
+	p := s.findPhoto(form.Get("photo_id"))
+	if p == nil {
+		return nil, &apiError{1, "Photo not found"}
+	}
+
+	if d := form.Get("date_taken"); d != "" {
+		p.DateTaken = d
+	}
+	return nil, nil
+}
+
+func (s *Server) photosGeoSetLocation(form url.Values) (interface{}, *apiError) {
+	p := s.findPhoto(form.Get("photo_id"))
+	if p == nil {
+		return nil, &apiError{1, "Photo not found"}
+	}
+
+	lat, err := strconv.ParseFloat(form.Get("lat"), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return nil, &apiError{2, "Required arguments missing"}
+	}
+	lon, err := strconv.ParseFloat(form.Get("lon"), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return nil, &apiError{2, "Required arguments missing"}
+	}
+	accuracy := 16
+	if a := form.Get("accuracy"); a != "" {
+		if accuracy, err = strconv.Atoi(a); err != nil || accuracy < 1 || accuracy > 16 {
+			accuracy = 16
+		}
+	}
+
+	p.Latitude, p.Longitude, p.Accuracy = lat, lon, accuracy
+	return nil, nil
+}
+
+func (s *Server) photosSetMeta(form url.Values) (interface{}, *apiError) {
+	p := s.findPhoto(form.Get("photo_id"))
+	if p == nil {
+		return nil, &apiError{1, "Photo not found"}
+	}
+
+	p.Title = form.Get("title")
+	return nil, nil
+}
+
+func (s *Server) photosSetPerms(form url.Values) (interface{}, *apiError) {
+	p := s.findPhoto(form.Get("photo_id"))
+	if p == nil {
+		return nil, &apiError{1, "Photo not found"}
+	}
+
+	p.Private = form.Get("is_public") != "1"
+	p.Friend = form.Get("is_friend") == "1"
+	p.Family = form.Get("is_family") == "1"
+	return nil, nil
+}
+
+func (s *Server) photosDelete(form url.Values) (interface{}, *apiError) {
+	if s.grantedPerms != "" && s.grantedPerms != "delete" {
+		return nil, &apiError{99, "Insufficient permissions. Method requires delete privileges; write granted."}
+	}
+
+	id := form.Get("photo_id")
+	if s.findPhoto(id) == nil {
+		return nil, &apiError{1, "Photo not found"}
+	}
+	s.removePhoto(id)
+	return nil, nil
+}
+
+func (s *Server) photosetsGetList(form url.Values) (interface{}, *apiError) {
+	start, end, info := s.paginate(form, len(s.albums))
+	list := []interface{}{}
+	for _, a := range s.albums[start:end] {
+		list = append(list, map[string]interface{}{
+			"id":          a.Id,
+			"primary":     a.Primary,
+			"photos":      len(a.PhotoIds),
+			"title":       content(a.Title),
+			"description": content(""),
+		})
+	}
+	info["photoset"] = list
+
+	return map[string]interface{}{"photosets": info}, nil
+}
+
+func (s *Server) photosetsGetPhotos(form url.Values) (interface{}, *apiError) {
+	a := s.findAlbum(form.Get("photoset_id"))
+	if a == nil {
+		return nil, &apiError{1, "Photoset not found"}
+	}
+
+	start, end, info := s.paginate(form, len(a.PhotoIds))
+	list := []interface{}{}
+	for _, id := range a.PhotoIds[start:end] {
+		if p := s.findPhoto(id); p != nil {
+			pj := s.photoJSON(p)
+			pj["isprimary"] = boolInt(id == a.Primary)
+			list = append(list, pj)
+		}
+	}
+	info["id"] = a.Id
+	info["primary"] = a.Primary
+	info["owner"] = s.UserId
+	info["title"] = a.Title
+	info["photo"] = list
+
+	return map[string]interface{}{"photoset": info}, nil
+}
+
+func (s *Server) photosetsAddPhoto(form url.Values) (interface{}, *apiError) {
+	a := s.findAlbum(form.Get("photoset_id"))
+	if a == nil {
+		return nil, &apiError{1, "Photoset not found"}
+	}
+	id := form.Get("photo_id")
+	if s.findPhoto(id) == nil {
+		return nil, &apiError{2, "Photo not found"}
+	}
+	if contains(a.PhotoIds, id) {
+		return nil, &apiError{3, "Photo already in set"}
+	}
+
+	a.PhotoIds = append(a.PhotoIds, id)
+	return nil, nil
+}
+
+func (s *Server) photosetsSetPrimaryPhoto(form url.Values) (interface{}, *apiError) {
+	a := s.findAlbum(form.Get("photoset_id"))
+	if a == nil {
+		return nil, &apiError{1, "Photoset not found"}
+	}
+	id := form.Get("photo_id")
+	if !contains(a.PhotoIds, id) {
+		return nil, &apiError{2, "Photo not found"}
+	}
+
+	a.Primary = id
+	return nil, nil
+}
+
+func (s *Server) photosetsReorderPhotos(form url.Values) (interface{}, *apiError) {
+	a := s.findAlbum(form.Get("photoset_id"))
+	if a == nil {
+		return nil, &apiError{1, "Photoset not found"}
+	}
+
+	// listed photos move to the front in the given order, the rest keep their order
+	var order []string
+	for _, id := range strings.Split(form.Get("photo_ids"), ",") {
+		if id == "" || !contains(a.PhotoIds, id) {
+			return nil, &apiError{2, "Photo not found"}
+		}
+		if !contains(order, id) {
+			order = append(order, id)
+		}
+	}
+	for _, id := range a.PhotoIds {
+		if !contains(order, id) {
+			order = append(order, id)
+		}
+	}
+	a.PhotoIds = order
+	return nil, nil
+}
+
+// ***** Helpers *****
+
+func (s *Server) newId() string {
+	s.nextId++
+	return strconv.Itoa(s.nextId)
+}
+
+func (s *Server) findPhoto(id string) *Photo {
+	for _, p := range s.photos {
+		if p.Id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *Server) findAlbum(id string) *Album {
+	for _, a := range s.albums {
+		if a.Id == id {
+			return a
+		}
+	}
+	return nil
+}
+
+func (s *Server) photoJSON(p *Photo) map[string]interface{} {
+	var machineTags []string
+	for _, tag := range p.Tags {
+		if strings.Contains(tag, ":") && strings.Contains(tag, "=") {
+			machineTags = append(machineTags, tag)
+		}
+	}
+
+	return map[string]interface{}{
+		"id":       p.Id,
+		"owner":    s.UserId,
+		"secret":   "abcdef",
+		"server":   "1",
+		"farm":     1,
+		"title":    p.Title,
+		"ispublic": boolInt(!p.Private),
+		"isfriend": boolInt(p.Friend),
+		"isfamily": boolInt(p.Family),
+		// only sent by the real api when asked for in extras but harmless to always include
+		"machine_tags":   strings.Join(machineTags, " "),
+		"datetaken":      dateTaken(p),
+		"originalformat": originalFormat(p),
+		"media":          p.Media,
+	}
+}
+
+// The date taken the way Flickr shows it, the upload time when it wasn't set
+func dateTaken(p *Photo) string {
+	if p.DateTaken != "" {
+		return p.DateTaken
+	}
+	return p.Uploaded.Format("2006-01-02 15:04:05")
+}
+
+// The extension of the uploaded file without the dot
+func originalFormat(p *Photo) string {
+	if ext := filepath.Ext(p.Filename); ext != "" {
+		return strings.ToLower(ext[1:])
+	}
+	if p.Media == "video" {
+		return "mp4"
+	}
+	return "jpg"
+}
+
+// Work out the slice bounds for the requested page along with the paging info
+// in the same shape (and with the same mix of ints and strings) as Flickr.
+func (s *Server) paginate(form url.Values, total int) (int, int, map[string]interface{}) {
+	perPage, err := strconv.Atoi(form.Get("per_page"))
+	if err != nil || perPage <= 0 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	if s.MaxPerPage > 0 && perPage > s.MaxPerPage {
+		perPage = s.MaxPerPage
+	}
+
+	pages := (total + perPage - 1) / perPage
+	if pages == 0 {
+		pages = 1
+	}
+
+	page, err := strconv.Atoi(form.Get("page"))
+	if err != nil || page <= 0 {
+		page = 1
+	}
+
+	start := (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+
+	return start, end, map[string]interface{}{
+		"page":    page,
+		"pages":   pages,
+		"perpage": perPage,
+		"total":   strconv.Itoa(total),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}, apiErr *apiError) {
+	resp := map[string]interface{}{}
+	if apiErr != nil {
+		resp["stat"] = "fail"
+		resp["code"] = apiErr.Code
+		resp["message"] = apiErr.Message
+	} else {
+		if m, ok := data.(map[string]interface{}); ok {
+			for k, v := range m {
+				resp[k] = v
+			}
+		}
+		resp["stat"] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeUploadFail(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\" ?>\n<rsp stat=\"fail\">\n<err code=\"%d\" msg=\"%s\" />\n</rsp>\n", code, msg)
+}
+
+func content(s string) map[string]string {
+	return map[string]string{"_content": s}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package photosynctest_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Reisender/photosync/photosynctest"
+)
+
+// Call a REST method and decode the JSON answer
+func call(t *testing.T, srv *photosynctest.Server, method string, args url.Values) (int, map[string]interface{}) {
+	if args == nil {
+		args = url.Values{}
+	}
+	args.Set("method", method)
+	args.Set("format", "json")
+	args.Set("nojsoncallback", "1")
+	resp, err := http.Get(srv.ApiBase() + "/rest/?" + args.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	data := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+// Upload a file the way the upload endpoint takes it
+func upload(t *testing.T, srv *photosynctest.Server, filename, title, content string) (int, string) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if len(title) > 0 {
+		w.WriteField("title", title)
+	}
+	fw, _ := w.CreateFormFile("photo", filename)
+	fw.Write([]byte(content))
+	w.Close()
+
+	resp, err := http.Post(srv.ApiBase()+"/upload/", w.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestSearchPages(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	srv.MaxPerPage = 2
+	for _, title := range []string{"a", "b", "c", "d", "e"} {
+		srv.AddPhoto(title, "photo")
+	}
+	srv.AddPhoto("clip", "video")
+
+	var titles []string
+	for page := 1; page <= 3; page++ {
+		_, data := call(t, srv, "flickr.photos.search", url.Values{"media": {"photos"}, "per_page": {"500"}, "page": {strconv.Itoa(page)}})
+		photos := data["photos"].(map[string]interface{})
+		if photos["pages"].(float64) != 3 || photos["total"] != "5" {
+			t.Fatalf("page %d info %v", page, photos)
+		}
+		for _, p := range photos["photo"].([]interface{}) {
+			titles = append(titles, p.(map[string]interface{})["title"].(string))
+		}
+	}
+	// newest first
+	if got := strings.Join(titles, ","); got != "e,d,c,b,a" {
+		t.Fatal("titles", got)
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	srv.FailNext("flickr.test.login", 1, http.StatusBadGateway)
+	srv.FailNext("flickr.test.login", 1, http.StatusOK)
+
+	if status, _ := call(t, srv, "flickr.test.login", nil); status != http.StatusBadGateway {
+		t.Fatal("status", status)
+	}
+	if _, data := call(t, srv, "flickr.test.login", nil); data["stat"] != "fail" || data["code"].(float64) != 105 {
+		t.Fatal("api failure", data)
+	}
+	if _, data := call(t, srv, "flickr.test.login", nil); data["stat"] != "ok" {
+		t.Fatal("after the failures", data)
+	}
+	if n := srv.Calls("flickr.test.login"); n != 3 {
+		t.Fatal("calls", n)
+	}
+
+	if _, data := call(t, srv, "flickr.no.such.method", nil); data["code"].(float64) != 112 {
+		t.Fatal("unknown method", data)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+
+	status, body := upload(t, srv, "beach.jpg", "", "AAA")
+	if status != http.StatusOK || !strings.Contains(body, "<photoid>1001</photoid>") {
+		t.Fatal("upload", status, body)
+	}
+	upload(t, srv, "clip.MOV", "My clip", "BBB")
+
+	photos := srv.Photos()
+	if len(photos) != 2 {
+		t.Fatal("photos", len(photos))
+	}
+	if p := photos[0]; p.Title != "beach" || p.Media != "photo" || string(p.Content) != "AAA" {
+		t.Fatalf("photo %+v", p)
+	}
+	if p := photos[1]; p.Title != "My clip" || p.Media != "video" {
+		t.Fatalf("video %+v", p)
+	}
+
+	srv.FailNext("upload", 1, http.StatusOK)
+	if _, body := upload(t, srv, "x.jpg", "", "x"); !strings.Contains(body, `code="105"`) {
+		t.Fatal("failed upload", body)
+	}
+	if n := len(srv.Photos()); n != 2 || srv.Calls("upload") != 3 {
+		t.Fatal("failed upload kept", n, srv.Calls("upload"))
+	}
+}
+
+func TestAlbums(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	a := srv.AddPhoto("a", "photo")
+	b := srv.AddPhoto("b", "photo")
+	album := srv.AddAlbum("Trip", a.Id)
+
+	if _, data := call(t, srv, "flickr.photosets.addPhoto", url.Values{"photoset_id": {album.Id}, "photo_id": {b.Id}}); data["stat"] != "ok" {
+		t.Fatal("add", data)
+	}
+	if _, data := call(t, srv, "flickr.photosets.addPhoto", url.Values{"photoset_id": {album.Id}, "photo_id": {b.Id}}); data["code"].(float64) != 3 {
+		t.Fatal("add again", data)
+	}
+
+	// deleted photos leave their albums
+	srv.RemovePhoto(a.Id)
+	albums := srv.Albums()
+	if len(albums) != 1 || strings.Join(albums[0].PhotoIds, ",") != b.Id {
+		t.Fatalf("albums %+v", albums)
+	}
+	if _, data := call(t, srv, "flickr.photos.getInfo", url.Values{"photo_id": {a.Id}}); data["code"].(float64) != 1 {
+		t.Fatal("info on a deleted photo", data)
+	}
+}
+
+func TestOriginals(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	p := srv.AddPhoto("a", "photo")
+	p.Content = []byte("0123456789")
+
+	req, _ := http.NewRequest("GET", srv.URL+"/originals/"+p.Id, nil)
+	req.Header.Set("Range", "bytes=4-")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(b) != "456789" {
+		t.Fatal("range", resp.StatusCode, string(b))
+	}
+
+	resp, err = http.Get(srv.URL + "/originals/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("missing original", resp.StatusCode)
+	}
+}
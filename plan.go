@@ -0,0 +1,195 @@
+package photosync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// What an Action does
+type ActionType string
+
+const (
+	ActionRename       ActionType = "rename"        // move From to Path
+	ActionUpload       ActionType = "upload"        // upload Path as a new photo or video
+	ActionLink         ActionType = "link"          // remember Path is already on Flickr as PhotoId
+	ActionAddTags      ActionType = "add-tags"      // add Tags to the photo
+	ActionAddToAlbum   ActionType = "add-to-album"  // add the photo to Album
+	ActionReorderAlbum ActionType = "reorder-album" // save the order of Album after photos were added to it
+	ActionSetDate      ActionType = "set-date"      // set the date taken to Date
+	ActionSetLocation  ActionType = "set-location"  // put the photo on the map
+	ActionDeleteLocal  ActionType = "delete-local"  // delete Path, its photo is gone from Flickr
+	ActionTrash        ActionType = "trash"         // move Path to To, its photo is gone from Flickr
+	ActionMakePrivate  ActionType = "make-private"  // hide the photo, Path was deleted
+	ActionDeletePhoto  ActionType = "delete-photo"  // delete the photo from Flickr, Path was deleted
+	ActionMarkGone     ActionType = "mark-gone"     // note Path was deleted, its photo is changed after the grace period
+	ActionMarkBack     ActionType = "mark-back"     // Path is back, forget it was deleted
+	ActionForget       ActionType = "forget"        // drop the record for Path, it moved and the new name's record carries on
+)
+
+// One change a sync makes. Actions on a photo that is still to be uploaded
+// leave PhotoId empty and name the file it is uploaded from in Path, the id
+// is filled in once the upload is done.
+type Action struct {
+	Type    ActionType `json:"type"`
+	Path    string     `json:"path,omitempty"`     // the local file, after any rename
+	PhotoId string     `json:"photo_id,omitempty"` // the photo or video to change
+
+	From          string  `json:"from,omitempty"`           // rename
+	To            string  `json:"to,omitempty"`             // trash
+	Title         string  `json:"title,omitempty"`          // upload, link
+	Media         string  `json:"media,omitempty"`          // upload, link: photo or video
+	Hash          string  `json:"hash,omitempty"`           // upload
+	Raw           string  `json:"raw,omitempty"`            // upload: preview or convert for RAW files
+	StripLocation bool    `json:"strip_location,omitempty"` // upload
+	Tags          string  `json:"tags,omitempty"`           // add-tags
+	Album         string  `json:"album,omitempty"`          // add-to-album, reorder-album
+	Date          string  `json:"date,omitempty"`           // set-date, as FlickrTimeLayout
+	Latitude      float64 `json:"latitude,omitempty"`       // set-location
+	Longitude     float64 `json:"longitude,omitempty"`      // set-location
+	Accuracy      int     `json:"accuracy,omitempty"`       // set-location
+}
+
+// The photo the action is about, the id or the file it'll be uploaded from
+func (this Action) target() string {
+	if len(this.PhotoId) > 0 {
+		return this.PhotoId
+	}
+	return this.Path
+}
+
+func (this Action) String() string {
+	switch this.Type {
+	case ActionRename:
+		return fmt.Sprintf("rename %s to %s", this.From, this.Path)
+	case ActionUpload:
+		return fmt.Sprintf("upload %s as %s", this.Path, this.Title)
+	case ActionLink:
+		return fmt.Sprintf("link %s to %s", this.Path, this.PhotoId)
+	case ActionAddTags:
+		return fmt.Sprintf("add tags to %s: %s", this.target(), this.Tags)
+	case ActionAddToAlbum:
+		return fmt.Sprintf("add %s to album %s", this.target(), this.Album)
+	case ActionReorderAlbum:
+		return fmt.Sprintf("update album order: %s", this.Album)
+	case ActionSetDate:
+		return fmt.Sprintf("set date of %s to %s", this.target(), this.Date)
+	case ActionSetLocation:
+		return fmt.Sprintf("set location of %s to %f,%f", this.target(), this.Latitude, this.Longitude)
+	case ActionDeleteLocal:
+		return fmt.Sprintf("delete %s, %s is gone from flickr", this.Path, this.PhotoId)
+	case ActionTrash:
+		return fmt.Sprintf("move %s to %s, %s is gone from flickr", this.Path, this.To, this.PhotoId)
+	case ActionMakePrivate:
+		return fmt.Sprintf("make %s private, %s was deleted", this.PhotoId, this.Path)
+	case ActionDeletePhoto:
+		return fmt.Sprintf("delete %s from flickr, %s was deleted", this.PhotoId, this.Path)
+	case ActionMarkGone:
+		return fmt.Sprintf("note %s was deleted", this.Path)
+	case ActionMarkBack:
+		return fmt.Sprintf("note %s is back", this.Path)
+	case ActionForget:
+		return fmt.Sprintf("forget %s, it moved", this.Path)
+	}
+	return string(this.Type) + " " + this.target()
+}
+
+// Everything a sync would change, in the order it would change it
+type Plan struct {
+	Actions []Action `json:"actions"`
+}
+
+// Load a plan saved by Write
+func ReadPlan(path string) (*Plan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	plan := &Plan{}
+	if err := json.NewDecoder(f).Decode(plan); err != nil {
+		return nil, fmt.Errorf("reading plan %s: %v", path, err)
+	}
+	if err := plan.Validate(); err != nil {
+		return nil, fmt.Errorf("reading plan %s: %v", path, err)
+	}
+	return plan, nil
+}
+
+// Save the plan as JSON
+func (this *Plan) Write(w io.Writer) error {
+	b, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Print the actions one per line
+func (this *Plan) Print(w io.Writer) {
+	for _, a := range this.Actions {
+		fmt.Fprintln(w, a)
+	}
+}
+
+// How many of the actions are of the type
+func (this *Plan) Count(t ActionType) int {
+	n := 0
+	for _, a := range this.Actions {
+		if a.Type == t {
+			n++
+		}
+	}
+	return n
+}
+
+// Check a plan from somewhere else makes sense before applying any of it
+func (this *Plan) Validate() error {
+	uploads := make(map[string]bool)
+	for i, a := range this.Actions {
+		var missing []string
+		need := func(name string, ok bool) {
+			if !ok {
+				missing = append(missing, name)
+			}
+		}
+
+		switch a.Type {
+		case ActionRename:
+			need("from", len(a.From) > 0)
+			need("path", len(a.Path) > 0)
+		case ActionUpload:
+			need("path", len(a.Path) > 0)
+			need("title", len(a.Title) > 0)
+			uploads[a.Path] = true
+		case ActionLink:
+			need("path", len(a.Path) > 0)
+			need("photo_id", len(a.PhotoId) > 0)
+		case ActionAddTags, ActionAddToAlbum, ActionSetDate, ActionSetLocation:
+			// the photo is either on Flickr already or uploaded earlier in the plan
+			need("photo_id or an earlier upload of path", len(a.PhotoId) > 0 || uploads[a.Path])
+			need("tags", a.Type != ActionAddTags || len(a.Tags) > 0)
+			need("album", a.Type != ActionAddToAlbum || len(a.Album) > 0)
+			need("date", a.Type != ActionSetDate || len(a.Date) > 0)
+		case ActionReorderAlbum:
+			need("album", len(a.Album) > 0)
+		case ActionDeleteLocal, ActionTrash, ActionMarkGone, ActionMarkBack, ActionForget:
+			need("path", len(a.Path) > 0)
+			need("to", a.Type != ActionTrash || len(a.To) > 0)
+		case ActionMakePrivate, ActionDeletePhoto:
+			need("path", len(a.Path) > 0)
+			need("photo_id", len(a.PhotoId) > 0)
+		default:
+			return fmt.Errorf("action %d: unknown type %q", i, a.Type)
+		}
+
+		if len(missing) > 0 {
+			return fmt.Errorf("action %d (%s): missing %s", i, a.Type, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
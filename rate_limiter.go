@@ -0,0 +1,86 @@
+package photosync
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Flickr allows 3600 calls an hour per key
+const defaultRequestsPerHour = 3600
+
+// Client side limit on api calls. Zero values fall back to the defaults.
+type RateLimitConfig struct {
+	PerHour int `json:"per_hour"` // default 3600, negative turns the limit off
+	Burst   int `json:"burst"`    // calls allowed back to back, default 10
+}
+
+// A token bucket shared by everything using the api
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Returns nil when limiting is turned off. A nil limiter never waits.
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	if cfg.PerHour < 0 {
+		return nil
+	}
+	if cfg.PerHour == 0 {
+		cfg.PerHour = defaultRequestsPerHour
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = 10
+	}
+
+	return &rateLimiter{
+		rate:   float64(cfg.PerHour) / time.Hour.Seconds(),
+		burst:  float64(cfg.Burst),
+		tokens: float64(cfg.Burst),
+		last:   time.Now(),
+	}
+}
+
+// Block until the next call is allowed or the context is done
+func (this *rateLimiter) Wait(ctx context.Context) error {
+	if this == nil {
+		return ctx.Err()
+	}
+
+	delay := this.reserve()
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Take a token and return how long to wait before using it. The bucket can
+// go into debt so concurrent callers queue up behind each other.
+func (this *rateLimiter) reserve() time.Duration {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+
+	this.tokens--
+	if this.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-this.tokens / this.rate * float64(time.Second))
+}
@@ -0,0 +1,115 @@
+package photosync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// names for WatchDirConfig.Raw
+const (
+	RawSkip    = "skip"    // leave RAW files alone, the default
+	RawPreview = "preview" // upload the JPEG the camera embedded in the RAW
+	RawConvert = "convert" // upload a JPEG made by PhotosyncConfig.RawConverter
+)
+
+// Whether there is a JPEG or HEIC of the same shot next to a RAW file.
+// Cameras shooting RAW+JPEG write both and the JPEG goes up on its own.
+func hasSidecar(path string) bool {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for _, mt := range MediaTypes {
+		if mt.Name != "jpeg" && mt.Name != "heic" {
+			continue
+		}
+		for _, ext := range mt.Exts {
+			for _, e := range []string{ext, strings.ToLower(ext)} {
+				if _, err := os.Stat(base + e); err == nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Make a JPEG Flickr will take out of a RAW file, either its embedded
+// preview or one made by the configured converter. The JPEG is named after
+// the RAW in a temp dir, the returned func removes it.
+func prepareRaw(ctx context.Context, config *PhotosyncConfig, session *ExifToolSession, mode string, path string, key string) (string, func(), error) {
+	dir, err := ioutil.TempDir("", "photosync-raw")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	out := filepath.Join(dir, key+".jpg")
+
+	switch mode {
+	case RawPreview:
+		err = extractPreview(ctx, path, out)
+	case RawConvert:
+		err = convertRaw(ctx, config.RawConverter, path, out)
+	default:
+		err = fmt.Errorf("unknown raw mode %q", mode)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	// previews and most converters drop the metadata, bring back the dates,
+	// GPS and orientation. Not worth failing the upload over.
+	if _, err := exec.LookPath("exiftool"); err == nil {
+		runExifTool(ctx, session, "-overwrite_original", "-tagsfromfile", path, "-all:all", "-unsafe", out)
+	}
+
+	return out, cleanup, nil
+}
+
+// Pull the largest JPEG exiftool can find out of a RAW file
+func extractPreview(ctx context.Context, path, out string) error {
+	if _, err := exec.LookPath("exiftool"); err != nil {
+		return fmt.Errorf("previewing RAW files needs exiftool: %v", err)
+	}
+
+	// binary output doesn't mix with the -stay_open protocol so run it on its own
+	for _, tag := range []string{"-JpgFromRaw", "-PreviewImage"} {
+		img, err := exec.CommandContext(ctx, "exiftool", "-b", tag, path).Output()
+		if err != nil {
+			return err
+		}
+		if len(img) > 0 {
+			return ioutil.WriteFile(out, img, 0600)
+		}
+	}
+	return fmt.Errorf("no preview image in %s", path)
+}
+
+// Run the raw_converter command with {in} and {out} filled in
+func convertRaw(ctx context.Context, converter []string, path, out string) error {
+	if len(converter) == 0 {
+		return Error{"raw is convert but no raw_converter is configured"}
+	}
+
+	args := make([]string, len(converter))
+	for i, arg := range converter {
+		arg = strings.Replace(arg, "{in}", path, -1)
+		args[i] = strings.Replace(arg, "{out}", out, -1)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	if _, err := os.Stat(out); err != nil {
+		return fmt.Errorf("%s didn't write %s", args[0], out)
+	}
+	return nil
+}
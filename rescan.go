@@ -0,0 +1,150 @@
+package photosync
+
+import (
+	"log"
+	"time"
+)
+
+// how long before a listing of Flickr starts an upload is kept in it if it
+// isn't listed, new photos can take a moment to show up in searches
+const recentUploadWindow = time.Minute
+
+// A photo uploaded by this run, for putting back into listings that miss it
+type recentUpload struct {
+	photo Photo
+	media string
+	at    time.Time
+}
+
+// A time.Ticker that never ticks when the interval isn't set
+type ticker struct {
+	t *time.Ticker
+}
+
+func newTicker(d time.Duration) *ticker {
+	if d <= 0 {
+		return &ticker{}
+	}
+	return &ticker{time.NewTicker(d)}
+}
+
+func (this *ticker) C() <-chan time.Time {
+	if this.t == nil {
+		return nil
+	}
+	return this.t.C
+}
+
+func (this *ticker) Stop() {
+	if this.t != nil {
+		this.t.Stop()
+	}
+}
+
+// Walk the directories again like Sync does at the start, for the changes the
+// watcher missed
+func (this *syncer) rescan() {
+	plan, err := this.planDirs()
+	if err != nil {
+		if this.ctx.Err() == nil {
+			log.Println("error rescanning", err)
+		}
+		return
+	}
+	this.applyNow(plan.Actions)
+}
+
+// List the photos, videos and albums on Flickr again so changes made there
+// are noticed. Uploads made just before or during the listing are kept even
+// if it missed them, and album orders not saved yet are saved first.
+func (this *syncer) refreshRemote() error {
+	started := time.Now()
+	user, err := this.api.GetLoginContext(this.ctx)
+	if err != nil {
+		return err
+	}
+
+	// with a state db the listing is saved there by id, which is what two way
+	// syncs check photos against
+	var photos, videos, all *PhotosMap
+	if this.state == nil {
+		photos, videos, err = LoadLibraryContext(this.ctx, this.api, nil, user)
+	} else {
+		all, err = this.api.GetLibraryContext(this.ctx, user)
+	}
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, m := range []*PhotosMap{photos, videos, all} {
+		if m == nil {
+			continue
+		}
+		for _, p := range *m {
+			listed[p.Id] = true
+		}
+	}
+
+	// recent uploads go in before the listing is saved or swapped in, so
+	// nothing planning in the meantime sees them missing
+	this.mu.Lock()
+	for id, up := range this.recent {
+		if up.at.Before(started.Add(-recentUploadWindow)) {
+			delete(this.recent, id)
+			continue
+		}
+		if listed[id] {
+			continue
+		}
+		if all != nil {
+			p := up.photo
+			p.Media = up.media
+			(*all)[id] = p
+			continue
+		}
+		m := photos
+		if up.media == "video" {
+			m = videos
+		}
+		if _, ok := (*m)[up.photo.Title]; !ok {
+			(*m)[up.photo.Title] = up.photo
+		}
+	}
+	if all != nil {
+		err = this.state.ReplaceRemote(all)
+		if err == nil {
+			err = this.state.SetLastListed(started)
+		}
+		if err == nil {
+			photos, videos, err = savedLibrary(this.state)
+		}
+		if err != nil {
+			this.mu.Unlock()
+			return err
+		}
+	}
+	*this.photos, *this.videos = *photos, *videos
+	if all != nil {
+		this.hashes = IndexByHash(all)
+	} else {
+		this.hashes = IndexByHash(this.photos, this.videos)
+	}
+	nPhotos, nVideos := len(*photos), len(*videos)
+	this.mu.Unlock()
+
+	// hold the albums while listing them so photos added in the meantime
+	// aren't lost when the listing is swapped in
+	this.albumsMu.Lock()
+	updateAlbumsOrder(this.work, this.api, this.albums, this.out)
+	albums, err := this.api.GetAlbumsContext(this.ctx, user)
+	if err != nil {
+		this.albumsMu.Unlock()
+		return err
+	}
+	*this.albums = *albums
+	nAlbums := len(*albums)
+	this.albumsMu.Unlock()
+
+	log.Printf("refreshed the Flickr listing, %d photos, %d videos and %d albums", nPhotos, nVideos, nAlbums)
+	return nil
+}
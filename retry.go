@@ -0,0 +1,94 @@
+package photosync
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Flickr error codes worth trying again
+var retryableApiCodes = map[int]bool{
+	105: true, // service currently unavailable
+	106: true, // write operation failed
+}
+
+// How failed api calls get retried. Zero values fall back to the defaults.
+type RetryConfig struct {
+	MaxAttempts int      `json:"max_attempts"` // including the first try, default 5
+	BaseDelay   Duration `json:"base_delay"`   // default 1s
+	MaxDelay    Duration `json:"max_delay"`    // default 1m
+}
+
+func (this RetryConfig) withDefaults() RetryConfig {
+	if this.MaxAttempts <= 0 {
+		this.MaxAttempts = 5
+	}
+	if this.BaseDelay <= 0 {
+		this.BaseDelay = Duration(time.Second)
+	}
+	if this.MaxDelay <= 0 {
+		this.MaxDelay = Duration(time.Minute)
+	}
+	return this
+}
+
+// Exponential backoff with full jitter for the given retry (starting at 1)
+func (this RetryConfig) backoff(retry int) time.Duration {
+	ceil := this.BaseDelay.Duration()
+	for i := 1; i < retry && ceil < this.MaxDelay.Duration(); i++ {
+		ceil *= 2
+	}
+	if ceil > this.MaxDelay.Duration() {
+		ceil = this.MaxDelay.Duration()
+	}
+	return time.Duration(rand.Int63n(int64(ceil) + 1))
+}
+
+// Server errors, rate limiting, timeouts and dropped connections are all
+// worth another go. Anything else is our fault and will fail again, and
+// uploads that may have gone through are left alone.
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *StatusError:
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	case *ApiError:
+		return retryableApiCodes[e.Code]
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// Call fn until it succeeds, fails with an error that isn't worth retrying,
+// runs out of attempts or the context is done.
+func (this *FlickrAPI) withRetry(ctx context.Context, what string, fn func() error) error {
+	cfg := this.config.Retry.withDefaults()
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// a cancelled request looks like a network error so check first
+			return ctx.Err()
+		}
+		if !isRetryable(err) || attempt >= cfg.MaxAttempts {
+			return err
+		}
+
+		delay := cfg.backoff(attempt)
+		log.Printf("%s failed, retrying in %v: %v", what, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package photosync_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Reisender/photosync"
+	"github.com/Reisender/photosync/photosynctest"
+)
+
+func TestRetry(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	cfg := testConfig(srv)
+	api := photosync.NewFlickrAPI(&cfg)
+
+	// server errors are tried again
+	srv.FailNext("flickr.test.login", 2, http.StatusBadGateway)
+	if _, err := api.GetLogin(); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Calls("flickr.test.login"); n != 3 {
+		t.Fatal("login calls", n)
+	}
+
+	// until they run out of attempts
+	srv.FailNext("flickr.photos.addTags", 5, http.StatusOK)
+	err := api.AddTags("1", "x")
+	if e, ok := err.(*photosync.ApiError); !ok || e.Code != 105 {
+		t.Fatal("add tags", err)
+	}
+	if n := srv.Calls("flickr.photos.addTags"); n != 5 {
+		t.Fatal("add tags calls", n)
+	}
+
+	// errors that won't go away aren't
+	if err := api.AddTags("nope", "x"); err == nil {
+		t.Fatal("tagged a missing photo")
+	}
+	if n := srv.Calls("flickr.photos.addTags"); n != 6 {
+		t.Fatal("add tags calls", n)
+	}
+}
+
+func TestRetryUpload(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	cfg := testConfig(srv)
+	api := photosync.NewFlickrAPI(&cfg)
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"hello.jpg": "x"})
+	path := filepath.Join(dir, "hello.jpg")
+	f, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flickr saying it failed means it didn't keep the photo
+	srv.FailNext("upload", 1, http.StatusOK)
+	if _, err := api.Upload(path, f); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Calls("upload"); n != 2 {
+		t.Fatal("upload calls", n)
+	}
+	if n := len(srv.Photos()); n != 1 {
+		t.Fatal("photos", n)
+	}
+
+	// a failure once the whole photo was sent might have kept it, trying
+	// again could upload it twice
+	srv.FailNext("upload", 1, http.StatusBadGateway)
+	_, err = api.Upload(path, f)
+	if _, ok := err.(*photosync.UploadUncertainError); !ok {
+		t.Fatal("upload", err)
+	}
+	if n := srv.Calls("upload"); n != 3 {
+		t.Fatal("upload calls", n)
+	}
+}
+
+// Changes that can't simply be repeated count as made when a retry finds them done
+func TestRetryLostResponse(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	cfg := testConfig(srv)
+	api := photosync.NewFlickrAPI(&cfg)
+	a := srv.AddPhoto("a", "photo")
+	b := srv.AddPhoto("b", "photo")
+	srv.AddAlbum("Alb", a.Id)
+	user, err := api.GetLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	albums, err := api.GetAlbums(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	album := (*albums)["Alb"]
+
+	srv.LoseNext("flickr.photosets.addPhoto", 1, http.StatusBadGateway)
+	if err := api.AddToAlbum(b.Id, album); err != nil {
+		t.Fatal("add to album", err)
+	}
+	if n := srv.Calls("flickr.photosets.addPhoto"); n != 2 {
+		t.Fatal("add to album calls", n)
+	}
+	if ids := srv.Albums()[0].PhotoIds; len(ids) != 2 {
+		t.Fatal("album photos", ids)
+	}
+
+	// without a lost answer it really is an error
+	if err := api.AddToAlbum(b.Id, album); err == nil {
+		t.Fatal("added a photo already in the album")
+	}
+
+	srv.LoseNext("flickr.photos.delete", 1, http.StatusBadGateway)
+	if err := api.Delete(a.Id); err != nil {
+		t.Fatal("delete", err)
+	}
+	if n := len(srv.Photos()); n != 1 {
+		t.Fatal("photos", n)
+	}
+	if err := api.Delete(a.Id); err == nil {
+		t.Fatal("deleted a missing photo")
+	}
+}
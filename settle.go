@@ -0,0 +1,130 @@
+package photosync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a new file has to stay the same before the daemon syncs it
+const defaultSettle = 2 * time.Second
+
+// Holds back files that turned up or changed while watching until they stop
+// changing, so files still being copied or downloaded aren't uploaded half
+// written.
+// Every event on a file starts its wait over, and once the wait is up the
+// size and mod time have to match what they were at the last event.
+type settler struct {
+	ctx   context.Context
+	wait  time.Duration
+	ready chan string // files that have settled
+
+	mu      sync.Mutex
+	pending map[string]*settling
+}
+
+type settling struct {
+	size    int64
+	modTime time.Time
+	timer   *time.Timer
+}
+
+func newSettler(ctx context.Context, wait time.Duration) *settler {
+	if wait <= 0 {
+		wait = defaultSettle
+	}
+	return &settler{
+		ctx:     ctx,
+		wait:    wait,
+		ready:   make(chan string),
+		pending: make(map[string]*settling),
+	}
+}
+
+// Start the wait for a file over, or start waiting for a new one
+func (this *settler) touch(path string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	p, ok := this.pending[path]
+	if !ok {
+		p = &settling{size: -1}
+		p.timer = time.AfterFunc(this.wait, func() { this.check(path) })
+		this.pending[path] = p
+	} else {
+		p.timer.Reset(this.wait)
+	}
+
+	if f, err := os.Stat(path); err == nil {
+		p.size, p.modTime = f.Size(), f.ModTime()
+	}
+}
+
+// Whether the file is being waited on
+func (this *settler) has(path string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	_, ok := this.pending[path]
+	return ok
+}
+
+// Stop waiting for a file that went away, or anything in a folder that did
+func (this *settler) cancel(path string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	for p, s := range this.pending {
+		if p == path || strings.HasPrefix(p, prefix) {
+			s.timer.Stop()
+			delete(this.pending, p)
+		}
+	}
+}
+
+// Stop waiting for everything
+func (this *settler) stop() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for p, s := range this.pending {
+		s.timer.Stop()
+		delete(this.pending, p)
+	}
+}
+
+// The wait for a file is up, hand it on if it hasn't changed since
+func (this *settler) check(path string) {
+	f, err := os.Stat(path)
+
+	this.mu.Lock()
+	p, ok := this.pending[path]
+	if !ok {
+		this.mu.Unlock()
+		return
+	}
+	if err != nil {
+		// moved or deleted before it settled, a temp file renamed into place say
+		delete(this.pending, path)
+		this.mu.Unlock()
+		return
+	}
+	if f.Size() != p.size || !f.ModTime().Equal(p.modTime) {
+		// still being written without telling us
+		p.size, p.modTime = f.Size(), f.ModTime()
+		p.timer.Reset(this.wait)
+		this.mu.Unlock()
+		return
+	}
+	delete(this.pending, path)
+	this.mu.Unlock()
+
+	select {
+	case this.ready <- path:
+	case <-this.ctx.Done():
+	}
+}
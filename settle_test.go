@@ -0,0 +1,151 @@
+package photosync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testSettle = 50 * time.Millisecond
+
+// A settler with a short wait and a folder to make files in
+func testSettler(t *testing.T) (*settler, string) {
+	dir, err := ioutil.TempDir("", "photosync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	settle := newSettler(ctx, testSettle)
+	t.Cleanup(func() {
+		settle.stop()
+		cancel()
+		os.RemoveAll(dir)
+	})
+	return settle, dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Wait for a file to settle, failing if it takes much longer than it should
+func settled(t *testing.T, settle *settler) (string, time.Time) {
+	select {
+	case path := <-settle.ready:
+		return path, time.Now()
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing settled")
+	}
+	return "", time.Time{}
+}
+
+// Check nothing settles for a while
+func notSettled(t *testing.T, settle *settler, d time.Duration) {
+	select {
+	case path := <-settle.ready:
+		t.Fatal("settled", path)
+	case <-time.After(d):
+	}
+}
+
+func TestSettle(t *testing.T) {
+	settle, dir := testSettler(t)
+	path := filepath.Join(dir, "a.jpg")
+	writeFile(t, path, "a")
+
+	start := time.Now()
+	settle.touch(path)
+	if !settle.has(path) {
+		t.Fatal("not waiting on", path)
+	}
+	got, at := settled(t, settle)
+	if got != path {
+		t.Fatal("settled", got)
+	}
+	if d := at.Sub(start); d < testSettle {
+		t.Fatal("settled after", d)
+	}
+	if settle.has(path) {
+		t.Fatal("still waiting on", path)
+	}
+
+	if s := newSettler(context.Background(), 0); s.wait != defaultSettle {
+		t.Fatal("default wait", s.wait)
+	}
+}
+
+func TestSettleTouchedAgain(t *testing.T) {
+	settle, dir := testSettler(t)
+	path := filepath.Join(dir, "a.jpg")
+	writeFile(t, path, "a")
+
+	// every event starts the wait over
+	settle.touch(path)
+	var last time.Time
+	for i := 0; i < 4; i++ {
+		time.Sleep(testSettle / 2)
+		last = time.Now()
+		settle.touch(path)
+	}
+	got, at := settled(t, settle)
+	if got != path {
+		t.Fatal("settled", got)
+	}
+	if d := at.Sub(last); d < testSettle {
+		t.Fatal("settled", d, "after the last event")
+	}
+	notSettled(t, settle, 2*testSettle) // only the once
+}
+
+func TestSettleChangedQuietly(t *testing.T) {
+	settle, dir := testSettler(t)
+	path := filepath.Join(dir, "a.jpg")
+	writeFile(t, path, "a")
+
+	// changes without an event still start the wait over, once it's up
+	start := time.Now()
+	settle.touch(path)
+	time.Sleep(testSettle / 2)
+	writeFile(t, path, "aaaa")
+	got, at := settled(t, settle)
+	if got != path {
+		t.Fatal("settled", got)
+	}
+	if d := at.Sub(start); d < 2*testSettle {
+		t.Fatal("settled after", d)
+	}
+}
+
+func TestSettleGone(t *testing.T) {
+	settle, dir := testSettler(t)
+	a := filepath.Join(dir, "a.jpg")
+	sub := filepath.Join(dir, "sub")
+	b := filepath.Join(sub, "b.jpg")
+	c := filepath.Join(dir, "c.jpg")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{a, b, c} {
+		writeFile(t, path, "x")
+		settle.touch(path)
+	}
+
+	// cancelled, by name or by folder, or gone before the wait is up
+	settle.cancel(a)
+	settle.cancel(sub)
+	os.Remove(c)
+	for _, path := range []string{a, b} {
+		if settle.has(path) {
+			t.Fatal("still waiting on", path)
+		}
+	}
+	notSettled(t, settle, 3*testSettle)
+	if settle.has(c) {
+		t.Fatal("still waiting on", c)
+	}
+}
@@ -0,0 +1,492 @@
+package photosync
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bucket names in the state db
+var (
+	filesBucket  = []byte("files")  // local path -> FileState
+	remoteBucket = []byte("remote") // flickr photo id -> RemotePhoto
+	metaBucket   = []byte("meta")   // misc bookkeeping
+	hashesBucket = []byte("hashes") // content hash -> flickr photo id
+)
+
+var lastListedKey = []byte("last_listed")
+
+// SyncState is the persistent record of what has been synced so a run
+// doesn't need to rebuild everything from the Flickr listings.
+type SyncState struct {
+	db *bolt.DB
+}
+
+// What we know about a local file
+type FileState struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Hash    string // hex sha256 of the contents
+	PhotoId string
+	Title   string
+	Media   string // photo or video
+	Tags    []string
+	Albums  []string
+	Synced  time.Time
+	Missing time.Time // when the file was first seen to be deleted, zero while it's there
+}
+
+// What we know about a photo or video on Flickr
+type RemotePhoto struct {
+	Photo
+	Media string // photo or video
+}
+
+// The default state db lives next to the config file
+func DefaultStatePath(configPath string) string {
+	ext := filepath.Ext(configPath)
+	return configPath[:len(configPath)-len(ext)] + ".state.db"
+}
+
+func OpenSyncState(path string) (*SyncState, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{filesBucket, remoteBucket, metaBucket, hashesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SyncState{db: db}, nil
+}
+
+func (this *SyncState) Close() error {
+	return this.db.Close()
+}
+
+// Get the record for a local file. Returns nil if the file has never been seen.
+func (this *SyncState) GetFile(path string) (*FileState, error) {
+	var rec *FileState
+	err := this.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(filesBucket).Get([]byte(path))
+		if v == nil {
+			return nil
+		}
+		rec = &FileState{}
+		return json.Unmarshal(v, rec)
+	})
+	return rec, err
+}
+
+func (this *SyncState) PutFile(rec *FileState) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return this.db.Update(func(tx *bolt.Tx) error {
+		if len(rec.Hash) > 0 && len(rec.PhotoId) > 0 {
+			if err := tx.Bucket(hashesBucket).Put([]byte(rec.Hash), []byte(rec.PhotoId)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(filesBucket).Put([]byte(rec.Path), v)
+	})
+}
+
+// The id of the photo uploaded with the given content hash. Empty if there isn't one.
+func (this *SyncState) PhotoIdForHash(hash string) (string, error) {
+	var id string
+	err := this.db.View(func(tx *bolt.Tx) error {
+		id = string(tx.Bucket(hashesBucket).Get([]byte(hash)))
+		return nil
+	})
+	return id, err
+}
+
+func (this *SyncState) DeleteFile(path string) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).Delete([]byte(path))
+	})
+}
+
+// Carry the record for a local file over to where it was moved
+func (this *SyncState) MoveFile(from, to string) error {
+	rec, err := this.GetFile(from)
+	if err != nil || rec == nil {
+		return err
+	}
+	rec.Path = to
+	if err := this.PutFile(rec); err != nil {
+		return err
+	}
+	return this.DeleteFile(from)
+}
+
+// Call fn for every local file record
+func (this *SyncState) Files(fn func(rec *FileState) error) error {
+	return this.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			rec := FileState{}
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			return fn(&rec)
+		})
+	})
+}
+
+// The record for a local file brought up to date with what's on disk, without
+// saving it. The contents are only rehashed when the size or mod time changed
+// since the record was saved.
+func (this *SyncState) Track(path string, f os.FileInfo) (*FileState, error) {
+	rec, err := this.GetFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		rec = &FileState{Path: path}
+	}
+
+	if len(rec.Hash) == 0 || rec.Size != f.Size() || !rec.ModTime.Equal(f.ModTime()) {
+		if rec.Hash, err = FileHash(path); err != nil {
+			return nil, err
+		}
+		rec.Size = f.Size()
+		rec.ModTime = f.ModTime()
+	}
+
+	return rec, nil
+}
+
+// Save the remote listing for the given media type
+func (this *SyncState) PutRemote(media string, photos *PhotosMap) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(remoteBucket)
+		for _, p := range *photos {
+			v, err := json.Marshal(RemotePhoto{p, media})
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(p.Id), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (this *SyncState) DeleteRemote(photoId string) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(remoteBucket).Delete([]byte(photoId))
+	})
+}
+
+// Forget a photo deleted from Flickr, both in the remote listing and as
+// the upload of any content
+func (this *SyncState) ForgetPhoto(photoId string) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(remoteBucket).Delete([]byte(photoId)); err != nil {
+			return err
+		}
+		var hashes [][]byte
+		b := tx.Bucket(hashesBucket)
+		err := b.ForEach(func(k, v []byte) error {
+			if string(v) == photoId {
+				hashes = append(hashes, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range hashes {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Swap the saved remote listing for a full one keyed by id, dropping
+// whatever was deleted from Flickr since the last one
+func (this *SyncState) ReplaceRemote(photos *PhotosMap) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(remoteBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(remoteBucket)
+		if err != nil {
+			return err
+		}
+		for id, p := range *photos {
+			v, err := json.Marshal(RemotePhoto{p, p.Media})
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(id), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The saved remote listing for one photo or video. Nil if it isn't in it.
+func (this *SyncState) RemotePhoto(photoId string) (*RemotePhoto, error) {
+	var rp *RemotePhoto
+	err := this.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(remoteBucket).Get([]byte(photoId))
+		if v == nil {
+			return nil
+		}
+		rp = &RemotePhoto{}
+		return json.Unmarshal(v, rp)
+	})
+	return rp, err
+}
+
+// Load the saved remote listing for the given media type keyed by id, as
+// titles can repeat
+func (this *SyncState) RemotePhotos(media string) (*PhotosMap, error) {
+	photos := make(PhotosMap)
+	err := this.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(remoteBucket).ForEach(func(k, v []byte) error {
+			rp := RemotePhoto{}
+			if err := json.Unmarshal(v, &rp); err != nil {
+				return err
+			}
+			if rp.Media == media {
+				photos[string(k)] = rp.Photo
+			}
+			return nil
+		})
+	})
+	return &photos, err
+}
+
+// When the remote listing was last refreshed. Zero if it never was.
+func (this *SyncState) LastListed() (time.Time, error) {
+	var t time.Time
+	err := this.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(metaBucket).Get(lastListedKey)
+		if v == nil {
+			return nil
+		}
+		return t.UnmarshalText(v)
+	})
+	return t, err
+}
+
+func (this *SyncState) SetLastListed(t time.Time) error {
+	v, err := t.MarshalText()
+	if err != nil {
+		return err
+	}
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(lastListedKey, v)
+	})
+}
+
+// Load the photos and videos on Flickr. With a state db only the uploads
+// since the last listing are fetched and merged into the saved listing.
+func LoadLibrary(api PhotoService, state *SyncState, user *FlickrUser) (*PhotosMap, *PhotosMap, error) {
+	return LoadLibraryContext(context.Background(), api, state, user)
+}
+
+func LoadLibraryContext(ctx context.Context, api PhotoService, state *SyncState, user *FlickrUser) (*PhotosMap, *PhotosMap, error) {
+	if state == nil {
+		photos, err := api.GetPhotosContext(ctx, user)
+		if err != nil {
+			return nil, nil, err
+		}
+		videos, err := api.GetVideosContext(ctx, user)
+		if err != nil {
+			return nil, nil, err
+		}
+		return photos, videos, nil
+	}
+
+	last, err := state.LastListed()
+	if err != nil {
+		return nil, nil, err
+	}
+	started := time.Now()
+
+	// listed by id, as titles can repeat
+	var listed *PhotosMap
+	if last.IsZero() {
+		listed, err = api.GetLibraryContext(ctx, user)
+	} else {
+		// overlap a bit to cover uploads that were still processing last time
+		listed, err = api.GetLibrarySinceContext(ctx, user, last.Add(-time.Hour))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newPhotos, newVideos := splitMedia(listed)
+	if err := state.PutRemote("photo", newPhotos); err != nil {
+		return nil, nil, err
+	}
+	if err := state.PutRemote("video", newVideos); err != nil {
+		return nil, nil, err
+	}
+	if err := state.SetLastListed(started); err != nil {
+		return nil, nil, err
+	}
+
+	return savedLibrary(state)
+}
+
+// Load the photos and videos on Flickr with a full listing, replacing the one
+// in the state db. Slower than LoadLibrary but it catches photos deleted or
+// retitled on Flickr, which two way syncs need.
+func RefreshLibrary(api PhotoService, state *SyncState, user *FlickrUser) (*PhotosMap, *PhotosMap, error) {
+	return RefreshLibraryContext(context.Background(), api, state, user)
+}
+
+func RefreshLibraryContext(ctx context.Context, api PhotoService, state *SyncState, user *FlickrUser) (*PhotosMap, *PhotosMap, error) {
+	_, photos, videos, err := RefreshLibraryByIdContext(ctx, api, state, user)
+	return photos, videos, err
+}
+
+// Like RefreshLibrary but the full listing keyed by id is returned too, for
+// when photos sharing a title all matter, as they do for downloads.
+func RefreshLibraryById(api PhotoService, state *SyncState, user *FlickrUser) (all, photos, videos *PhotosMap, err error) {
+	return RefreshLibraryByIdContext(context.Background(), api, state, user)
+}
+
+func RefreshLibraryByIdContext(ctx context.Context, api PhotoService, state *SyncState, user *FlickrUser) (all, photos, videos *PhotosMap, err error) {
+	started := time.Now()
+	all, err = api.GetLibraryContext(ctx, user)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if state != nil {
+		if err := state.ReplaceRemote(all); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := state.SetLastListed(started); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	photos, videos = splitMedia(all)
+	return all, byTitle(photos), byTitle(videos), nil
+}
+
+// A listing split into its photos and its videos
+func splitMedia(all *PhotosMap) (*PhotosMap, *PhotosMap) {
+	photos, videos := PhotosMap{}, PhotosMap{}
+	for id, p := range *all {
+		if p.Media == "video" {
+			videos[id] = p
+		} else {
+			photos[id] = p
+		}
+	}
+	return &photos, &videos
+}
+
+// The photos and videos in the state db keyed by title
+func savedLibrary(state *SyncState) (*PhotosMap, *PhotosMap, error) {
+	photos, err := state.RemotePhotos("photo")
+	if err != nil {
+		return nil, nil, err
+	}
+	videos, err := state.RemotePhotos("video")
+	if err != nil {
+		return nil, nil, err
+	}
+	return byTitle(photos), byTitle(videos), nil
+}
+
+// A listing keyed by id keyed by title instead. Where titles repeat the
+// lowest id, the first uploaded, is kept.
+func byTitle(photos *PhotosMap) *PhotosMap {
+	titled := make(PhotosMap, len(*photos))
+	for _, p := range *photos {
+		if had, ok := titled[p.Title]; !ok || idLess(p.Id, had.Id) {
+			titled[p.Title] = p
+		}
+	}
+	return &titled
+}
+
+// How much of a limited thing was used in the window starting at Start
+type allowance struct {
+	Start time.Time
+	Used  int
+}
+
+func allowanceKey(name string) []byte {
+	return []byte("allowance:" + name)
+}
+
+// How many more of name can be done in the current window of the given
+// length, when max can be done in each one. The count is kept in the db so
+// it holds across runs.
+func (this *SyncState) Allowance(name string, window time.Duration, max int) (int, error) {
+	left := 0
+	err := this.db.View(func(tx *bolt.Tx) error {
+		a, err := getAllowance(tx, name, window)
+		left = max - a.Used
+		return err
+	})
+	if left < 0 {
+		left = 0
+	}
+	return left, err
+}
+
+// Use one of name's allowance for the current window. False when there's
+// none left.
+func (this *SyncState) UseAllowance(name string, window time.Duration, max int) (bool, error) {
+	ok := false
+	err := this.db.Update(func(tx *bolt.Tx) error {
+		a, err := getAllowance(tx, name, window)
+		if err != nil || a.Used >= max {
+			return err
+		}
+		a.Used++
+		v, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		ok = true
+		return tx.Bucket(metaBucket).Put(allowanceKey(name), v)
+	})
+	return ok && err == nil, err
+}
+
+// The allowance for the current window, a fresh one once the last is over
+func getAllowance(tx *bolt.Tx, name string, window time.Duration) (*allowance, error) {
+	now := time.Now()
+	a := &allowance{}
+	if v := tx.Bucket(metaBucket).Get(allowanceKey(name)); v != nil {
+		if err := json.Unmarshal(v, a); err != nil {
+			return nil, err
+		}
+	}
+	if now.Sub(a.Start) >= window || a.Start.After(now) {
+		a = &allowance{Start: now}
+	}
+	return a, nil
+}
@@ -0,0 +1,83 @@
+package photosync_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Reisender/photosync"
+	"github.com/Reisender/photosync/photosynctest"
+)
+
+func TestSyncStateFiles(t *testing.T) {
+	dir := tempDir(t)
+	state := openState(t, dir)
+	path := filepath.Join(dir, "a.jpg")
+	writeFiles(t, dir, map[string]string{"a.jpg": "aaa"})
+	f, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := state.Track(path, f)
+	if err != nil || rec.Path != path || len(rec.PhotoId) > 0 {
+		t.Fatalf("tracked %+v %v", rec, err)
+	}
+	rec.PhotoId, rec.Hash = "1001", "abc"
+	if err := state.PutFile(rec); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := state.PhotoIdForHash("abc"); id != "1001" {
+		t.Fatal("photo for hash", id)
+	}
+
+	if err := state.MoveFile(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := state.GetFile(path); rec != nil {
+		t.Fatal("old path still there")
+	}
+	if rec, _ := state.GetFile(path + ".moved"); rec == nil || rec.PhotoId != "1001" {
+		t.Fatalf("moved %+v", rec)
+	}
+}
+
+// Photos sharing a title are all kept in the saved listing
+func TestSyncStateSameTitle(t *testing.T) {
+	srv := photosynctest.NewServer()
+	defer srv.Close()
+	first := srv.AddPhoto("dup", "photo")
+	second := srv.AddPhoto("dup", "photo")
+	srv.AddPhoto("clip", "video")
+
+	cfg := testConfig(srv)
+	api := photosync.NewFlickrAPI(&cfg)
+	state := openState(t, tempDir(t))
+	user, err := api.GetLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	photos, videos, err := photosync.LoadLibrary(api, state, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*photos) != 1 || (*photos)["dup"].Id != first.Id || len(*videos) != 1 {
+		t.Fatalf("by title %v %v", *photos, *videos)
+	}
+
+	saved, err := state.RemotePhotos("photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*saved) != 2 || (*saved)[first.Id].Title != "dup" || (*saved)[second.Id].Title != "dup" {
+		t.Fatalf("saved %v", *saved)
+	}
+
+	// the incremental listing keeps them too
+	if _, _, err := photosync.LoadLibrary(api, state, user); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := state.RemotePhotos("photo"); len(*saved) != 2 {
+		t.Fatalf("saved after listing again %v", *saved)
+	}
+}
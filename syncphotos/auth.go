@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Reisender/photosync"
+	"github.com/codegangsta/cli"
+)
+
+// Run the OAuth flow and save the access token and secret in the config
+func auth(c *cli.Context) {
+	configPath := c.String("config")
+
+	config := photosync.PhotosyncConfig{}
+	if err := photosync.LoadConfig(&configPath, &config); err != nil {
+		log.Fatalf("Error reading configuration, %v", err)
+	}
+
+	if len(config.Consumer.Token) == 0 || len(config.Consumer.Secret) == 0 {
+		log.Fatal("the config needs a consumer token and secret, get them from https://www.flickr.com/services/apps/create/")
+	}
+
+	perms := c.String("perms")
+	if len(perms) == 0 {
+		perms = config.Perms
+	}
+
+	fl := photosync.NewFlickrAPI(&config)
+
+	var verifier string
+	var err error
+
+	listen := c.String("listen")
+	callback := photosync.OobCallback
+	var ln net.Listener
+	if len(listen) > 0 {
+		if ln, err = net.Listen("tcp", listen); err != nil {
+			log.Fatal(err)
+		}
+		defer ln.Close()
+		callback = "http://" + ln.Addr().String() + "/callback"
+	}
+
+	tmp, authURL, err := fl.RequestAuthorization(callback, perms)
+	if err != nil {
+		log.Fatal("requesting a token: ", err)
+	}
+
+	fmt.Println("open this url in a browser to let syncphotos access your Flickr account:")
+	fmt.Println()
+	fmt.Println("  ", authURL)
+	fmt.Println()
+
+	if ln != nil {
+		fmt.Println("waiting for Flickr to redirect back to", callback)
+		verifier = waitForVerifier(ln, tmp.Token)
+	} else {
+		fmt.Print("enter the code Flickr gives you: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			log.Fatal(err)
+		}
+		verifier = strings.TrimSpace(line)
+	}
+
+	access, vals, err := fl.Authorize(tmp, verifier)
+	if err != nil {
+		log.Fatal("getting the access token: ", err)
+	}
+
+	if err := photosync.SaveAccess(configPath, access); err != nil {
+		log.Fatalf("Error saving the access token to %s, %v", configPath, err)
+	}
+
+	fmt.Println("authorized as", vals.Get("username"), "and saved to", configPath)
+}
+
+// Serve the OAuth callback until Flickr redirects back with the verifier
+func waitForVerifier(ln net.Listener, token string) string {
+	verifiers := make(chan string, 1)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/callback" || q.Get("oauth_token") != token || len(q.Get("oauth_verifier")) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		fmt.Fprintln(w, "syncphotos is authorized, you can close this window.")
+
+		select {
+		case verifiers <- q.Get("oauth_verifier"):
+		default: // already have one
+		}
+	})}
+
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	return <-verifiers
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Reisender/photosync"
+	"github.com/codegangsta/cli"
+)
+
+// Mirror the Flickr account to a local directory
+func download(c *cli.Context) {
+	opts := parseOptions(c)
+	opts.NoUpload = false // it needs the listing and uploads nothing anyway
+
+	dlOpts := &photosync.DownloadOptions{
+		Dir:    c.String("dir"),
+		Layout: c.String("layout"),
+		Media:  c.String("media"),
+		Albums: c.StringSlice("album"),
+		Verify: c.Bool("verify"),
+		Jobs:   c.Int("jobs"),
+		Dryrun: opts.Dryrun,
+		Out:    opts.Out,
+	}
+	switch dlOpts.Media {
+	case "", "photo", "video":
+	default:
+		log.Fatalf("--media must be photo or video, not %s", dlOpts.Media)
+	}
+
+	var err error
+	if dlOpts.Since, err = parseDay(c.String("since")); err != nil {
+		log.Fatalf("--since: %v", err)
+	}
+	if dlOpts.Until, err = parseDay(c.String("until")); err != nil {
+		log.Fatalf("--until: %v", err)
+	}
+
+	lib, closeLib := load(opts, true)
+	if lib == nil {
+		return
+	}
+	defer closeLib()
+
+	if opts.Dryrun {
+		fmt.Println("--+ Dry Run +--")
+	}
+
+	// by id, photos can share a title
+	downcnt, excnt, errCnt, err := photosync.DownloadAllContext(lib.ctx, lib.fl, lib.all, lib.albums, dlOpts)
+	if err != nil && err == lib.ctx.Err() {
+		fmt.Println("--+ Stopped +--")
+	} else if err != nil {
+		log.Fatal(errCnt, err)
+	}
+
+	fmt.Println(downcnt, " downloaded")
+	fmt.Println(excnt, " existing")
+	fmt.Println(errCnt, " failed")
+}
+
+// A 2006-01-02 date in local time, zero when empty
+func parseDay(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
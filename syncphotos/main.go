@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Reisender/photosync"
 	"github.com/codegangsta/cli"
@@ -12,58 +15,148 @@ import (
 
 const syncphotos_version_string = "0.1.0"
 
-func run(opt *photosync.Options) {
+// Everything a sync needs: the config, the api and what's already on Flickr
+type library struct {
+	ctx    context.Context
+	config photosync.PhotosyncConfig
+	fl     *photosync.FlickrAPI
+	user   *photosync.FlickrUser
+	state  *photosync.SyncState
+	photos *photosync.PhotosMap
+	videos *photosync.PhotosMap
+	all    *photosync.PhotosMap // keyed by id, only after a full listing
+	albums *photosync.AlbumsMap
+}
+
+// Load the config, log in and list the library, all of it when full is set.
+// Returns nil when there is nothing to do, the caller must call close when
+// there isn't.
+func load(opt *photosync.Options, full bool) (*library, func()) {
+	out := opt.Out
+	if out == nil {
+		out = os.Stdout
+	}
 
 	// ensure the config file exists
 	if _, err := os.Stat(opt.ConfigPath); os.IsNotExist(err) {
-		fmt.Printf("config file not found: %s", opt.ConfigPath)
-		return
+		fmt.Fprintf(out, "config file not found: %s", opt.ConfigPath)
+		return nil, nil
 	}
 
-	config := photosync.PhotosyncConfig{}
+	lib := &library{
+		photos: &photosync.PhotosMap{},
+		videos: &photosync.PhotosMap{},
+		albums: &photosync.AlbumsMap{},
+	}
 
-	if err := photosync.LoadConfig(&opt.ConfigPath, &config); err != nil {
+	if err := photosync.LoadConfig(&opt.ConfigPath, &lib.config); err != nil {
 		log.Fatalf("Error reading configuration, %v", err)
 	}
 
-	fl := photosync.NewFlickrAPI(&config)
+	if len(lib.config.Access.Token) == 0 {
+		fmt.Fprintln(out, "no access token in the config, run `syncphotos auth` first")
+		return nil, nil
+	}
+
+	lib.fl = photosync.NewFlickrAPI(&lib.config)
+	lib.fl.Out = opt.Out
+
+	// stop cleanly on ctrl-c or a kill, letting uploads in progress finish.
+	// A second one doesn't wait for them.
+	ctx, cancel := context.WithCancel(context.Background())
+	lib.ctx = ctx
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Println("got", sig, "stopping...")
+		cancel()
 
-	user, errr := fl.GetLogin()
+		sig = <-sigs
+		log.Println("got", sig, "again, quitting now")
+		os.Exit(1)
+	}()
+
+	// reload the config on a hangup while watching
+	if opt.Daemon {
+		hups := make(chan os.Signal, 1)
+		signal.Notify(hups, syscall.SIGHUP)
+		reload := make(chan struct{}, 1)
+		opt.Reload = reload
+		go func() {
+			for range hups {
+				select {
+				case reload <- struct{}{}:
+				default: // one is already waiting
+				}
+			}
+		}()
+	}
+
+	user, errr := lib.fl.GetLoginContext(ctx)
 	if errr != nil {
 		log.Fatal(errr)
 	}
+	lib.user = user
 
 	var err error
-	var photos = &photosync.PhotosMap{}
-	var videos = &photosync.PhotosMap{}
-	var albums = &photosync.AlbumsMap{}
+	if len(opt.StatePath) > 0 {
+		lib.state, err = photosync.OpenSyncState(opt.StatePath)
+		if err != nil {
+			log.Fatalf("Error opening sync state %s, %v", opt.StatePath, err)
+		}
+	}
+
+	closeLib := func() {
+		cancel()
+		if lib.state != nil {
+			lib.state.Close()
+		}
+	}
 
 	if !opt.NoUpload {
-		photos, err = fl.GetPhotos(user)
-		if err != nil {
-			log.Fatal(err)
+		// two way syncs need the full listing to see what was deleted
+		if full || lib.config.TwoWay.Enabled {
+			lib.all, lib.photos, lib.videos, err = photosync.RefreshLibraryByIdContext(ctx, lib.fl, lib.state, user)
+		} else {
+			lib.photos, lib.videos, err = photosync.LoadLibraryContext(ctx, lib.fl, lib.state, user)
 		}
-		videos, err = fl.GetVideos(user)
 		if err != nil {
 			log.Fatal(err)
 		}
-		albums, err = fl.GetAlbums(user)
+		lib.albums, err = lib.fl.GetAlbumsContext(ctx, user)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		fmt.Println(len(*photos), "Flickr photos found")
-		fmt.Println(len(*videos), "Flickr videos found")
-		fmt.Println(len(*albums), "Flickr albums found")
+		fmt.Fprintln(out, len(*lib.photos), "Flickr photos found")
+		fmt.Fprintln(out, len(*lib.videos), "Flickr videos found")
+		fmt.Fprintln(out, len(*lib.albums), "Flickr albums found")
 	}
 
+	return lib, closeLib
+}
+
+func run(opt *photosync.Options) {
+	lib, closeLib := load(opt, false)
+	if lib == nil {
+		return
+	}
+	defer closeLib()
+
 	if opt.Dryrun {
 		fmt.Println("--+ Dry Run +--")
 	}
 
 	// now walk the directory
-	rencnt, excnt, newcnt, errCnt, err := photosync.Sync(fl, photos, videos, albums, opt)
-	if err != nil {
+	rencnt, excnt, newcnt, errCnt, err := photosync.SyncContext(lib.ctx, lib.fl, &lib.config, lib.state, lib.photos, lib.videos, lib.albums, opt)
+	report(opt, rencnt, excnt, newcnt, errCnt, err)
+}
+
+func report(opt *photosync.Options, rencnt, excnt, newcnt, errCnt int, err error) {
+	if err == context.Canceled {
+		fmt.Println("--+ Stopped +--")
+	} else if err != nil {
 		log.Fatal(errCnt, err)
 	}
 
@@ -99,21 +192,54 @@ func main() {
 			Usage:  "don't actually make any changes or upload anything",
 			EnvVar: "PHOTOSYNC_DRYRUN",
 		},
+		cli.StringFlag{
+			Name:   "state",
+			Usage:  "path to the sync state db (defaults to next to the config file)",
+			EnvVar: "PHOTOSYNC_STATE",
+		},
 		cli.BoolFlag{
-			Name:   "deamon",
+			Name:   "no-state",
+			Usage:  "don't keep a sync state db, rebuild everything from the Flickr listings",
+			EnvVar: "PHOTOSYNC_NO_STATE",
+		},
+		cli.BoolFlag{
+			Name:   "daemon",
 			Usage:  "run as a daemon that watches the dirs in the config for newly created files",
 			EnvVar: "PHOTOSYNC_DAEMON",
 		},
+		cli.BoolFlag{
+			Name:   "deamon",
+			Usage:  "old misspelling of --daemon",
+			Hidden: true,
+		},
 	}
 
 	renameFlags := append(app.Flags, []cli.Flag{}...)
 
+	authFlags := append(app.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:   "perms",
+			Usage:  "access to ask for: read, write or delete (defaults to perms in the config or write)",
+			EnvVar: "PHOTOSYNC_PERMS",
+		},
+		cli.StringFlag{
+			Name:   "listen",
+			Usage:  "address like localhost:8910 to take the OAuth callback on instead of pasting in a code",
+			EnvVar: "PHOTOSYNC_AUTH_LISTEN",
+		},
+	}...)
+
 	syncFlags := append(app.Flags, []cli.Flag{
 		cli.BoolFlag{
 			Name:   "no-upload, noupload",
 			Usage:  "no-upload means don't actually upload files",
 			EnvVar: "PHOTOSYNC_RETRO_TAGS",
 		},
+		cli.IntFlag{
+			Name:   "jobs, j",
+			Usage:  "number of files to upload in parallel (defaults to the jobs setting in the config or 1)",
+			EnvVar: "PHOTOSYNC_JOBS",
+		},
 		cli.BoolFlag{
 			Name:   "retro-tags",
 			Usage:  "retroactively set the tags for images found in a folder with tags in the config",
@@ -126,6 +252,47 @@ func main() {
 		},
 	}...)
 
+	downloadFlags := append(app.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:   "dir",
+			Value:  ".",
+			Usage:  "where to put the mirror",
+			EnvVar: "PHOTOSYNC_DOWNLOAD_DIR",
+		},
+		cli.StringFlag{
+			Name:   "layout",
+			Value:  photosync.DefaultDownloadLayout,
+			Usage:  "template for the path of each file, with .Title, .Id, .Media, .Album and .Date \"2006/01\"",
+			EnvVar: "PHOTOSYNC_DOWNLOAD_LAYOUT",
+		},
+		cli.StringFlag{
+			Name:  "media",
+			Usage: "only download photo or video",
+		},
+		cli.StringSliceFlag{
+			Name:  "album",
+			Value: &cli.StringSlice{},
+			Usage: "only download what's in the album, can be given more than once",
+		},
+		cli.StringFlag{
+			Name:  "since",
+			Usage: "only download what was taken on or after this 2006-01-02 date",
+		},
+		cli.StringFlag{
+			Name:  "until",
+			Usage: "only download what was taken before this 2006-01-02 date",
+		},
+		cli.BoolFlag{
+			Name:  "verify",
+			Usage: "check files already downloaded are the same size as the original and download them again if not",
+		},
+		cli.IntFlag{
+			Name:   "jobs, j",
+			Usage:  "number of files to download in parallel",
+			EnvVar: "PHOTOSYNC_JOBS",
+		},
+	}...)
+
 	app.Commands = []cli.Command{
 		{
 			Name:    "version",
@@ -133,6 +300,12 @@ func main() {
 			Usage:   "print out the version",
 			Action:  version,
 		},
+		{
+			Name:   "auth",
+			Usage:  "authorize syncphotos with Flickr and save the access token in the config",
+			Flags:  authFlags,
+			Action: auth,
+		},
 		{
 			Name:    "rename",
 			Aliases: []string{"r"},
@@ -147,6 +320,26 @@ func main() {
 			Flags:   syncFlags,
 			Action:  sync,
 		},
+		{
+			Name:   "plan",
+			Usage:  "print what a sync would do as JSON, `syncphotos plan > plan.json`",
+			Flags:  syncFlags,
+			Action: plan,
+		},
+		{
+			Name:      "apply",
+			Usage:     "carry out a plan saved by plan",
+			ArgsUsage: "plan.json",
+			Flags:     syncFlags,
+			Action:    apply,
+		},
+		{
+			Name:    "download",
+			Aliases: []string{"d"},
+			Usage:   "download the originals of everything on flickr that isn't already there",
+			Flags:   downloadFlags,
+			Action:  download,
+		},
 	}
 
 	app.Run(os.Args)
@@ -157,7 +350,25 @@ func version(c *cli.Context) {
 }
 
 func parseOptions(c *cli.Context) *photosync.Options {
-	return &photosync.Options{c.String("config"), c.Bool("dry-run"), c.Bool("no-upload"), c.Bool("daemon"), c.Bool("retro-tags"), c.Bool("retro-albums")}
+	opt := &photosync.Options{
+		ConfigPath:  c.String("config"),
+		Dryrun:      c.Bool("dry-run"),
+		NoUpload:    c.Bool("no-upload"),
+		Daemon:      c.Bool("daemon") || c.Bool("deamon"),
+		RetroTags:   c.Bool("retro-tags"),
+		RetroAlbums: c.Bool("retro-albums"),
+		StatePath:   c.String("state"),
+		Jobs:        c.Int("jobs"),
+	}
+
+	if len(opt.StatePath) == 0 {
+		opt.StatePath = photosync.DefaultStatePath(opt.ConfigPath)
+	}
+	if c.Bool("no-state") {
+		opt.StatePath = ""
+	}
+
+	return opt
 }
 
 func rename(c *cli.Context) {
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Reisender/photosync"
+	"github.com/codegangsta/cli"
+)
+
+// Work out what a sync would do and print it as JSON to review and apply later
+func plan(c *cli.Context) {
+	opts := parseOptions(c)
+
+	// only the plan goes to stdout so it can be redirected to a file
+	opts.Out = os.Stderr
+
+	lib, closeLib := load(opts, false)
+	if lib == nil {
+		return
+	}
+	defer closeLib()
+
+	p, err := photosync.PlanSyncContext(lib.ctx, &lib.config, lib.state, lib.photos, lib.videos, lib.albums, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := p.Write(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintln(os.Stderr, p.Count(photosync.ActionRename), " to rename")
+	fmt.Fprintln(os.Stderr, p.Count(photosync.ActionUpload), " to upload")
+	fmt.Fprintln(os.Stderr, len(p.Actions), " actions")
+}
+
+// Carry out a plan saved by `syncphotos plan`
+func apply(c *cli.Context) {
+	if !c.Args().Present() {
+		log.Fatal("which plan? syncphotos apply plan.json")
+	}
+
+	p, err := photosync.ReadPlan(c.Args().First())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := parseOptions(c)
+	lib, closeLib := load(opts, false)
+	if lib == nil {
+		return
+	}
+	defer closeLib()
+
+	rencnt, excnt, newcnt, errCnt, err := photosync.ApplyPlanContext(lib.ctx, lib.fl, &lib.config, lib.state, lib.photos, lib.videos, lib.albums, p, opts)
+	report(opts, rencnt, excnt, newcnt, errCnt, err)
+}
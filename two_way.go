@@ -0,0 +1,139 @@
+package photosync
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// names for the TwoWayConfig policies
+const (
+	TwoWayUpload = "upload" // put it back on Flickr, the default for deletes
+	TwoWayDelete = "delete" // delete the local file
+	TwoWayTrash  = "trash"  // move the local file to TwoWayConfig.Trash
+	TwoWayRename = "rename" // rename the local file to the new title
+	TwoWayIgnore = "ignore" // leave the local file alone, the default for title changes
+)
+
+const defaultTwoWayMaxDeletes = 10
+
+// name and window of the two way deletes allowance in the state db
+const (
+	twoWayAllowance       = "two_way_deletes"
+	twoWayAllowanceWindow = 24 * time.Hour
+)
+
+// What to do locally about changes made on Flickr to photos synced from here.
+// Changes are found by comparing the state db to a full listing of Flickr, so
+// it needs a state db. Only so many local files are deleted or trashed a day.
+type TwoWayConfig struct {
+	Enabled    bool   `json:"enabled"`
+	OnDelete   string `json:"on_delete"`   // upload, delete, trash or ignore
+	OnRename   string `json:"on_rename"`   // rename or ignore
+	Trash      string `json:"trash"`       // where trash moves files to
+	MaxDeletes int    `json:"max_deletes"` // most files deleted or trashed a day, 10 by default
+}
+
+// Check the policies make sense, dirs are the watched directories
+func (this *TwoWayConfig) Validate(dirs []WatchDirConfig) error {
+	switch this.OnDelete {
+	case "", TwoWayUpload, TwoWayDelete, TwoWayIgnore:
+	case TwoWayTrash:
+		if len(this.Trash) == 0 {
+			return fmt.Errorf("two_way: on_delete is trash but there is no trash dir")
+		}
+	default:
+		return fmt.Errorf("two_way: on_delete must be %s, %s, %s or %s", TwoWayUpload, TwoWayDelete, TwoWayTrash, TwoWayIgnore)
+	}
+
+	switch this.OnRename {
+	case "", TwoWayRename, TwoWayIgnore:
+	default:
+		return fmt.Errorf("two_way: on_rename must be %s or %s", TwoWayRename, TwoWayIgnore)
+	}
+	if this.MaxDeletes < 0 {
+		return fmt.Errorf("two_way: max_deletes can't be negative")
+	}
+
+	// the trash would be synced right back up
+	if len(this.Trash) > 0 {
+		for _, dir := range dirs {
+			if within(dir.Dir, this.Trash) {
+				return fmt.Errorf("two_way: the trash dir can't be inside %s", dir.Dir)
+			}
+		}
+	}
+	return nil
+}
+
+func (this *TwoWayConfig) GetOnDelete() string {
+	if len(this.OnDelete) == 0 {
+		return TwoWayUpload
+	}
+	return this.OnDelete
+}
+
+func (this *TwoWayConfig) GetOnRename() string {
+	if len(this.OnRename) == 0 {
+		return TwoWayIgnore
+	}
+	return this.OnRename
+}
+
+func (this *TwoWayConfig) GetMaxDeletes() int {
+	if this.MaxDeletes == 0 {
+		return defaultTwoWayMaxDeletes
+	}
+	return this.MaxDeletes
+}
+
+// Take one of the local files two way syncs may delete or trash today, false
+// when they're used up. Kept in the state db like the mirror deletes one.
+func (this *syncer) useTwoWayAllowance(config *PhotosyncConfig) bool {
+	if this.state == nil {
+		return true
+	}
+	ok, err := this.state.UseAllowance(twoWayAllowance, twoWayAllowanceWindow, config.TwoWay.GetMaxDeletes())
+	if err != nil {
+		log.Println("error reading sync state", err)
+		return false
+	}
+	return ok
+}
+
+// Where trash moves a file from a watched dir, keeping its place under the dir
+func (this *TwoWayConfig) trashPath(dirCfg *WatchDirConfig, path, photoId string) string {
+	rel, err := filepath.Rel(dirCfg.Dir, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	dest := filepath.Join(this.Trash, filepath.Base(filepath.Clean(dirCfg.Dir)), rel)
+
+	// don't lose an earlier file trashed from the same place
+	if _, err := os.Stat(dest); err == nil {
+		ext := filepath.Ext(dest)
+		dest = strings.TrimSuffix(dest, ext) + "_" + photoId + ext
+	}
+	return dest
+}
+
+// Whether path is dir or somewhere under it
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// A title made safe to use as a file name, empty if there's nothing left of it
+func safeFilename(title string) string {
+	name := strings.TrimSpace(strings.NewReplacer("/", "_", "\\", "_").Replace(title))
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
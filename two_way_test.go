@@ -0,0 +1,157 @@
+package photosync_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Reisender/photosync"
+	"github.com/Reisender/photosync/photosynctest"
+)
+
+// A watched dir of synced files with two way syncs on
+func twoWaySetup(t *testing.T, tw photosync.TwoWayConfig, files ...string) (*photosynctest.Server, *photosync.FlickrAPI, *photosync.PhotosyncConfig, *photosync.SyncState, string) {
+	srv := photosynctest.NewServer()
+	t.Cleanup(srv.Close)
+	dir := tempDir(t)
+	watch := filepath.Join(dir, "watch")
+	contents := make(map[string]string)
+	for _, name := range files {
+		contents[name+".jpg"] = name + name + name
+	}
+	writeFiles(t, watch, contents)
+	srv.AddPhoto("unrelated", "photo")
+
+	cfg := testConfig(srv)
+	cfg.WatchDir = []photosync.WatchDirConfig{{Dir: watch}}
+	cfg.WatchDir[0].CreateTemplates()
+	if len(tw.Trash) > 0 {
+		tw.Trash = filepath.Join(dir, tw.Trash)
+	}
+	cfg.TwoWay = tw
+	if err := cfg.TwoWay.Validate(cfg.WatchDir); err != nil {
+		t.Fatal(err)
+	}
+	api := photosync.NewFlickrAPI(&cfg)
+	state := openState(t, dir)
+
+	var out lockedBuffer
+	if got := runSync(t, api, &cfg, state, &out); got.uploaded != len(files) {
+		t.Fatalf("first sync %+v\n%s", got, out.String())
+	}
+	return srv, api, &cfg, state, watch
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestTwoWay(t *testing.T) {
+	for _, policy := range []string{photosync.TwoWayUpload, photosync.TwoWayDelete, photosync.TwoWayTrash, photosync.TwoWayIgnore} {
+		t.Run(policy, func(t *testing.T) {
+			tw := photosync.TwoWayConfig{Enabled: true, OnDelete: policy, OnRename: photosync.TwoWayRename, Trash: "trash"}
+			srv, api, cfg, state, watch := twoWaySetup(t, tw, "a", "b", "c")
+			var out lockedBuffer
+
+			srv.RemovePhoto(photoTitled(t, srv, "a").Id)
+			b := photoTitled(t, srv, "b")
+			srv.SetTitle(b.Id, "b renamed")
+			got := runSync(t, api, cfg, state, &out)
+			if got.failed != 0 {
+				t.Fatalf("sync %+v\n%s", got, out.String())
+			}
+
+			a := filepath.Join(watch, "a.jpg")
+			trashed := filepath.Join(cfg.TwoWay.Trash, "watch", "a.jpg")
+			switch policy {
+			case photosync.TwoWayUpload:
+				if got.uploaded != 1 || !exists(a) {
+					t.Fatal("not uploaded again", got.uploaded)
+				}
+			case photosync.TwoWayDelete:
+				if got.uploaded != 0 || exists(a) {
+					t.Fatal("not deleted", got.uploaded)
+				}
+			case photosync.TwoWayTrash:
+				if got.uploaded != 0 || exists(a) || !exists(trashed) {
+					t.Fatal("not trashed", got.uploaded)
+				}
+			case photosync.TwoWayIgnore:
+				if got.uploaded != 0 || !exists(a) {
+					t.Fatal("not left alone", got.uploaded)
+				}
+			}
+
+			renamed := filepath.Join(watch, "b renamed.jpg")
+			if !exists(renamed) {
+				t.Fatal("not renamed")
+			}
+			rec, err := state.GetFile(renamed)
+			if err != nil || rec == nil || rec.PhotoId != b.Id || rec.Title != "b renamed" {
+				t.Fatalf("renamed file's record %+v %v", rec, err)
+			}
+
+			if got := runSync(t, api, cfg, state, &out); got.uploaded != 0 || got.failed != 0 {
+				t.Fatalf("sync again %+v\n%s", got, out.String())
+			}
+		})
+	}
+}
+
+// A photo the listing missed is still there, only Flickr not finding it
+// means it was deleted
+func TestTwoWayListingMissed(t *testing.T) {
+	tw := photosync.TwoWayConfig{Enabled: true, OnDelete: photosync.TwoWayDelete}
+	srv, api, cfg, state, watch := twoWaySetup(t, tw, "a", "b")
+	var out lockedBuffer
+
+	if err := state.DeleteRemote(photoTitled(t, srv, "a").Id); err != nil {
+		t.Fatal(err)
+	}
+	// what's left of the listing, keyed by title as Sync takes it
+	saved, err := state.RemotePhotos("photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	photos := photosync.PhotosMap{}
+	for _, p := range *saved {
+		photos[p.Title] = p
+	}
+	albums := &photosync.AlbumsMap{}
+	_, _, up, er, err := photosync.Sync(api, cfg, state, &photos, &photosync.PhotosMap{}, albums, &photosync.Options{Out: &out})
+	if err != nil || up != 0 || er != 0 {
+		t.Fatalf("sync %d uploaded %d failed %v\n%s", up, er, err, out.String())
+	}
+	if !exists(filepath.Join(watch, "a.jpg")) {
+		t.Fatal("deleted a file whose photo is still on Flickr")
+	}
+	if n := srv.Calls("flickr.photos.getInfo"); n != 1 {
+		t.Fatal("getInfo calls", n)
+	}
+}
+
+// Only so many local files are deleted a day
+func TestTwoWayMaxDeletes(t *testing.T) {
+	tw := photosync.TwoWayConfig{Enabled: true, OnDelete: photosync.TwoWayDelete, MaxDeletes: 2}
+	srv, api, cfg, state, watch := twoWaySetup(t, tw, "a", "b", "c", "d")
+	var out lockedBuffer
+
+	for _, title := range []string{"a", "b", "c"} {
+		srv.RemovePhoto(photoTitled(t, srv, title).Id)
+	}
+	runSync(t, api, cfg, state, &out)
+	runSync(t, api, cfg, state, &out)
+	left := 0
+	for _, name := range []string{"a", "b", "c"} {
+		if exists(filepath.Join(watch, name+".jpg")) {
+			left++
+		}
+	}
+	if left != 1 {
+		t.Fatal("files left", left)
+	}
+	if !exists(filepath.Join(watch, "d.jpg")) {
+		t.Fatal("deleted a file still on Flickr")
+	}
+}
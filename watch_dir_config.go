@@ -2,7 +2,11 @@ package photosync
 
 import (
 	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
 	"text/template"
+	"time"
 )
 
 type WatchDirConfig struct {
@@ -10,16 +14,47 @@ type WatchDirConfig struct {
 	Tags     string
 	tagsTmpl *template.Template
 	Albums   []string
+
+	Gpx           string   `json:"gpx"`            // track log to place photos without GPS, relative to Dir
+	GpxMaxGap     Duration `json:"gpx_max_gap"`    // how far from a track point a photo can be, defaults to 5m
+	GeoAccuracy   int      `json:"geo_accuracy"`   // 1 (world) to 16 (street), defaults to 16
+	StripLocation bool     `json:"strip_location"` // upload without any location at all
+	gpx           *GpxTrack
+
+	Include []string `json:"include"` // media types, photo/video or extensions to sync, everything when empty
+	Exclude []string `json:"exclude"` // media types, photo/video or extensions to leave alone
+	Raw     string   `json:"raw"`     // skip (default), preview or convert
+
+	Ignore []string `json:"ignore"` // name patterns of files and folders to leave out, like .thumbnails
+
+	Watcher      string   `json:"watcher"`       // fsnotify (default) or poll, how the daemon notices changes
+	PollInterval Duration `json:"poll_interval"` // how often poll looks for changes, 10s by default
 }
 
+// the most precise accuracy Flickr takes
+const maxGeoAccuracy = 16
+
 func (this *WatchDirConfig) CreateTemplates() {
-	this.tagsTmpl = template.Must(template.New("tagsTmpl").Parse(this.Tags))
+	if err := this.LoadTemplates(); err != nil {
+		panic(err)
+	}
+}
+
+// CreateTemplates that returns a bad template instead of panicking
+func (this *WatchDirConfig) LoadTemplates() error {
+	tmpl, err := template.New("tagsTmpl").Parse(this.Tags)
+	if err != nil {
+		return fmt.Errorf("%s: tags: %v", this.Dir, err)
+	}
+	this.tagsTmpl = tmpl
+	return nil
 }
 
 func (this *WatchDirConfig) GetTags(context *DynamicValueContext) (string, error) {
 	tags := new(bytes.Buffer)
 
-	if err := this.tagsTmpl.Execute(tags, *context); err != nil {
+	// the context methods have pointer receivers so don't deref it
+	if err := this.tagsTmpl.Execute(tags, context); err != nil {
 		return this.Tags, err
 	}
 
@@ -29,3 +64,109 @@ func (this *WatchDirConfig) GetTags(context *DynamicValueContext) (string, error
 func (this *WatchDirConfig) GetAlbums(context *DynamicValueContext) []string {
 	return this.Albums
 }
+
+// Check the geotagging settings and load the GPX track if there is one
+func (this *WatchDirConfig) LoadGeo() error {
+	if this.GeoAccuracy < 0 || this.GeoAccuracy > maxGeoAccuracy {
+		return fmt.Errorf("%s: geo_accuracy must be between 1 and %d", this.Dir, maxGeoAccuracy)
+	}
+
+	if len(this.Gpx) == 0 || this.StripLocation {
+		return nil
+	}
+
+	path := this.Gpx
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(this.Dir, path)
+	}
+	track, err := LoadGpx(path)
+	if err != nil {
+		return fmt.Errorf("%s: loading gpx: %v", this.Dir, err)
+	}
+	this.gpx = track
+	return nil
+}
+
+// Where to put a photo on the map, from its GPS data or else the GPX track
+func (this *WatchDirConfig) GetLocation(exif *ExifToolOutput) (float64, float64, bool) {
+	if this.StripLocation {
+		return 0, 0, false
+	}
+
+	if lat, lon, ok := exif.Position(); ok {
+		return lat, lon, true
+	}
+
+	if this.gpx != nil {
+		if t, ok := exif.DateTaken(); ok {
+			return this.gpx.Position(t, time.Duration(this.GpxMaxGap))
+		}
+	}
+
+	return 0, 0, false
+}
+
+func (this *WatchDirConfig) GetGeoAccuracy() int {
+	if this.GeoAccuracy == 0 {
+		return maxGeoAccuracy
+	}
+	return this.GeoAccuracy
+}
+
+// Check the include, exclude and raw settings
+func (this *WatchDirConfig) LoadMedia() error {
+	if err := validMediaNames(this.Include); err != nil {
+		return fmt.Errorf("%s: include: %v", this.Dir, err)
+	}
+	if err := validMediaNames(this.Exclude); err != nil {
+		return fmt.Errorf("%s: exclude: %v", this.Dir, err)
+	}
+
+	for _, pattern := range this.Ignore {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: ignore %q: %v", this.Dir, pattern, err)
+		}
+	}
+
+	switch this.Raw {
+	case "", RawSkip, RawPreview, RawConvert:
+	default:
+		return fmt.Errorf("%s: raw must be %s, %s or %s", this.Dir, RawSkip, RawPreview, RawConvert)
+	}
+	return nil
+}
+
+// Whether files of this type with this extension get synced from the dir
+func (this *WatchDirConfig) Accepts(mt *MediaType, ext string) bool {
+	if len(this.Include) > 0 && !mt.matches(this.Include, ext) {
+		return false
+	}
+	return !mt.matches(this.Exclude, ext)
+}
+
+// Whether the path is left out because it, or a folder it's in under Dir,
+// matches an ignore pattern
+func (this *WatchDirConfig) Ignores(path string) bool {
+	if len(this.Ignore) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(this.Dir, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		for _, pattern := range this.Ignore {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (this *WatchDirConfig) GetRaw() string {
+	if len(this.Raw) == 0 {
+		return RawSkip
+	}
+	return this.Raw
+}
@@ -0,0 +1,325 @@
+package photosync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-fsnotify/fsnotify"
+)
+
+// names for WatchDirConfig.Watcher
+const (
+	WatcherNotify = "fsnotify" // the OS reports changes, the default
+	WatcherPoll   = "poll"     // look for changes every poll interval, for shares that don't report them
+)
+
+const defaultPollInterval = 10 * time.Second
+
+// What happened to a file or folder, like fsnotify.Op
+type WatchOp uint32
+
+const (
+	WatchCreate WatchOp = 1 << iota
+	WatchWrite
+	WatchRemove
+	WatchRename
+	WatchChmod
+)
+
+// A change to a file or folder in a watched folder
+type WatchEvent struct {
+	Name string
+	Op   WatchOp
+}
+
+// Reports changes in folders. Only what's directly in a folder is watched,
+// folders under it have to be added too.
+type Watcher interface {
+	Add(dir string) error
+	Remove(dir string) error
+	Events() <-chan WatchEvent
+	Errors() <-chan error
+	Close() error
+}
+
+// Check the watcher settings
+func (this *WatchDirConfig) LoadWatcher() error {
+	switch this.Watcher {
+	case "", WatcherNotify, WatcherPoll:
+	default:
+		return fmt.Errorf("%s: watcher must be %s or %s", this.Dir, WatcherNotify, WatcherPoll)
+	}
+	if this.PollInterval < 0 {
+		return fmt.Errorf("%s: poll_interval can't be negative", this.Dir)
+	}
+	return nil
+}
+
+func (this *WatchDirConfig) GetWatcher() string {
+	if len(this.Watcher) == 0 {
+		return WatcherNotify
+	}
+	return this.Watcher
+}
+
+func (this *WatchDirConfig) GetPollInterval() time.Duration {
+	if this.PollInterval == 0 {
+		return defaultPollInterval
+	}
+	return this.PollInterval.Duration()
+}
+
+// Start the kind of watcher the dir config asks for
+func NewWatcher(dirCfg *WatchDirConfig) (Watcher, error) {
+	if dirCfg.GetWatcher() == WatcherPoll {
+		return NewPollWatcher(dirCfg.GetPollInterval()), nil
+	}
+	return NewNotifyWatcher()
+}
+
+// A Watcher the OS tells about changes, through fsnotify
+type notifyWatcher struct {
+	watcher *fsnotify.Watcher
+	events  chan WatchEvent
+	done    chan struct{}
+	once    sync.Once
+}
+
+func NewNotifyWatcher() (Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	this := &notifyWatcher{watcher: w, events: make(chan WatchEvent), done: make(chan struct{})}
+	go this.run()
+	return this, nil
+}
+
+func (this *notifyWatcher) run() {
+	defer close(this.events)
+	for event := range this.watcher.Events {
+		var op WatchOp
+		if event.Op&fsnotify.Create != 0 {
+			op |= WatchCreate
+		}
+		if event.Op&fsnotify.Write != 0 {
+			op |= WatchWrite
+		}
+		if event.Op&fsnotify.Remove != 0 {
+			op |= WatchRemove
+		}
+		if event.Op&fsnotify.Rename != 0 {
+			op |= WatchRename
+		}
+		if event.Op&fsnotify.Chmod != 0 {
+			op |= WatchChmod
+		}
+		select {
+		case this.events <- WatchEvent{event.Name, op}:
+		case <-this.done:
+			return
+		}
+	}
+}
+
+func (this *notifyWatcher) Add(dir string) error {
+	return this.watcher.Add(dir)
+}
+
+func (this *notifyWatcher) Remove(dir string) error {
+	return this.watcher.Remove(dir)
+}
+
+func (this *notifyWatcher) Events() <-chan WatchEvent {
+	return this.events
+}
+
+func (this *notifyWatcher) Errors() <-chan error {
+	return this.watcher.Errors
+}
+
+func (this *notifyWatcher) Close() error {
+	this.once.Do(func() { close(this.done) })
+	return this.watcher.Close()
+}
+
+// A Watcher that lists the folders every interval and compares them to the
+// last listing, for network shares and the like that don't report changes.
+// A folder that can't be listed keeps its last listing, so a share that
+// drops out for a while doesn't look emptied.
+type pollWatcher struct {
+	interval time.Duration
+	events   chan WatchEvent
+	errors   chan error
+	done     chan struct{}
+	once     sync.Once
+
+	mu   sync.Mutex
+	dirs map[string]map[string]os.FileInfo // the last listing of each folder by name
+}
+
+func NewPollWatcher(interval time.Duration) Watcher {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	this := &pollWatcher{
+		interval: interval,
+		events:   make(chan WatchEvent),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+		dirs:     make(map[string]map[string]os.FileInfo),
+	}
+	go this.run()
+	return this
+}
+
+func (this *pollWatcher) Add(dir string) error {
+	dir = filepath.Clean(dir)
+	listing, err := listDir(dir)
+	if err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, ok := this.dirs[dir]; !ok {
+		this.dirs[dir] = listing
+	}
+	return nil
+}
+
+func (this *pollWatcher) Remove(dir string) error {
+	dir = filepath.Clean(dir)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, ok := this.dirs[dir]; !ok {
+		return fmt.Errorf("can't remove non-existent watch: %s", dir)
+	}
+	delete(this.dirs, dir)
+	return nil
+}
+
+func (this *pollWatcher) Events() <-chan WatchEvent {
+	return this.events
+}
+
+func (this *pollWatcher) Errors() <-chan error {
+	return this.errors
+}
+
+func (this *pollWatcher) Close() error {
+	this.once.Do(func() { close(this.done) })
+	return nil
+}
+
+func (this *pollWatcher) run() {
+	tick := time.NewTicker(this.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-tick.C:
+			this.poll()
+		}
+	}
+}
+
+// List every folder and report what changed since the last time
+func (this *pollWatcher) poll() {
+	this.mu.Lock()
+	dirs := make([]string, 0, len(this.dirs))
+	for dir := range this.dirs {
+		dirs = append(dirs, dir)
+	}
+	this.mu.Unlock()
+
+	for _, dir := range dirs {
+		listing, err := listDir(dir)
+		if err != nil {
+			// gone folders are reported by the folder they were in
+			if !os.IsNotExist(err) && !this.send(nil, err) {
+				return
+			}
+			continue
+		}
+
+		this.mu.Lock()
+		last, ok := this.dirs[dir]
+		if ok {
+			this.dirs[dir] = listing
+		}
+		this.mu.Unlock()
+		if !ok {
+			continue // removed while listing it
+		}
+
+		for _, event := range diffListings(dir, last, listing) {
+			if !this.send(&event, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Hand on an event or error, false once the watcher is closed
+func (this *pollWatcher) send(event *WatchEvent, err error) bool {
+	if event != nil {
+		select {
+		case this.events <- *event:
+			return true
+		case <-this.done:
+			return false
+		}
+	}
+	select {
+	case this.errors <- err:
+		return true
+	case <-this.done:
+		return false
+	}
+}
+
+// What's in a folder by name
+func listDir(dir string) (map[string]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	listing := make(map[string]os.FileInfo, len(infos))
+	for _, f := range infos {
+		listing[f.Name()] = f
+	}
+	return listing, nil
+}
+
+// The events that turn one listing of a folder into the next. A file that
+// changes to a folder or back is removed and created again, and changes to
+// what's in a folder under it are left to that folder's listing.
+func diffListings(dir string, last, listing map[string]os.FileInfo) []WatchEvent {
+	var events []WatchEvent
+	for name, was := range last {
+		path := filepath.Join(dir, name)
+		now, ok := listing[name]
+		switch {
+		case !ok || now.IsDir() != was.IsDir():
+			events = append(events, WatchEvent{path, WatchRemove})
+		case now.IsDir():
+		case now.Size() != was.Size() || !now.ModTime().Equal(was.ModTime()):
+			events = append(events, WatchEvent{path, WatchWrite})
+		case now.Mode() != was.Mode():
+			events = append(events, WatchEvent{path, WatchChmod})
+		}
+	}
+	for name, now := range listing {
+		if was, ok := last[name]; !ok || now.IsDir() != was.IsDir() {
+			events = append(events, WatchEvent{filepath.Join(dir, name), WatchCreate})
+		}
+	}
+	return events
+}
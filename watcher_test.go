@@ -0,0 +1,91 @@
+package photosync
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Just enough of a file for comparing listings
+type fakeInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (this fakeInfo) Name() string       { return this.name }
+func (this fakeInfo) Size() int64        { return this.size }
+func (this fakeInfo) Mode() os.FileMode  { return this.mode }
+func (this fakeInfo) ModTime() time.Time { return this.modTime }
+func (this fakeInfo) IsDir() bool        { return this.mode.IsDir() }
+func (this fakeInfo) Sys() interface{}   { return nil }
+
+func TestDiffListings(t *testing.T) {
+	dir := filepath.Join("watched", "dir")
+	then := time.Date(2016, 5, 1, 10, 10, 10, 0, time.UTC)
+	file := func(name string, size int64) fakeInfo {
+		return fakeInfo{name: name, size: size, mode: 0644, modTime: then}
+	}
+	folder := func(name string) fakeInfo {
+		return fakeInfo{name: name, mode: os.ModeDir | 0755, modTime: then}
+	}
+	listing := func(infos ...fakeInfo) map[string]os.FileInfo {
+		m := make(map[string]os.FileInfo)
+		for _, f := range infos {
+			m[f.name] = f
+		}
+		return m
+	}
+	touched := file("a.jpg", 3)
+	touched.modTime = then.Add(time.Second)
+	chmodded := file("a.jpg", 3)
+	chmodded.mode = 0600
+	both := file("a.jpg", 4)
+	both.mode = 0600
+	subTouched := folder("sub")
+	subTouched.modTime = then.Add(time.Second)
+
+	tests := []struct {
+		name       string
+		last, next map[string]os.FileInfo
+		want       []WatchEvent
+	}{
+		{"nothing", listing(), listing(), nil},
+		{"unchanged", listing(file("a.jpg", 3), folder("sub")), listing(file("a.jpg", 3), folder("sub")), nil},
+		{"created", listing(), listing(file("a.jpg", 3)), []WatchEvent{{"a.jpg", WatchCreate}}},
+		{"folder created", listing(), listing(folder("sub")), []WatchEvent{{"sub", WatchCreate}}},
+		{"removed", listing(file("a.jpg", 3)), listing(), []WatchEvent{{"a.jpg", WatchRemove}}},
+		{"folder removed", listing(folder("sub")), listing(), []WatchEvent{{"sub", WatchRemove}}},
+		{"size changed", listing(file("a.jpg", 3)), listing(file("a.jpg", 4)), []WatchEvent{{"a.jpg", WatchWrite}}},
+		{"mod time changed", listing(file("a.jpg", 3)), listing(touched), []WatchEvent{{"a.jpg", WatchWrite}}},
+		{"mode changed", listing(file("a.jpg", 3)), listing(chmodded), []WatchEvent{{"a.jpg", WatchChmod}}},
+		{"written and mode changed", listing(file("a.jpg", 3)), listing(both), []WatchEvent{{"a.jpg", WatchWrite}}},
+		{"renamed", listing(file("a.jpg", 3)), listing(file("b.jpg", 3)), []WatchEvent{{"a.jpg", WatchRemove}, {"b.jpg", WatchCreate}}},
+		{"renamed over another", listing(file("a.jpg", 3), file("b.jpg", 5)), listing(file("b.jpg", 3)), []WatchEvent{{"a.jpg", WatchRemove}, {"b.jpg", WatchWrite}}},
+		{"file to folder", listing(file("a", 3)), listing(folder("a")), []WatchEvent{{"a", WatchRemove}, {"a", WatchCreate}}},
+		{"folder to file", listing(folder("a")), listing(file("a", 3)), []WatchEvent{{"a", WatchRemove}, {"a", WatchCreate}}},
+		{"changes in a folder are left to it", listing(folder("sub")), listing(subTouched), nil},
+		{"several", listing(file("a.jpg", 3), file("b.jpg", 3), folder("sub")), listing(file("a.jpg", 4), file("c.jpg", 3), folder("sub")),
+			[]WatchEvent{{"a.jpg", WatchWrite}, {"b.jpg", WatchRemove}, {"c.jpg", WatchCreate}}},
+	}
+	for _, test := range tests {
+		var want []WatchEvent
+		for _, e := range test.want {
+			want = append(want, WatchEvent{filepath.Join(dir, e.Name), e.Op})
+		}
+		got := diffListings(dir, test.last, test.next)
+		sort.Slice(got, func(i, j int) bool {
+			if got[i].Name != got[j].Name {
+				return got[i].Name < got[j].Name
+			}
+			return got[i].Op > got[j].Op // removes before creates
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, want)
+		}
+	}
+}